@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"text/tabwriter"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/crypto"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/postgres"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/web"
+)
+
+const usage = `usage: heroku-addon [command]
+
+With no command the web server is started.
+
+commands:
+  migrate up           apply all pending migrations
+  migrate down [n]     roll back the last n migrations (default 1)
+  migrate status       list migrations and whether they are applied
+  rotate-keys [n]      re-seal stored secrets with the active key and bind them
+                       to their row, n rows per batch (default 100)
+  stripe-events list [status]
+                       list recorded stripe webhook events with the given
+                       status (default failed)
+  stripe-events replay <id>...
+                       process recorded stripe webhook events again
+  instance-deletions list [outcome]
+                       list instances deleted by customers with the given
+                       subscription cancellation outcome (default failed)`
+
+const defaultRotateBatchSize = 100
+
+// runCommand runs the command in args. newWebServer is only called by
+// commands that process events.
+func runCommand(postgresClient postgres.Client, cryptoUtil crypto.Util, newWebServer func() (web.WebServer, error), args []string) error {
+	switch args[0] {
+	case "migrate":
+		return runMigrate(postgresClient, args[1:])
+	case "rotate-keys":
+		return runRotateKeys(postgresClient, cryptoUtil, args[1:])
+	case "stripe-events":
+		return runStripeEvents(postgresClient, newWebServer, args[1:])
+	case "instance-deletions":
+		return runInstanceDeletions(postgresClient, args[1:])
+	default:
+		return fmt.Errorf("unknown command %q\n%s", args[0], usage)
+	}
+}
+
+func runMigrate(postgresClient postgres.Client, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing migrate subcommand\n%s", usage)
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "up":
+		applied, err := postgresClient.MigrateUp(ctx)
+		if err != nil {
+			return err
+		}
+		logger.Infof("applied %d migrations", applied)
+
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid number of migrations to roll back: %s", args[1])
+			}
+			steps = n
+		}
+
+		rolledBack, err := postgresClient.MigrateDown(ctx, steps)
+		if err != nil {
+			return err
+		}
+		logger.Infof("rolled back %d migrations", rolledBack)
+
+	case "status":
+		statuses, err := postgresClient.MigrationStatus(ctx)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range statuses {
+			appliedAt := "pending"
+			if s.Applied {
+				appliedAt = s.AppliedAt.Format("2006-01-02 15:04:05 MST")
+			}
+			fmt.Fprintf(tw, "%d\t%s\t%s\n", s.Version, s.Name, appliedAt)
+		}
+		return tw.Flush()
+
+	default:
+		return fmt.Errorf("unknown migrate subcommand %q\n%s", args[0], usage)
+	}
+
+	return nil
+}
+
+func runRotateKeys(postgresClient postgres.Client, cryptoUtil crypto.Util, args []string) error {
+	batchSize := defaultRotateBatchSize
+	if len(args) > 0 {
+		n, err := strconv.Atoi(args[0])
+		if err != nil || n < 1 {
+			return fmt.Errorf("invalid batch size: %s", args[0])
+		}
+		batchSize = n
+	}
+
+	ctx := context.Background()
+	logger.Infof("re-encrypting with key %s, known keys: %v", cryptoUtil.ActiveKeyID(), cryptoUtil.KeyIDs())
+
+	accounts, err := postgresClient.ReencryptAccountTokens(ctx, cryptoUtil, batchSize)
+	if err != nil {
+		return fmt.Errorf("re-encrypting account tokens after updating %d accounts: %w", accounts, err)
+	}
+	logger.Infof("re-encrypted tokens for %d accounts", accounts)
+
+	instances, err := postgresClient.ReencryptInstanceConfigVars(ctx, cryptoUtil, batchSize)
+	if err != nil {
+		return fmt.Errorf("re-encrypting instance config vars after updating %d instances: %w", instances, err)
+	}
+	logger.Infof("re-encrypted config vars for %d instances", instances)
+
+	return nil
+}
+
+func runStripeEvents(postgresClient postgres.Client, newWebServer func() (web.WebServer, error), args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing stripe-events subcommand\n%s", usage)
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "list":
+		status := account.StripeEventStatusFailed
+		if len(args) > 1 {
+			status = account.StripeEventStatus(args[1])
+		}
+
+		events, err := postgresClient.GetStripeEventsByStatus(ctx, status)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tTYPE\tSTATUS\tATTEMPTS\tRECEIVED AT\tERROR")
+		for _, e := range events {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%d\t%s\t%s\n", e.ID, e.Type, e.Status, e.Attempts, e.ReceivedAt.Format("2006-01-02 15:04:05 MST"), e.LastError)
+		}
+		return tw.Flush()
+
+	case "replay":
+		if len(args) < 2 {
+			return fmt.Errorf("missing event id\n%s", usage)
+		}
+
+		webServer, err := newWebServer()
+		if err != nil {
+			return fmt.Errorf("creating web server: %w", err)
+		}
+
+		var failed int
+		for _, id := range args[1:] {
+			err := webServer.ReplayStripeEvent(ctx, id)
+			if err != nil {
+				logger.Errorf("replaying stripe event %s: %s", id, err)
+				failed++
+				continue
+			}
+			logger.Infof("replayed stripe event %s", id)
+		}
+
+		if failed > 0 {
+			return fmt.Errorf("%d of %d events failed", failed, len(args)-1)
+		}
+
+	default:
+		return fmt.Errorf("unknown stripe-events subcommand %q\n%s", args[0], usage)
+	}
+
+	return nil
+}
+
+func runInstanceDeletions(postgresClient postgres.Client, args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("missing instance-deletions subcommand\n%s", usage)
+	}
+
+	ctx := context.Background()
+	switch args[0] {
+	case "list":
+		outcome := "failed"
+		if len(args) > 1 {
+			outcome = args[1]
+		}
+
+		deletions, err := postgresClient.GetInstanceDeletions(ctx, outcome)
+		if err != nil {
+			return err
+		}
+
+		tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "ACCOUNT\tINSTANCE\tSUBSCRIPTION\tOUTCOME\tDELETED AT\tERROR")
+		for _, d := range deletions {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\n", d.AccountID, d.InstanceID, d.SubscriptionID, d.Outcome, d.DeletedAt.Format("2006-01-02 15:04:05 MST"), d.Error)
+		}
+		return tw.Flush()
+
+	default:
+		return fmt.Errorf("unknown instance-deletions subcommand %q\n%s", args[0], usage)
+	}
+}
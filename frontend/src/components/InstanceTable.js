@@ -25,6 +25,8 @@ const InstanceTable = (props) => {
             <TableRow>
                 <TableCell><strong>Name</strong></TableCell>
                 <TableCell align="left"><strong>Plan</strong></TableCell>
+                <TableCell align="left"><strong>Status</strong></TableCell>
+                <TableCell align="left"><strong>Renews</strong></TableCell>
                 <TableCell align="right"><strong>Actions</strong></TableCell>
             </TableRow>
             </TableHead>
@@ -38,6 +40,10 @@ const InstanceTable = (props) => {
                     <Button variant="text">{row.name}</Button>
                 </TableCell>
                 <TableCell align="left">{row.plan.toUpperCase()}</TableCell>
+                <TableCell align="left">{row.status}</TableCell>
+                <TableCell align="left">
+                    {row.subscription ? new Date(row.subscription.currentPeriodEnd).toLocaleDateString() : "-"}
+                </TableCell>
                 <TableCell align="right">
                     {(props.user.provenance === "heroku") ? (
                         <Button onClick={handleHerokuEdit} size="small" variant="outlined">Edit</Button>
@@ -1,4 +1,104 @@
+import { useEffect, useState } from 'react';
 import { Outlet } from "react-router-dom";
+import { Button } from '@mui/material';
+import Table from '@mui/material/Table';
+import TableBody from '@mui/material/TableBody';
+import TableCell from '@mui/material/TableCell';
+import TableContainer from '@mui/material/TableContainer';
+import TableHead from '@mui/material/TableHead';
+import TableRow from '@mui/material/TableRow';
+import Paper from '@mui/material/Paper';
+
+const Billing = () => {
+  var [invoices, setInvoices] = useState([]);
+  var [hasMore, setHasMore] = useState(false);
+  const [portalDisabled, setPortalDisabled] = useState(false);
+
+  const loadInvoices = (startingAfter) => {
+    var url = "/api/billing/invoices"
+    if (startingAfter) {
+      url += "?starting_after=" + encodeURIComponent(startingAfter)
+    }
+    fetch(url, {
+      method: 'GET',
+      credentials: 'same-origin',
+      headers: {
+        'Content-Type': 'application/json'
+      },
+      referrerPolicy: 'no-referrer'
+    })
+    .then(r => r.json())
+    .then(r => {
+      if (r.error) {
+        alert("failed to get invoices: " + r.error)
+        return
+      }
+      setInvoices(state => startingAfter ? [...state, ...r.invoices] : r.invoices)
+      setHasMore(r.hasMore)
+    })
+  }
+
+  useEffect(() => {
+    loadInvoices()
+  }, [])
+
+  const handleManageBilling = () => {
+    setPortalDisabled(true)
+    fetch("/api/billing/portal", {
+      method: 'POST',
+      credentials: 'same-origin',
+      headers: {
+        'Content-Type': 'application/json'
+      },
+      referrerPolicy: 'no-referrer'
+    })
+    .then(r => r.json())
+    .then(r => {
+      if (r.status === 'success') {
+        window.location.href = r.url
+      } else {
+        alert("failed to open billing portal: " + r.error)
+        setPortalDisabled(false)
+      }
+    })
+  }
+
+  return (
+    <>
+    <h1>Billing</h1>
+    <Button disabled={portalDisabled} onClick={handleManageBilling} size="small" variant="outlined">Manage Billing</Button>
+    <TableContainer component={Paper}>
+      <Table sx={{ minWidth: 650 }} aria-label="invoices">
+        <TableHead>
+          <TableRow>
+            <TableCell><strong>Number</strong></TableCell>
+            <TableCell align="left"><strong>Date</strong></TableCell>
+            <TableCell align="left"><strong>Amount</strong></TableCell>
+            <TableCell align="left"><strong>Status</strong></TableCell>
+            <TableCell align="right"><strong>Receipt</strong></TableCell>
+          </TableRow>
+        </TableHead>
+        <TableBody>
+          {invoices.map((row) => (
+            <TableRow key={row.id}>
+              <TableCell component="th" scope="row">{row.number}</TableCell>
+              <TableCell align="left">{new Date(row.created).toLocaleDateString()}</TableCell>
+              <TableCell align="left">${(row.amountDue / 100).toFixed(2)}</TableCell>
+              <TableCell align="left">{row.status}</TableCell>
+              <TableCell align="right">
+                {row.pdf ? <Button href={row.pdf} size="small" variant="text">Download</Button> : "-"}
+              </TableCell>
+            </TableRow>
+          ))}
+        </TableBody>
+      </Table>
+    </TableContainer>
+    {hasMore && (
+      <Button onClick={() => loadInvoices(invoices[invoices.length - 1].id)} size="small" variant="outlined">Load More</Button>
+    )}
+    </>
+  );
+}
 
 const Account = (props) => {
   return (
@@ -6,6 +106,9 @@ const Account = (props) => {
     <h1>Account</h1>
     <h3>Email: {props.user.email}</h3>
     <h3>Login Method: {props.user.provenance}</h3>
+    {props.user.provenance && props.user.provenance !== "heroku" && (
+      <Billing />
+    )}
     <Outlet />
   </>
   );
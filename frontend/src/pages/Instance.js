@@ -50,9 +50,9 @@ const CreateInstance = (props) => {
         label="Plan"
         onChange={handleUpdateInstancePlan}
       >
-      <MenuItem value={"free"}>Free (${LookupPrice(props.pricing, 'free').price}/month)</MenuItem>
-      <MenuItem value={"staging"}>Staging (${LookupPrice(props.pricing, 'staging').price}/month)</MenuItem>
-      <MenuItem value={"production"}>Production (${LookupPrice(props.pricing, 'production').price}/month)</MenuItem>
+      {props.pricing.map((plan) => (
+        <MenuItem key={plan.name} value={plan.name}>{plan.displayName} (${plan.price}/month)</MenuItem>
+      ))}
     </Select>
   </FormControl>
   <Button onClick={handleCreateInstance} size="small" variant="outlined">Review</Button>
@@ -142,18 +142,48 @@ const EditInstance = (props) => {
   const location = useLocation();
   var [instanceName, setInstanceName] = useState('');
   const [deleteDisabled, setDeleteDisabled] = useState(true);
+  var [newPlan, setNewPlan] = useState('');
+  const [planDisabled, setPlanDisabled] = useState(false);
+  const [clientSecret, setClientSecret] = useState("");
+
+  const handleUpdatePlan = (event) => {
+    setNewPlan(event.target.value)
+  }
+
+  const handleChangePlan = () => {
+    setPlanDisabled(true)
+    fetch(`/api/instances/${location.state.id}/plan`, {
+      method: 'PUT',
+      credentials: 'same-origin',
+      headers: {
+        'Content-Type': 'application/json'
+      },
+      referrerPolicy: 'no-referrer',
+      body: JSON.stringify({"plan": newPlan})
+    })
+    .then(r => r.json())
+    .then(r => {
+      if (r.status === 'success') {
+        navigate("/")
+      } else if (r.status === 'pending') {
+        if (r.clientSecret) {
+          setClientSecret(r.clientSecret)
+        } else {
+          alert("plan change requested, it will apply once the payment is confirmed")
+          navigate("/")
+        }
+      } else {
+        alert("failed to change plan: " + r.error)
+        setPlanDisabled(false)
+      }
+    })
+  }
 
   const handleInstanceName = (event) => {
     setInstanceName(event.target.value)
   }
 
-  const handleDeleteInstance = () => {
-    if (instanceName !== location.state.name) {
-      alert("Entered text did not equal " + location.state.name)
-      return
-    }
-
-    setDeleteDisabled(true)
+  const deleteInstance = (force) => {
     fetch("/api/delete-instance", {
       method: 'POST',
       credentials: 'same-origin',
@@ -161,19 +191,33 @@ const EditInstance = (props) => {
         'Content-Type': 'application/json'
       },
       referrerPolicy: 'no-referrer',
-      body: JSON.stringify({"id": location.state.id})
+      body: JSON.stringify({"id": location.state.id, "force": force})
     })
     .then(r => r.json())
     .then(r => {
       if (r.status === 'success') {
+        if (r.subscription === 'cancel_at_period_end') {
+          alert(location.state.name + " will be deleted at the end of the billing period")
+        }
         navigate("/")
+      } else if (!force && window.confirm("failed to cancel the subscription: " + r.error + ". Delete anyway?")) {
+        deleteInstance(true)
       } else {
-        alert("failed to delete nothing: " + r)
         setDeleteDisabled(false)
       }
     })
   }
 
+  const handleDeleteInstance = () => {
+    if (instanceName !== location.state.name) {
+      alert("Entered text did not equal " + location.state.name)
+      return
+    }
+
+    setDeleteDisabled(true)
+    deleteInstance(false)
+  }
+
   const handleBack = () => {
     navigate("/")
   }
@@ -194,6 +238,28 @@ const EditInstance = (props) => {
     <h3>Total: ${LookupPrice(props.pricing, location.state.plan).price}/month</h3>
     <br></br>
     <br></br>
+    <h1>Change Plan</h1>
+    <FormControl fullWidth>
+      <InputLabel id="new-plan">Plan</InputLabel>
+      <Select
+        labelId="new-plan"
+        value={newPlan}
+        label="Plan"
+        onChange={handleUpdatePlan}
+      >
+      {props.pricing.map((plan) => (
+        <MenuItem key={plan.name} value={plan.name}>{plan.displayName} (${plan.price}/month)</MenuItem>
+      ))}
+    </Select>
+    </FormControl>
+    <Button disabled={planDisabled || newPlan === ''} onClick={handleChangePlan} size="small" variant="outlined">Change Plan</Button>
+    {clientSecret && (
+      <Elements options={{clientSecret, appearance: {theme: 'stripe'}}} stripe={stripePromise}>
+        <CheckoutForm></CheckoutForm>
+      </Elements>
+    )}
+    <br></br>
+    <br></br>
     <h1>Delete Nothing</h1>
     <div>Are you sure you want to delete {location.state.name}? Type <i>{location.state.name}</i> to confirm deletion.</div>
     <TextField onChange={handleInstanceName} id="outlined-basic" label="Name" variant="outlined" />
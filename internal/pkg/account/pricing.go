@@ -0,0 +1,196 @@
+package account
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+type PricingPlan struct {
+	Name         string `json:"name"`
+	DisplayName  string `json:"displayName"`
+	PriceID      string `json:"priceID"`
+	PriceDollars int    `json:"price"`
+	// HerokuPlan is the slug Heroku sends when provisioning or changing to
+	// this plan.
+	HerokuPlan string         `json:"herokuPlan"`
+	Limits     map[string]int `json:"limits,omitempty"`
+	Features   []string       `json:"features,omitempty"`
+}
+
+// pricingPlanConfig is a plan as it is written in the pricing plans file,
+// with a Stripe price ID for each environment.
+type pricingPlanConfig struct {
+	Name         string            `json:"name"`
+	DisplayName  string            `json:"displayName"`
+	PriceIDs     map[string]string `json:"priceIDs"`
+	PriceDollars int               `json:"price"`
+	HerokuPlan   string            `json:"herokuPlan"`
+	Limits       map[string]int    `json:"limits"`
+	Features     []string          `json:"features"`
+}
+
+// UnknownPlan is returned when a plan is not in the catalog. ValidPlans lists
+// the plans that could have been requested instead.
+type UnknownPlan struct {
+	Plan       string
+	ValidPlans []string
+}
+
+func (m *UnknownPlan) Error() string {
+	return fmt.Sprintf("unknown plan %s, valid plans are %s", m.Plan, strings.Join(m.ValidPlans, ", "))
+}
+
+// PricingCatalog holds the plans offered in one environment.
+type PricingCatalog struct {
+	plans []PricingPlan
+}
+
+// LoadPricingCatalog reads the pricing plans file at path and resolves the
+// Stripe price IDs for env. Plans without a price ID for env are still
+// loaded, they can be provisioned through Heroku but not billed through
+// Stripe.
+func LoadPricingCatalog(path, env string) (PricingCatalog, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return PricingCatalog{}, fmt.Errorf("reading pricing plans file: %w", err)
+	}
+
+	var configs []pricingPlanConfig
+	err = json.Unmarshal(b, &configs)
+	if err != nil {
+		return PricingCatalog{}, fmt.Errorf("parsing pricing plans file %s: %w", path, err)
+	}
+
+	plans := make([]PricingPlan, 0, len(configs))
+	for _, c := range configs {
+		priceID := c.PriceIDs[env]
+
+		// Stripe test and live mode prices are separate objects, an ID shared
+		// between environments can't be retrieved with one of the keys.
+		for otherEnv, otherID := range c.PriceIDs {
+			if priceID != "" && otherEnv != env && otherID == priceID {
+				return PricingCatalog{}, fmt.Errorf("plan %s uses stripe price id %s for both %s and %s", c.Name, priceID, env, otherEnv)
+			}
+		}
+
+		plans = append(plans, PricingPlan{
+			Name:         c.Name,
+			DisplayName:  c.DisplayName,
+			PriceID:      priceID,
+			PriceDollars: c.PriceDollars,
+			HerokuPlan:   c.HerokuPlan,
+			Limits:       c.Limits,
+			Features:     c.Features,
+		})
+	}
+
+	return NewPricingCatalog(plans)
+}
+
+// NewPricingCatalog returns a catalog of plans after checking that names and
+// Heroku plan slugs are set and unique, and that no two plans share a price
+// ID.
+func NewPricingCatalog(plans []PricingPlan) (PricingCatalog, error) {
+	if len(plans) == 0 {
+		return PricingCatalog{}, fmt.Errorf("no pricing plans configured")
+	}
+
+	var err error
+	names := map[string]bool{}
+	priceIDs := map[string]bool{}
+	herokuPlans := map[string]bool{}
+	for _, p := range plans {
+		if p.Name == "" {
+			err = errors.Join(err, fmt.Errorf("pricing plan is missing a name"))
+			continue
+		}
+		if p.HerokuPlan == "" {
+			err = errors.Join(err, fmt.Errorf("plan %s is missing a heroku plan", p.Name))
+		}
+		if p.PriceDollars < 0 {
+			err = errors.Join(err, fmt.Errorf("plan %s has a negative price", p.Name))
+		}
+
+		if names[p.Name] {
+			err = errors.Join(err, fmt.Errorf("plan %s is defined more than once", p.Name))
+		}
+		if p.PriceID != "" && priceIDs[p.PriceID] {
+			err = errors.Join(err, fmt.Errorf("plan %s reuses stripe price id %s", p.Name, p.PriceID))
+		}
+		if p.HerokuPlan != "" && herokuPlans[p.HerokuPlan] {
+			err = errors.Join(err, fmt.Errorf("plan %s reuses heroku plan %s", p.Name, p.HerokuPlan))
+		}
+		names[p.Name] = true
+		priceIDs[p.PriceID] = true
+		herokuPlans[p.HerokuPlan] = true
+	}
+
+	if err != nil {
+		return PricingCatalog{}, err
+	}
+
+	return PricingCatalog{plans: plans}, nil
+}
+
+// StripePriceID returns the ID of the Stripe price the plan is billed with,
+// or an error when the plan has no price in this environment.
+func (p PricingPlan) StripePriceID() (string, error) {
+	if p.PriceID == "" {
+		return "", fmt.Errorf("plan %s has no stripe price id in this environment", p.Name)
+	}
+	return p.PriceID, nil
+}
+
+// Plans returns the plans in the order they were configured.
+func (c PricingCatalog) Plans() []PricingPlan {
+	plans := make([]PricingPlan, len(c.plans))
+	copy(plans, c.plans)
+	return plans
+}
+
+// Names returns the names of the plans.
+func (c PricingCatalog) Names() []string {
+	names := make([]string, 0, len(c.plans))
+	for _, plan := range c.plans {
+		names = append(names, plan.Name)
+	}
+	return names
+}
+
+// LookupPricingPlan returns the plan with a name, or an UnknownPlan error.
+func (c PricingCatalog) LookupPricingPlan(name string) (PricingPlan, error) {
+	for _, plan := range c.plans {
+		if plan.Name == name {
+			return plan, nil
+		}
+	}
+	return PricingPlan{}, &UnknownPlan{Plan: name, ValidPlans: c.Names()}
+}
+
+// LookupPricingPlanByPriceID returns the plan billed with a Stripe price.
+func (c PricingCatalog) LookupPricingPlanByPriceID(priceID string) (PricingPlan, error) {
+	for _, plan := range c.plans {
+		if priceID != "" && plan.PriceID == priceID {
+			return plan, nil
+		}
+	}
+	return PricingPlan{}, fmt.Errorf("no plan uses stripe price %s", priceID)
+}
+
+// LookupHerokuPlan returns the plan for a Heroku plan slug, or an UnknownPlan
+// error listing the Heroku plan slugs.
+func (c PricingCatalog) LookupHerokuPlan(slug string) (PricingPlan, error) {
+	for _, plan := range c.plans {
+		if plan.HerokuPlan == slug {
+			return plan, nil
+		}
+	}
+	herokuPlans := make([]string, 0, len(c.plans))
+	for _, plan := range c.plans {
+		herokuPlans = append(herokuPlans, plan.HerokuPlan)
+	}
+	return PricingPlan{}, &UnknownPlan{Plan: slug, ValidPlans: herokuPlans}
+}
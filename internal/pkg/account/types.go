@@ -1,5 +1,7 @@
 package account
 
+import "time"
+
 type AccountType string
 
 const (
@@ -24,6 +26,13 @@ type Account struct {
 	AccessToken  string
 	RefreshToken string
 	StripeCustID string
+	// TokenExpiresAt is when AccessToken expires. The zero value is used for
+	// accounts without Heroku tokens, and for Heroku accounts created before
+	// expiry was tracked, whose tokens are treated as expired.
+	TokenExpiresAt time.Time
+	// DeprovisionedAt is set once a Heroku resource has been removed, the
+	// zero value means the account is active.
+	DeprovisionedAt time.Time
 }
 
 type Instance struct {
@@ -31,37 +40,97 @@ type Instance struct {
 	Id        string `json:"id"`
 	Plan      string `json:"plan"`
 	Name      string `json:"name"`
+	// ConfigVars are the connection details for the instance, they are
+	// stored encrypted and set as config vars on Heroku apps.
+	ConfigVars map[string]string `json:"config,omitempty"`
+	Status     InstanceStatus    `json:"status"`
+	// Subscription is the Stripe subscription that pays for the instance, it
+	// is nil for free and Heroku instances.
+	Subscription *Subscription `json:"subscription,omitempty"`
+	// PaymentFailedAt is when the latest renewal of the subscription failed,
+	// the zero value means payments are up to date.
+	PaymentFailedAt time.Time `json:"-"`
 }
 
-type PricingPlan struct {
-	Name         string `json:"name"`
-	PriceID      string `json:"priceID"`
-	PriceDollars int    `json:"price"`
+type InstanceStatus string
+
+const (
+	// InstanceStatusPending instances are waiting for the first payment of
+	// their subscription.
+	InstanceStatusPending   InstanceStatus = "pending"
+	InstanceStatusActive    InstanceStatus = "active"
+	InstanceStatusSuspended InstanceStatus = "suspended"
+)
+
+// Subscription is the billing state of an instance as last reported by
+// Stripe.
+type Subscription struct {
+	ID               string    `json:"id"`
+	PriceID          string    `json:"priceID"`
+	Status           string    `json:"status"`
+	CurrentPeriodEnd time.Time `json:"currentPeriodEnd"`
+	// CancelAtPeriodEnd is set when the subscription has been cancelled but
+	// the instance keeps running until the end of the paid period.
+	CancelAtPeriodEnd bool `json:"cancelAtPeriodEnd"`
 }
 
-var PricingPlans = []PricingPlan{
-	{
-		Name:         "free",
-		PriceID:      "price_1NpNZUGmaA1TfgH4vQUS0mw3",
-		PriceDollars: 0,
-	},
-	{
-		Name:         "staging",
-		PriceID:      "price_1NpNZUGmaA1TfgH41kduGxJ8",
-		PriceDollars: 10,
-	},
-	{
-		Name:         "production",
-		PriceID:      "price_1NpNZUGmaA1TfgH4yXZg6urh",
-		PriceDollars: 35,
-	},
+// InstanceDeletion records a customer deleting an instance and what happened
+// to its Stripe subscription, so that deletions whose cancellation failed can
+// be found and reconciled after the instance is gone.
+type InstanceDeletion struct {
+	AccountID      string
+	InstanceID     string
+	SubscriptionID string
+	// Outcome is the cancellation outcome, for example "cancelled" or
+	// "failed".
+	Outcome   string
+	Error     string
+	DeletedAt time.Time
 }
 
-func LookupPricingPlan(name string) PricingPlan {
-	for _, plan := range PricingPlans {
-		if plan.Name == name {
-			return plan
-		}
-	}
-	return PricingPlan{}
+type ProvisioningJobStatus string
+
+const (
+	ProvisioningJobStatusPending  ProvisioningJobStatus = "pending"
+	ProvisioningJobStatusRunning  ProvisioningJobStatus = "running"
+	ProvisioningJobStatusComplete ProvisioningJobStatus = "complete"
+	ProvisioningJobStatusFailed   ProvisioningJobStatus = "failed"
+)
+
+// ProvisioningJob is a Heroku provisioning request that has been accepted
+// and is completed in the background.
+type ProvisioningJob struct {
+	ResourceUUID string
+	Plan         string
+	Region       string
+	OauthCode    string
+	Status       ProvisioningJobStatus
+	Attempts     int
+	LastError    string
+}
+
+type StripeEventStatus string
+
+// Events are claimed as processing when they are received, the received
+// status is only left on events recorded before claiming was added.
+const (
+	StripeEventStatusReceived   StripeEventStatus = "received"
+	StripeEventStatusProcessing StripeEventStatus = "processing"
+	StripeEventStatusProcessed  StripeEventStatus = "processed"
+	StripeEventStatusFailed     StripeEventStatus = "failed"
+)
+
+// StripeEvent is a webhook delivery recorded in the event ledger, so that
+// retried deliveries are only processed once and failures can be replayed.
+type StripeEvent struct {
+	ID          string
+	Type        string
+	Payload     []byte
+	Status      StripeEventStatus
+	Attempts    int
+	LastError   string
+	ReceivedAt  time.Time
+	ProcessedAt time.Time
+	// ClaimedAt is when processing the event last started.
+	ClaimedAt time.Time
 }
@@ -0,0 +1,28 @@
+package billing
+
+import (
+	"context"
+
+	"github.com/stripe/stripe-go/v75"
+)
+
+// Provider is the payment provider GitHub users are billed through. It
+// speaks in Stripe's types so that webhook payloads and API responses can be
+// handled the same way whichever implementation is used.
+type Provider interface {
+	CreateCustomer(ctx context.Context, params *stripe.CustomerParams) (*stripe.Customer, error)
+	CreatePaymentIntent(ctx context.Context, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error)
+	CreateSubscription(ctx context.Context, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	GetSubscription(ctx context.Context, id string) (*stripe.Subscription, error)
+	UpdateSubscription(ctx context.Context, id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error)
+	CancelSubscription(ctx context.Context, id string) (*stripe.Subscription, error)
+	GetInvoice(ctx context.Context, id string) (*stripe.Invoice, error)
+	// ListInvoices returns a single page of invoices and whether there are
+	// more after it.
+	ListInvoices(ctx context.Context, params *stripe.InvoiceListParams) ([]*stripe.Invoice, bool, error)
+	GetPrice(ctx context.Context, id string) (*stripe.Price, error)
+	CreateBillingPortalSession(ctx context.Context, params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error)
+	// ConstructEvent verifies the signature of a webhook payload and parses
+	// the event in it.
+	ConstructEvent(payload []byte, signatureHeader string) (stripe.Event, error)
+}
@@ -0,0 +1,570 @@
+// Package fake is an in-process billing.Provider that keeps its objects in
+// memory, records every call made to it and emits signed webhooks, so the
+// payment and webhook flows can be exercised without reaching Stripe.
+package fake
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/stripe/stripe-go/v75"
+	"github.com/stripe/stripe-go/v75/webhook"
+)
+
+const billingPeriod = 30 * 24 * time.Hour
+
+// Call is a request made to the provider. Params holds the params struct it
+// was called with, or the ID for calls that only take one.
+type Call struct {
+	Method string
+	Params any
+}
+
+type Provider struct {
+	mu                   sync.Mutex
+	webhookSigningSecret string
+	seq                  int
+	calls                []Call
+	errs                 map[string]error
+	customers            map[string]*stripe.Customer
+	paymentIntents       map[string]*stripe.PaymentIntent
+	subscriptions        map[string]*stripe.Subscription
+	invoices             map[string]*stripe.Invoice
+	prices               map[string]*stripe.Price
+}
+
+func NewProvider(webhookSigningSecret string) *Provider {
+	return &Provider{
+		webhookSigningSecret: webhookSigningSecret,
+		errs:                 map[string]error{},
+		customers:            map[string]*stripe.Customer{},
+		paymentIntents:       map[string]*stripe.PaymentIntent{},
+		subscriptions:        map[string]*stripe.Subscription{},
+		invoices:             map[string]*stripe.Invoice{},
+		prices:               map[string]*stripe.Price{},
+	}
+}
+
+// AddPrice adds an active monthly price charging unitAmount cents.
+func (p *Provider) AddPrice(id string, unitAmount int64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.prices[id] = &stripe.Price{
+		ID:         id,
+		Active:     true,
+		Currency:   stripe.CurrencyUSD,
+		Type:       stripe.PriceTypeRecurring,
+		UnitAmount: unitAmount,
+		Recurring: &stripe.PriceRecurring{
+			Interval:      stripe.PriceRecurringIntervalMonth,
+			IntervalCount: 1,
+		},
+	}
+}
+
+// SetError makes every call to method fail with err until it is set to nil.
+func (p *Provider) SetError(method string, err error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err == nil {
+		delete(p.errs, method)
+		return
+	}
+	p.errs[method] = err
+}
+
+// Calls returns the calls made so far, oldest first.
+func (p *Provider) Calls() []Call {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	calls := make([]Call, len(p.calls))
+	copy(calls, p.calls)
+	return calls
+}
+
+// CallsTo returns the calls made to method, oldest first.
+func (p *Provider) CallsTo(method string) []Call {
+	var calls []Call
+	for _, c := range p.Calls() {
+		if c.Method == method {
+			calls = append(calls, c)
+		}
+	}
+	return calls
+}
+
+func (p *Provider) CreateCustomer(ctx context.Context, params *stripe.CustomerParams) (*stripe.Customer, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.record("CreateCustomer", params); err != nil {
+		return nil, err
+	}
+
+	c := &stripe.Customer{
+		ID:       p.newID("cus"),
+		Created:  time.Now().Unix(),
+		Metadata: params.Metadata,
+	}
+	if params.Name != nil {
+		c.Name = *params.Name
+	}
+	if params.Email != nil {
+		c.Email = *params.Email
+	}
+	p.customers[c.ID] = c
+
+	cp := *c
+	return &cp, nil
+}
+
+func (p *Provider) CreatePaymentIntent(ctx context.Context, params *stripe.PaymentIntentParams) (*stripe.PaymentIntent, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.record("CreatePaymentIntent", params); err != nil {
+		return nil, err
+	}
+
+	var amount int64
+	if params.Amount != nil {
+		amount = *params.Amount
+	}
+	pi := p.newPaymentIntent(amount)
+	pi.Metadata = params.Metadata
+	if params.Currency != nil {
+		pi.Currency = stripe.Currency(*params.Currency)
+	}
+	if params.Customer != nil {
+		pi.Customer = &stripe.Customer{ID: *params.Customer}
+	}
+
+	cp := *pi
+	return &cp, nil
+}
+
+// CreateSubscription starts a subscription to the first item's price. Paid
+// subscriptions stay incomplete until PaySubscription is called, free ones
+// are active straight away.
+func (p *Provider) CreateSubscription(ctx context.Context, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.record("CreateSubscription", params); err != nil {
+		return nil, err
+	}
+
+	if params.Customer == nil {
+		return nil, fmt.Errorf("customer is required")
+	}
+	if len(params.Items) == 0 || params.Items[0].Price == nil {
+		return nil, fmt.Errorf("a price is required")
+	}
+
+	price, ok := p.prices[*params.Items[0].Price]
+	if !ok {
+		return nil, fmt.Errorf("no such price: %s", *params.Items[0].Price)
+	}
+
+	now := time.Now()
+	sub := &stripe.Subscription{
+		ID:                 p.newID("sub"),
+		Created:            now.Unix(),
+		Customer:           &stripe.Customer{ID: *params.Customer},
+		Metadata:           params.Metadata,
+		CurrentPeriodStart: now.Unix(),
+		CurrentPeriodEnd:   now.Add(billingPeriod).Unix(),
+		Items: &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{
+				{ID: p.newID("si"), Price: price},
+			},
+		},
+	}
+	if params.CancelAtPeriodEnd != nil {
+		sub.CancelAtPeriodEnd = *params.CancelAtPeriodEnd
+	}
+
+	inv := p.newInvoice(sub, price.UnitAmount)
+	sub.LatestInvoice = inv
+	sub.Status = stripe.SubscriptionStatusIncomplete
+	if inv.Paid {
+		sub.Status = stripe.SubscriptionStatusActive
+	}
+	p.subscriptions[sub.ID] = sub
+
+	cp := *sub
+	return &cp, nil
+}
+
+func (p *Provider) GetSubscription(ctx context.Context, id string) (*stripe.Subscription, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.record("GetSubscription", id); err != nil {
+		return nil, err
+	}
+
+	sub, ok := p.subscriptions[id]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: %s", id)
+	}
+
+	cp := *sub
+	return &cp, nil
+}
+
+// UpdateSubscription applies cancel_at_period_end, metadata and price
+// changes. A price change is invoiced for the full new price, which is paid
+// straight away.
+func (p *Provider) UpdateSubscription(ctx context.Context, id string, params *stripe.SubscriptionParams) (*stripe.Subscription, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.record("UpdateSubscription", params); err != nil {
+		return nil, err
+	}
+
+	current, ok := p.subscriptions[id]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: %s", id)
+	}
+
+	sub := *current
+	if params.CancelAtPeriodEnd != nil {
+		sub.CancelAtPeriodEnd = *params.CancelAtPeriodEnd
+	}
+	for k, v := range params.Metadata {
+		if sub.Metadata == nil {
+			sub.Metadata = map[string]string{}
+		}
+		sub.Metadata[k] = v
+	}
+
+	if len(params.Items) > 0 && params.Items[0].Price != nil {
+		price, ok := p.prices[*params.Items[0].Price]
+		if !ok {
+			return nil, fmt.Errorf("no such price: %s", *params.Items[0].Price)
+		}
+
+		sub.Items = &stripe.SubscriptionItemList{
+			Data: []*stripe.SubscriptionItem{
+				{ID: current.Items.Data[0].ID, Price: price},
+			},
+		}
+
+		inv := p.newInvoice(&sub, price.UnitAmount)
+		inv.Paid = true
+		inv.Status = stripe.InvoiceStatusPaid
+		inv.AmountPaid = inv.AmountDue
+		if inv.PaymentIntent != nil {
+			inv.PaymentIntent.Status = stripe.PaymentIntentStatusSucceeded
+		}
+		sub.LatestInvoice = inv
+	}
+	p.subscriptions[id] = &sub
+
+	cp := sub
+	return &cp, nil
+}
+
+func (p *Provider) CancelSubscription(ctx context.Context, id string) (*stripe.Subscription, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.record("CancelSubscription", id); err != nil {
+		return nil, err
+	}
+
+	current, ok := p.subscriptions[id]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: %s", id)
+	}
+
+	sub := *current
+	sub.Status = stripe.SubscriptionStatusCanceled
+	sub.CanceledAt = time.Now().Unix()
+	sub.EndedAt = sub.CanceledAt
+	p.subscriptions[id] = &sub
+
+	cp := sub
+	return &cp, nil
+}
+
+func (p *Provider) GetInvoice(ctx context.Context, id string) (*stripe.Invoice, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.record("GetInvoice", id); err != nil {
+		return nil, err
+	}
+
+	inv, ok := p.invoices[id]
+	if !ok {
+		return nil, fmt.Errorf("no such invoice: %s", id)
+	}
+
+	cp := *inv
+	return &cp, nil
+}
+
+// ListInvoices returns the customer's invoices newest first, paginated like
+// Stripe with limit and starting_after.
+func (p *Provider) ListInvoices(ctx context.Context, params *stripe.InvoiceListParams) ([]*stripe.Invoice, bool, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.record("ListInvoices", params); err != nil {
+		return nil, false, err
+	}
+
+	var invoices []*stripe.Invoice
+	for _, inv := range p.invoices {
+		if params.Customer != nil && (inv.Customer == nil || inv.Customer.ID != *params.Customer) {
+			continue
+		}
+		invoices = append(invoices, inv)
+	}
+	sort.Slice(invoices, func(i, j int) bool {
+		if invoices[i].Created == invoices[j].Created {
+			return invoices[i].ID > invoices[j].ID
+		}
+		return invoices[i].Created > invoices[j].Created
+	})
+
+	if params.StartingAfter != nil {
+		for i, inv := range invoices {
+			if inv.ID == *params.StartingAfter {
+				invoices = invoices[i+1:]
+				break
+			}
+		}
+	}
+
+	limit := 10
+	if params.Limit != nil {
+		limit = int(*params.Limit)
+	}
+	hasMore := len(invoices) > limit
+	if hasMore {
+		invoices = invoices[:limit]
+	}
+
+	page := make([]*stripe.Invoice, 0, len(invoices))
+	for _, inv := range invoices {
+		cp := *inv
+		page = append(page, &cp)
+	}
+	return page, hasMore, nil
+}
+
+func (p *Provider) GetPrice(ctx context.Context, id string) (*stripe.Price, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.record("GetPrice", id); err != nil {
+		return nil, err
+	}
+
+	price, ok := p.prices[id]
+	if !ok {
+		return nil, fmt.Errorf("no such price: %s", id)
+	}
+
+	cp := *price
+	return &cp, nil
+}
+
+func (p *Provider) CreateBillingPortalSession(ctx context.Context, params *stripe.BillingPortalSessionParams) (*stripe.BillingPortalSession, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if err := p.record("CreateBillingPortalSession", params); err != nil {
+		return nil, err
+	}
+
+	id := p.newID("bps")
+	ps := &stripe.BillingPortalSession{
+		ID:      id,
+		Created: time.Now().Unix(),
+		URL:     fmt.Sprintf("https://billing.stripe.test/session/%s", id),
+	}
+	if params.Customer != nil {
+		ps.Customer = *params.Customer
+	}
+	if params.ReturnURL != nil {
+		ps.ReturnURL = *params.ReturnURL
+	}
+
+	return ps, nil
+}
+
+func (p *Provider) ConstructEvent(payload []byte, signatureHeader string) (stripe.Event, error) {
+	p.mu.Lock()
+	err := p.record("ConstructEvent", signatureHeader)
+	p.mu.Unlock()
+	if err != nil {
+		return stripe.Event{}, err
+	}
+
+	return webhook.ConstructEventWithOptions(payload, signatureHeader, p.webhookSigningSecret, webhook.ConstructEventOptions{
+		IgnoreAPIVersionMismatch: true,
+	})
+}
+
+// PaySubscription pays the latest invoice of a subscription as if the
+// customer had confirmed the payment, and returns the paid invoice for use in
+// an invoice.paid webhook.
+func (p *Provider) PaySubscription(id string) (*stripe.Invoice, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	current, ok := p.subscriptions[id]
+	if !ok {
+		return nil, fmt.Errorf("no such subscription: %s", id)
+	}
+
+	inv := *current.LatestInvoice
+	inv.Paid = true
+	inv.Status = stripe.InvoiceStatusPaid
+	inv.AmountPaid = inv.AmountDue
+	if inv.PaymentIntent != nil {
+		pi := *inv.PaymentIntent
+		pi.Status = stripe.PaymentIntentStatusSucceeded
+		p.paymentIntents[pi.ID] = &pi
+		inv.PaymentIntent = &pi
+	}
+	p.invoices[inv.ID] = &inv
+
+	sub := *current
+	sub.Status = stripe.SubscriptionStatusActive
+	sub.LatestInvoice = &inv
+	p.subscriptions[id] = &sub
+
+	cp := inv
+	return &cp, nil
+}
+
+// Event wraps object in a webhook event of eventType.
+func (p *Provider) Event(eventType string, object any) (stripe.Event, error) {
+	raw, err := json.Marshal(object)
+	if err != nil {
+		return stripe.Event{}, fmt.Errorf("marshalling event object: %w", err)
+	}
+
+	p.mu.Lock()
+	id := p.newID("evt")
+	p.mu.Unlock()
+
+	return stripe.Event{
+		ID:         id,
+		Object:     "event",
+		Type:       eventType,
+		APIVersion: stripe.APIVersion,
+		Created:    time.Now().Unix(),
+		Data: &stripe.EventData{
+			Raw: raw,
+		},
+	}, nil
+}
+
+// SignedPayload returns the JSON body of an event and the Stripe-Signature
+// header Stripe would send with it.
+func (p *Provider) SignedPayload(event stripe.Event) ([]byte, string, error) {
+	payload, err := json.Marshal(event)
+	if err != nil {
+		return nil, "", fmt.Errorf("marshalling event: %w", err)
+	}
+
+	signed := webhook.GenerateTestSignedPayload(&webhook.UnsignedPayload{
+		Payload: payload,
+		Secret:  p.webhookSigningSecret,
+	})
+
+	return signed.Payload, signed.Header, nil
+}
+
+// SendWebhook delivers a signed event to url, the way Stripe delivers
+// webhooks. Sending the same event again is a retried delivery.
+func (p *Provider) SendWebhook(ctx context.Context, url string, event stripe.Event) (*http.Response, error) {
+	payload, header, err := p.SignedPayload(event)
+	if err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, fmt.Errorf("creating webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Stripe-Signature", header)
+
+	return http.DefaultClient.Do(req)
+}
+
+// record must be called with the lock held.
+func (p *Provider) record(method string, params any) error {
+	p.calls = append(p.calls, Call{Method: method, Params: params})
+	return p.errs[method]
+}
+
+// newID must be called with the lock held.
+func (p *Provider) newID(prefix string) string {
+	p.seq++
+	return fmt.Sprintf("%s_fake%06d", prefix, p.seq)
+}
+
+// newPaymentIntent must be called with the lock held.
+func (p *Provider) newPaymentIntent(amount int64) *stripe.PaymentIntent {
+	id := p.newID("pi")
+	pi := &stripe.PaymentIntent{
+		ID:           id,
+		Amount:       amount,
+		Currency:     stripe.CurrencyUSD,
+		ClientSecret: fmt.Sprintf("%s_secret_fake", id),
+		Created:      time.Now().Unix(),
+		Status:       stripe.PaymentIntentStatusRequiresPaymentMethod,
+	}
+	p.paymentIntents[id] = pi
+	return pi
+}
+
+// newInvoice bills a subscription for amount cents. Invoices for nothing are
+// paid without a payment intent, like Stripe does. It must be called with the
+// lock held.
+func (p *Provider) newInvoice(sub *stripe.Subscription, amount int64) *stripe.Invoice {
+	now := time.Now()
+	inv := &stripe.Invoice{
+		ID:           p.newID("in"),
+		Customer:     sub.Customer,
+		Subscription: &stripe.Subscription{ID: sub.ID},
+		AmountDue:    amount,
+		Currency:     stripe.CurrencyUSD,
+		Created:      now.Unix(),
+		PeriodStart:  sub.CurrentPeriodStart,
+		PeriodEnd:    sub.CurrentPeriodEnd,
+		Status:       stripe.InvoiceStatusOpen,
+	}
+	inv.Number = fmt.Sprintf("FAKE-%04d", p.seq)
+
+	if amount == 0 {
+		inv.Paid = true
+		inv.Status = stripe.InvoiceStatusPaid
+	} else {
+		pi := p.newPaymentIntent(amount)
+		pi.Customer = sub.Customer
+		pi.Invoice = &stripe.Invoice{ID: inv.ID}
+		inv.PaymentIntent = pi
+	}
+
+	p.invoices[inv.ID] = inv
+	return inv
+}
@@ -0,0 +1,132 @@
+package billing
+
+import (
+	"context"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/tracing"
+	"github.com/stripe/stripe-go/v75"
+	"github.com/stripe/stripe-go/v75/client"
+	"github.com/stripe/stripe-go/v75/webhook"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/andrewmarklloyd/heroku-addon/internal/pkg/billing")
+
+// StripeProvider bills through the Stripe API with its own client, so the
+// key is never shared through the stripe package's globals.
+type StripeProvider struct {
+	api                  *client.API
+	webhookSigningSecret string
+}
+
+func NewStripeProvider(key, webhookSigningSecret string) StripeProvider {
+	api := &client.API{}
+	api.Init(key, nil)
+
+	return StripeProvider{
+		api:                  api,
+		webhookSigningSecret: webhookSigningSecret,
+	}
+}
+
+func (p StripeProvider) CreateCustomer(ctx context.Context, params *stripe.CustomerParams) (_ *stripe.Customer, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.CreateCustomer", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	params.Context = ctx
+	return p.api.Customers.New(params)
+}
+
+func (p StripeProvider) CreatePaymentIntent(ctx context.Context, params *stripe.PaymentIntentParams) (_ *stripe.PaymentIntent, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.CreatePaymentIntent", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	params.Context = ctx
+	return p.api.PaymentIntents.New(params)
+}
+
+func (p StripeProvider) CreateSubscription(ctx context.Context, params *stripe.SubscriptionParams) (_ *stripe.Subscription, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.CreateSubscription", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	params.Context = ctx
+	return p.api.Subscriptions.New(params)
+}
+
+func (p StripeProvider) GetSubscription(ctx context.Context, id string) (_ *stripe.Subscription, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.GetSubscription", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	params := &stripe.SubscriptionParams{}
+	params.Context = ctx
+	return p.api.Subscriptions.Get(id, params)
+}
+
+func (p StripeProvider) UpdateSubscription(ctx context.Context, id string, params *stripe.SubscriptionParams) (_ *stripe.Subscription, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.UpdateSubscription", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	params.Context = ctx
+	return p.api.Subscriptions.Update(id, params)
+}
+
+func (p StripeProvider) CancelSubscription(ctx context.Context, id string) (_ *stripe.Subscription, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.CancelSubscription", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	params := &stripe.SubscriptionCancelParams{}
+	params.Context = ctx
+	return p.api.Subscriptions.Cancel(id, params)
+}
+
+func (p StripeProvider) GetInvoice(ctx context.Context, id string) (_ *stripe.Invoice, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.GetInvoice", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	params := &stripe.InvoiceParams{}
+	params.Context = ctx
+	return p.api.Invoices.Get(id, params)
+}
+
+func (p StripeProvider) ListInvoices(ctx context.Context, params *stripe.InvoiceListParams) (_ []*stripe.Invoice, _ bool, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.ListInvoices", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	params.Context = ctx
+	params.Single = true
+
+	var invoices []*stripe.Invoice
+	iter := p.api.Invoices.List(params)
+	for iter.Next() {
+		invoices = append(invoices, iter.Invoice())
+	}
+	if err = iter.Err(); err != nil {
+		return nil, false, err
+	}
+
+	return invoices, iter.Meta().HasMore, nil
+}
+
+func (p StripeProvider) GetPrice(ctx context.Context, id string) (_ *stripe.Price, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.GetPrice", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	params := &stripe.PriceParams{}
+	params.Context = ctx
+	return p.api.Prices.Get(id, params)
+}
+
+func (p StripeProvider) CreateBillingPortalSession(ctx context.Context, params *stripe.BillingPortalSessionParams) (_ *stripe.BillingPortalSession, err error) {
+	ctx, span := tracer.Start(ctx, "stripe.CreateBillingPortalSession", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	params.Context = ctx
+	return p.api.BillingPortalSessions.New(params)
+}
+
+func (p StripeProvider) ConstructEvent(payload []byte, signatureHeader string) (stripe.Event, error) {
+	return webhook.ConstructEventWithOptions(payload, signatureHeader, p.webhookSigningSecret, webhook.ConstructEventOptions{
+		IgnoreAPIVersionMismatch: true, // TODO: fix this
+	})
+}
@@ -3,7 +3,13 @@ package config
 import (
 	"errors"
 	"fmt"
+	"net/url"
 	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/crypto"
 )
 
 func BuildConfig() (Server, error) {
@@ -15,8 +21,23 @@ func BuildConfig() (Server, error) {
 	var err error
 
 	encKey := os.Getenv("ENCRYPTION_KEY")
-	if encKey == "" {
-		err = errors.Join(err, fmt.Errorf("ENCRYPTION_KEY env var is not set"))
+	encKeys, parseErr := parseEncryptionKeys(os.Getenv("ENCRYPTION_KEYS"))
+	if parseErr != nil {
+		err = errors.Join(err, parseErr)
+	}
+	if encKey == "" && len(encKeys) == 0 {
+		err = errors.Join(err, fmt.Errorf("ENCRYPTION_KEY or ENCRYPTION_KEYS env var must be set"))
+	}
+	if encKey != "" {
+		encKeys[crypto.LegacyKeyID] = encKey
+	}
+
+	encKeyID := os.Getenv("ENCRYPTION_KEY_ID")
+	if encKeyID == "" {
+		encKeyID = crypto.LegacyKeyID
+	}
+	if _, ok := encKeys[encKeyID]; !ok && len(encKeys) > 0 {
+		err = errors.Join(err, fmt.Errorf("ENCRYPTION_KEY_ID %s is not one of the configured keys", encKeyID))
 	}
 
 	dbURL := os.Getenv("DATABASE_URL")
@@ -79,29 +100,137 @@ func BuildConfig() (Server, error) {
 		err = errors.Join(err, fmt.Errorf("STRIPE_WEBHOOK_SIGNING_SECRET env var is not set"))
 	}
 
+	// the customer portal links back here, it is configured rather than
+	// built from the request so that the Host header can't redirect
+	// customers elsewhere
+	stripePortalReturnURL := os.Getenv("STRIPE_PORTAL_RETURN_URL")
+	if stripePortalReturnURL == "" {
+		err = errors.Join(err, fmt.Errorf("STRIPE_PORTAL_RETURN_URL env var is not set"))
+	} else if u, parseErr := url.Parse(stripePortalReturnURL); parseErr != nil || (u.Scheme != "https" && u.Scheme != "http") || u.Host == "" {
+		err = errors.Join(err, fmt.Errorf("STRIPE_PORTAL_RETURN_URL env var must be an absolute http or https URL"))
+	}
+
+	metricsBackend := MetricsBackend(os.Getenv("METRICS_BACKEND"))
+	if metricsBackend == "" {
+		metricsBackend = MetricsBackendDatadog
+	}
+	switch metricsBackend {
+	case MetricsBackendDatadog, MetricsBackendPrometheus, MetricsBackendNoop:
+	default:
+		err = errors.Join(err, fmt.Errorf("METRICS_BACKEND must be one of %s, %s or %s", MetricsBackendDatadog, MetricsBackendPrometheus, MetricsBackendNoop))
+	}
+
 	ddApiKey := os.Getenv("DD_API_KEY")
-	if ddApiKey == "" {
+	if ddApiKey == "" && metricsBackend == MetricsBackendDatadog {
 		err = errors.Join(err, fmt.Errorf("DD_API_KEY env var is not set"))
 	}
 
+	ddFlushInterval, parseErr := parsePositiveDuration("DD_FLUSH_INTERVAL", 10*time.Second)
+	if parseErr != nil {
+		err = errors.Join(err, parseErr)
+	}
+
+	ddFlushSize, parseErr := parsePositiveInt("DD_FLUSH_SIZE", 100)
+	if parseErr != nil {
+		err = errors.Join(err, parseErr)
+	}
+
+	ddBufferSize, parseErr := parsePositiveInt("DD_BUFFER_SIZE", 1000)
+	if parseErr != nil {
+		err = errors.Join(err, parseErr)
+	}
+
+	ddMaxRetries, parseErr := parsePositiveInt("DD_MAX_RETRIES", 3)
+	if parseErr != nil {
+		err = errors.Join(err, parseErr)
+	}
+
+	tracingExporter := TracingExporter(os.Getenv("TRACING_EXPORTER"))
+	if tracingExporter == "" {
+		tracingExporter = TracingExporterNone
+	}
+	switch tracingExporter {
+	case TracingExporterNone, TracingExporterOTLP, TracingExporterStdout:
+	default:
+		err = errors.Join(err, fmt.Errorf("TRACING_EXPORTER must be one of %s, %s or %s", TracingExporterNone, TracingExporterOTLP, TracingExporterStdout))
+	}
+
+	tracingServiceName := os.Getenv("OTEL_SERVICE_NAME")
+	if tracingServiceName == "" {
+		tracingServiceName = "heroku-addon"
+	}
+
+	tracingSampleRatio := 1.0
+	if r := os.Getenv("TRACING_SAMPLE_RATIO"); r != "" {
+		f, parseErr := strconv.ParseFloat(r, 64)
+		if parseErr != nil || f < 0 || f > 1 {
+			err = errors.Join(err, fmt.Errorf("TRACING_SAMPLE_RATIO env var must be a number between 0 and 1"))
+		}
+		tracingSampleRatio = f
+	}
+
+	prometheusAddr := os.Getenv("PROMETHEUS_ADDR")
+	if prometheusAddr == "" {
+		prometheusAddr = ":9090"
+	}
+
+	accountRetention := 30 * 24 * time.Hour
+	if r := os.Getenv("ACCOUNT_RETENTION_PERIOD"); r != "" {
+		d, parseErr := time.ParseDuration(r)
+		switch {
+		case parseErr != nil:
+			err = errors.Join(err, fmt.Errorf("parsing ACCOUNT_RETENTION_PERIOD env var: %w", parseErr))
+		case d < 0:
+			// 0 is allowed, it purges deprovisioned accounts straight away
+			err = errors.Join(err, fmt.Errorf("ACCOUNT_RETENTION_PERIOD env var must not be negative"))
+		default:
+			accountRetention = d
+		}
+	}
+
+	herokuRequestTimeout, parseErr := parsePositiveDuration("HEROKU_REQUEST_TIMEOUT", 10*time.Second)
+	if parseErr != nil {
+		err = errors.Join(err, parseErr)
+	}
+
+	paymentGracePeriod, parseErr := parsePositiveDuration("STRIPE_PAYMENT_GRACE_PERIOD", 72*time.Hour)
+	if parseErr != nil {
+		err = errors.Join(err, parseErr)
+	}
+
+	pricingPlansFile := os.Getenv("PRICING_PLANS_FILE")
+	if pricingPlansFile == "" {
+		pricingPlansFile = "pricing.json"
+	}
+
 	if err != nil {
 		return Server{}, err
 	}
 
 	return Server{
-		TestMode:        os.Getenv("TEST_MODE") == "true",
-		Port:            port,
-		DBEncryptionKey: encKey,
-		PostgresURL:     dbURL,
+		TestMode: os.Getenv("TEST_MODE") == "true",
+		Port:     port,
+		DBEncryption: DBEncryption{
+			Keys:         encKeys,
+			ActiveKeyID:  encKeyID,
+			AllowUnbound: os.Getenv("DB_ENCRYPTION_ALLOW_UNBOUND") != "false",
+		},
+		PostgresURL:      dbURL,
+		PricingPlansFile: pricingPlansFile,
 		SessionSecret: SessionSecret{
 			HashKey:       sessHashKey,
 			EncryptionKey: sessEncKey,
 		},
 		Heroku: Heroku{
-			AddonUsername: herokuAddonUsername,
-			AddonPassword: herokuAddonPassword,
-			ClientSecret:  herokuClientSecret,
-			SSOSalt:       herokuSSOSalt,
+			AddonUsername:     herokuAddonUsername,
+			AddonPassword:     herokuAddonPassword,
+			ClientSecret:      herokuClientSecret,
+			SSOSalt:           herokuSSOSalt,
+			AccountRetention:  accountRetention,
+			AsyncProvisioning: os.Getenv("HEROKU_ASYNC_PROVISIONING") == "true",
+			APIURL:            os.Getenv("HEROKU_API_URL"),
+			IdentityURL:       os.Getenv("HEROKU_IDENTITY_URL"),
+			RequestTimeout:    herokuRequestTimeout,
 		},
 		Github: Github{
 			ClientID:     githubClientID,
@@ -111,9 +240,78 @@ func BuildConfig() (Server, error) {
 		Stripe: Stripe{
 			Key:                  stripeKey,
 			WebhookSigningSecret: stripeWebhookSigningSecret,
+			PaymentGracePeriod:   paymentGracePeriod,
+			CancelAtPeriodEnd:    os.Getenv("STRIPE_CANCEL_AT_PERIOD_END") == "true",
+			PortalReturnURL:      stripePortalReturnURL,
+		},
+		Metrics: Metrics{
+			Backend:        metricsBackend,
+			PrometheusAddr: prometheusAddr,
 		},
 		Datadog: Datadog{
-			APIKey: ddApiKey,
+			APIKey:        ddApiKey,
+			FlushInterval: ddFlushInterval,
+			FlushSize:     ddFlushSize,
+			BufferSize:    ddBufferSize,
+			MaxRetries:    ddMaxRetries,
+		},
+		Tracing: Tracing{
+			Exporter:    tracingExporter,
+			ServiceName: tracingServiceName,
+			SampleRatio: tracingSampleRatio,
 		},
 	}, nil
 }
+
+// parsePositiveInt parses the integer in the env var name, or returns def
+// when it isn't set.
+func parsePositiveInt(name string, def int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 1 {
+		return def, fmt.Errorf("%s env var must be a positive integer", name)
+	}
+
+	return n, nil
+}
+
+// parsePositiveDuration parses the duration in the env var name, or returns
+// def when it isn't set.
+func parsePositiveDuration(name string, def time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return def, nil
+	}
+
+	d, err := time.ParseDuration(value)
+	if err != nil || d <= 0 {
+		return def, fmt.Errorf("%s env var must be a positive duration", name)
+	}
+
+	return d, nil
+}
+
+// parseEncryptionKeys parses a comma separated list of id:key pairs.
+func parseEncryptionKeys(value string) (map[string]string, error) {
+	keys := map[string]string{}
+	if value == "" {
+		return keys, nil
+	}
+
+	for _, pair := range strings.Split(value, ",") {
+		id, key, ok := strings.Cut(pair, ":")
+		if !ok || id == "" || key == "" {
+			return keys, fmt.Errorf("ENCRYPTION_KEYS env var must be a comma separated list of id:key pairs")
+		}
+		if id == crypto.LegacyKeyID {
+			return keys, fmt.Errorf("ENCRYPTION_KEYS env var cannot use the reserved key id %s, use ENCRYPTION_KEY instead", crypto.LegacyKeyID)
+		}
+		keys[id] = key
+	}
+
+	return keys, nil
+}
@@ -1,15 +1,33 @@
 package config
 
+import "time"
+
 type Server struct {
-	TestMode        bool
-	Port            string
-	DBEncryptionKey string
-	PostgresURL     string
-	SessionSecret   SessionSecret
-	Github          Github
-	Heroku          Heroku
-	Stripe          Stripe
-	Datadog         Datadog
+	TestMode     bool
+	Port         string
+	DBEncryption DBEncryption
+	PostgresURL  string
+	// PricingPlansFile is the path of the JSON file defining the plans that
+	// are offered and their Stripe prices for each environment.
+	PricingPlansFile string
+	SessionSecret    SessionSecret
+	Github           Github
+	Heroku           Heroku
+	Stripe           Stripe
+	Metrics          Metrics
+	Datadog          Datadog
+	Tracing          Tracing
+}
+
+type DBEncryption struct {
+	// Keys maps key IDs to AES keys. The key from ENCRYPTION_KEY has the ID
+	// crypto.LegacyKeyID.
+	Keys        map[string]string
+	ActiveKeyID string
+	// AllowUnbound keeps ciphertexts that aren't bound to their row readable.
+	// Set DB_ENCRYPTION_ALLOW_UNBOUND=false once rotate-keys has re-sealed
+	// every row.
+	AllowUnbound bool
 }
 
 type SessionSecret struct {
@@ -29,13 +47,77 @@ type Heroku struct {
 	AddonPassword string
 	ClientSecret  string
 	SSOSalt       string
+	// AccountRetention is how long a deprovisioned Heroku account is kept
+	// before it is purged, allowing returning customers to be recognized.
+	AccountRetention time.Duration
+	// AsyncProvisioning responds to provisioning requests with 202 Accepted
+	// and completes them in the background.
+	AsyncProvisioning bool
+	// APIURL and IdentityURL override the Heroku Platform and Identity API
+	// base URLs, to run against a fake.
+	APIURL      string
+	IdentityURL string
+	// RequestTimeout bounds each request made to Heroku.
+	RequestTimeout time.Duration
 }
 
 type Stripe struct {
 	Key                  string
 	WebhookSigningSecret string
+	// PaymentGracePeriod is how long an instance keeps running after a
+	// subscription payment fails before it is suspended.
+	PaymentGracePeriod time.Duration
+	// CancelAtPeriodEnd keeps deleted instances running until the end of the
+	// period that was paid for instead of cancelling their subscription
+	// straight away.
+	CancelAtPeriodEnd bool
+	// PortalReturnURL is where the Stripe customer portal sends users back
+	// to.
+	PortalReturnURL string
+}
+
+type MetricsBackend string
+
+const (
+	MetricsBackendDatadog    MetricsBackend = "datadog"
+	MetricsBackendPrometheus MetricsBackend = "prometheus"
+	MetricsBackendNoop       MetricsBackend = "noop"
+)
+
+type Metrics struct {
+	Backend MetricsBackend
+	// PrometheusAddr is the address the /metrics listener binds to when the
+	// prometheus backend is used.
+	PrometheusAddr string
 }
 
 type Datadog struct {
 	APIKey string
+	// FlushInterval is how often buffered metrics are submitted to Datadog.
+	FlushInterval time.Duration
+	// FlushSize is the number of buffered series that triggers an early
+	// flush, and the most series sent in one request.
+	FlushSize int
+	// BufferSize is the most series buffered between flushes. Metrics for new
+	// series are dropped while it is full.
+	BufferSize int
+	// MaxRetries is how many times a failed submission is retried.
+	MaxRetries int
+}
+
+type TracingExporter string
+
+const (
+	TracingExporterNone   TracingExporter = "none"
+	TracingExporterOTLP   TracingExporter = "otlp"
+	TracingExporterStdout TracingExporter = "stdout"
+)
+
+type Tracing struct {
+	// Exporter is where spans are sent. The otlp exporter is configured with
+	// the standard OTEL_EXPORTER_OTLP_* env vars.
+	Exporter    TracingExporter
+	ServiceName string
+	// SampleRatio is the fraction of new traces that are recorded.
+	SampleRatio float64
 }
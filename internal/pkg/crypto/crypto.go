@@ -7,43 +7,215 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"sort"
+)
+
+// LegacyKeyID identifies the key used for ciphertexts written before key IDs
+// were added. Those ciphertexts have no header.
+const LegacyKeyID = "legacy"
+
+// Ciphertexts with a header start with a format version, the length of the
+// key ID, and the key ID. The header is followed by the nonce and the sealed
+// data. The header is always authenticated as additional data, from
+// formatVersionBound onwards the caller's additional data is as well.
+const (
+	formatVersionHeader byte = 1
+	formatVersionBound  byte = 2
 )
 
 type Util struct {
-	gcm cipher.AEAD
+	keys     map[string]cipher.AEAD
+	activeID string
+	// allowUnbound lets Open decrypt ciphertexts that are not bound to
+	// additional data, see DisallowUnbound.
+	allowUnbound bool
 }
 
+// NewUtil creates a Util with a single key that is used for legacy
+// ciphertexts and for everything encrypted from now on.
 func NewUtil(key string) (Util, error) {
-	c, err := aes.NewCipher([]byte(key))
-	if err != nil {
-		return Util{}, fmt.Errorf("creating new aes cipher: %w", err)
+	return NewKeyring(map[string]string{LegacyKeyID: key}, LegacyKeyID)
+}
+
+// NewKeyring creates a Util that encrypts with the key named activeID and
+// decrypts with any of the given keys. A key with the ID LegacyKeyID is used
+// to decrypt ciphertexts that have no header.
+func NewKeyring(keys map[string]string, activeID string) (Util, error) {
+	if _, ok := keys[activeID]; !ok {
+		return Util{}, fmt.Errorf("active key %s is not in the keyring", activeID)
 	}
 
-	gcm, err := cipher.NewGCM(c)
-	if err != nil {
-		return Util{}, fmt.Errorf("creating new gcm: %w", err)
+	u := Util{
+		keys:         map[string]cipher.AEAD{},
+		activeID:     activeID,
+		allowUnbound: true,
 	}
 
-	return Util{
-		gcm: gcm,
-	}, nil
+	for id, key := range keys {
+		if id == "" || len(id) > 255 {
+			return Util{}, fmt.Errorf("key id %q must be between 1 and 255 bytes", id)
+		}
+
+		c, err := aes.NewCipher([]byte(key))
+		if err != nil {
+			return Util{}, fmt.Errorf("creating new aes cipher for key %s: %w", id, err)
+		}
+
+		gcm, err := cipher.NewGCM(c)
+		if err != nil {
+			return Util{}, fmt.Errorf("creating new gcm for key %s: %w", id, err)
+		}
+
+		u.keys[id] = gcm
+	}
+
+	return u, nil
 }
 
+func (u *Util) ActiveKeyID() string {
+	return u.activeID
+}
+
+func (u *Util) KeyIDs() []string {
+	ids := []string{}
+	for id := range u.keys {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// DisallowUnbound makes Open reject ciphertexts that are not bound to
+// additional data: those without a header and those in the first header
+// format. Either can be copied between rows and still decrypt, so this should
+// be turned on once rotate-keys has re-sealed every row.
+func (u *Util) DisallowUnbound() {
+	u.allowUnbound = false
+}
+
+// Encrypt seals plaintext without binding it to any context, it is the same
+// as Seal with nil additional data.
 func (u *Util) Encrypt(plaintext []byte) ([]byte, error) {
-	nonce := make([]byte, u.gcm.NonceSize())
+	return u.Seal(plaintext, nil)
+}
+
+// Decrypt opens a ciphertext from Encrypt, it is the same as Open with nil
+// additional data.
+func (u *Util) Decrypt(ciphertext []byte) ([]byte, error) {
+	return u.Open(ciphertext, nil)
+}
+
+// Seal encrypts plaintext with the active key and binds it to
+// additionalData, for example the row and column it is stored in. The same
+// additionalData must be passed to Open.
+func (u *Util) Seal(plaintext, additionalData []byte) ([]byte, error) {
+	gcm := u.keys[u.activeID]
+	header := newHeader(formatVersionBound, u.activeID)
+
+	nonce := make([]byte, gcm.NonceSize())
 	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
 		return nil, fmt.Errorf("reading nonce: %w", err)
 	}
 
-	return u.gcm.Seal(nonce, nonce, plaintext, nil), nil
+	out := append(header, nonce...)
+	return gcm.Seal(out, nonce, plaintext, boundData(header, additionalData)), nil
 }
 
-func (u *Util) Decrypt(ciphertext []byte) ([]byte, error) {
-	nonceSize := u.gcm.NonceSize()
+// Open decrypts a ciphertext with whichever known key it was sealed with.
+// Unless DisallowUnbound was called, ciphertexts written before additional
+// data was supported are opened without checking additionalData so that
+// existing rows stay readable until they are re-sealed.
+func (u *Util) Open(ciphertext, additionalData []byte) ([]byte, error) {
+	header, keyID, ok := parseHeader(ciphertext)
+	if !u.allowUnbound {
+		if !ok || header[0] != formatVersionBound {
+			return nil, errors.New("ciphertext is not bound to additional data")
+		}
+		gcm, known := u.keys[keyID]
+		if !known {
+			return nil, fmt.Errorf("ciphertext was encrypted with unknown key %s", keyID)
+		}
+		return open(gcm, ciphertext[len(header):], boundData(header, additionalData))
+	}
+
+	if ok {
+		if gcm, known := u.keys[keyID]; known {
+			plaintext, err := open(gcm, ciphertext[len(header):], boundData(header, additionalData))
+			if err == nil {
+				return plaintext, nil
+			}
+			// a legacy ciphertext can start with bytes that look like a
+			// header, fall through and try it as one
+			if _, hasLegacy := u.keys[LegacyKeyID]; !hasLegacy {
+				return nil, err
+			}
+		}
+	}
+
+	legacy, ok := u.keys[LegacyKeyID]
+	if !ok {
+		return nil, errors.New("ciphertext was not encrypted with a known key")
+	}
+
+	return open(legacy, ciphertext, nil)
+}
+
+// NeedsRotation reports whether a ciphertext should be re-sealed, either
+// because it was encrypted with a key other than the active key or because
+// it is in an older format that is not bound to additional data.
+func (u *Util) NeedsRotation(ciphertext, additionalData []byte) bool {
+	header, keyID, ok := parseHeader(ciphertext)
+	if !ok || keyID != u.activeID || header[0] != formatVersionBound {
+		return true
+	}
+
+	// make sure this is not a legacy ciphertext that happens to look like
+	// it has a header
+	_, err := open(u.keys[keyID], ciphertext[len(header):], boundData(header, additionalData))
+	return err != nil
+}
+
+func open(gcm cipher.AEAD, ciphertext, additionalData []byte) ([]byte, error) {
+	nonceSize := gcm.NonceSize()
 	if len(ciphertext) < nonceSize {
 		return nil, errors.New("ciphertext too short")
 	}
 
 	nonce, ciphertext := ciphertext[:nonceSize], ciphertext[nonceSize:]
-	return u.gcm.Open(nil, nonce, ciphertext, nil)
+	return gcm.Open(nil, nonce, ciphertext, additionalData)
+}
+
+func newHeader(version byte, keyID string) []byte {
+	header := []byte{version, byte(len(keyID))}
+	return append(header, keyID...)
+}
+
+func parseHeader(ciphertext []byte) ([]byte, string, bool) {
+	if len(ciphertext) < 2 {
+		return nil, "", false
+	}
+
+	version := ciphertext[0]
+	if version != formatVersionHeader && version != formatVersionBound {
+		return nil, "", false
+	}
+
+	idLen := int(ciphertext[1])
+	if idLen == 0 || len(ciphertext) < 2+idLen {
+		return nil, "", false
+	}
+
+	return ciphertext[:2+idLen], string(ciphertext[2 : 2+idLen]), true
+}
+
+// boundData is the additional data authenticated for a ciphertext with the
+// given header.
+func boundData(header, additionalData []byte) []byte {
+	if header[0] == formatVersionHeader {
+		return header
+	}
+
+	data := make([]byte, 0, len(header)+len(additionalData))
+	data = append(data, header...)
+	return append(data, additionalData...)
 }
@@ -0,0 +1,238 @@
+package crypto
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"testing"
+)
+
+const (
+	legacyKey = "0123456789abcdef0123456789abcdef"
+	newKey    = "fedcba9876543210fedcba9876543210"
+)
+
+var plaintext = []byte("heroku-oauth-token")
+
+func newKeyring(t *testing.T, keys map[string]string, activeID string) Util {
+	t.Helper()
+
+	u, err := NewKeyring(keys, activeID)
+	if err != nil {
+		t.Fatalf("creating keyring: %s", err)
+	}
+	return u
+}
+
+// sealLegacy encrypts the way ciphertexts were written before key IDs, with
+// no header and no additional data.
+func sealLegacy(t *testing.T, u Util) []byte {
+	t.Helper()
+
+	gcm := u.keys[LegacyKeyID]
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		t.Fatalf("reading nonce: %s", err)
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil)
+}
+
+// sealHeaderOnly encrypts in the first header format, which authenticates
+// the header but not the caller's additional data.
+func sealHeaderOnly(t *testing.T, u Util, keyID string) []byte {
+	t.Helper()
+
+	gcm := u.keys[keyID]
+	header := newHeader(formatVersionHeader, keyID)
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		t.Fatalf("reading nonce: %s", err)
+	}
+	out := append(header, nonce...)
+	return gcm.Seal(out, nonce, plaintext, header)
+}
+
+func expectPlaintext(t *testing.T, got []byte, err error) {
+	t.Helper()
+
+	if err != nil {
+		t.Fatalf("opening ciphertext: %s", err)
+	}
+	if !bytes.Equal(got, plaintext) {
+		t.Fatalf("got plaintext %q, want %q", got, plaintext)
+	}
+}
+
+func TestRoundTripPerFormat(t *testing.T) {
+	u := newKeyring(t, map[string]string{LegacyKeyID: legacyKey, "k2": newKey}, "k2")
+	ad := []byte("account/uuid/accesstoken")
+
+	bound, err := u.Seal(plaintext, ad)
+	if err != nil {
+		t.Fatalf("sealing: %s", err)
+	}
+	if bound[0] != formatVersionBound {
+		t.Fatalf("got format version %d, want %d", bound[0], formatVersionBound)
+	}
+
+	tests := []struct {
+		name       string
+		ciphertext []byte
+	}{
+		{"no header", sealLegacy(t, u)},
+		{"header", sealHeaderOnly(t, u, "k2")},
+		{"bound", bound},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			got, err := u.Open(tc.ciphertext, ad)
+			expectPlaintext(t, got, err)
+		})
+	}
+}
+
+func TestOpenWithRetiredKey(t *testing.T) {
+	old := newKeyring(t, map[string]string{"k1": legacyKey}, "k1")
+	ciphertext, err := old.Seal(plaintext, nil)
+	if err != nil {
+		t.Fatalf("sealing: %s", err)
+	}
+
+	// k1 is still in the keyring but no longer active
+	rotated := newKeyring(t, map[string]string{"k1": legacyKey, "k2": newKey}, "k2")
+	got, err := rotated.Open(ciphertext, nil)
+	expectPlaintext(t, got, err)
+}
+
+func TestOpenUnknownKeyID(t *testing.T) {
+	sealer := newKeyring(t, map[string]string{"k2": newKey}, "k2")
+	ciphertext, err := sealer.Seal(plaintext, nil)
+	if err != nil {
+		t.Fatalf("sealing: %s", err)
+	}
+
+	// a keyring whose legacy key has the same value as k2 must still refuse
+	// a ciphertext that names a key it doesn't have
+	u := newKeyring(t, map[string]string{LegacyKeyID: newKey}, LegacyKeyID)
+	_, err = u.Open(ciphertext, nil)
+	if err == nil {
+		t.Errorf("opened a ciphertext sealed with unknown key k2")
+	}
+
+	u.DisallowUnbound()
+	_, err = u.Open(ciphertext, nil)
+	if err == nil {
+		t.Errorf("opened a ciphertext sealed with unknown key k2 with unbound ciphertexts disallowed")
+	}
+}
+
+func TestOpenWrongKey(t *testing.T) {
+	sealer := newKeyring(t, map[string]string{"k1": legacyKey}, "k1")
+	ciphertext, err := sealer.Seal(plaintext, nil)
+	if err != nil {
+		t.Fatalf("sealing: %s", err)
+	}
+
+	// same key ID, different key
+	u := newKeyring(t, map[string]string{"k1": newKey}, "k1")
+	_, err = u.Open(ciphertext, nil)
+	if err == nil {
+		t.Errorf("opened a ciphertext with the wrong key")
+	}
+}
+
+func TestNeedsRotation(t *testing.T) {
+	u := newKeyring(t, map[string]string{LegacyKeyID: legacyKey, "k1": legacyKey, "k2": newKey}, "k2")
+	ad := []byte("account/uuid/accesstoken")
+
+	current, err := u.Seal(plaintext, ad)
+	if err != nil {
+		t.Fatalf("sealing: %s", err)
+	}
+
+	retired := newKeyring(t, map[string]string{"k1": legacyKey}, "k1")
+	oldKey, err := retired.Seal(plaintext, ad)
+	if err != nil {
+		t.Fatalf("sealing with retired key: %s", err)
+	}
+
+	tests := []struct {
+		name       string
+		ciphertext []byte
+		ad         []byte
+		want       bool
+	}{
+		{"active key", current, ad, false},
+		{"other additional data", current, []byte("account/other/accesstoken"), true},
+		{"retired key", oldKey, ad, true},
+		{"no header", sealLegacy(t, u), ad, true},
+		{"header without additional data", sealHeaderOnly(t, u, "k2"), ad, true},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := u.NeedsRotation(tc.ciphertext, tc.ad); got != tc.want {
+				t.Errorf("got NeedsRotation %t, want %t", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestOpenAdditionalDataMismatch(t *testing.T) {
+	u := newKeyring(t, map[string]string{LegacyKeyID: legacyKey}, LegacyKeyID)
+
+	ciphertext, err := u.Seal(plaintext, []byte("account/a/accesstoken"))
+	if err != nil {
+		t.Fatalf("sealing: %s", err)
+	}
+
+	// a token copied to another row or column must not decrypt there
+	for _, ad := range [][]byte{
+		[]byte("account/b/accesstoken"),
+		[]byte("account/a/refreshtoken"),
+		nil,
+	} {
+		_, err = u.Open(ciphertext, ad)
+		if err == nil {
+			t.Errorf("opened a ciphertext bound to account/a/accesstoken with %q", ad)
+		}
+	}
+
+	u.DisallowUnbound()
+	_, err = u.Open(ciphertext, []byte("account/b/accesstoken"))
+	if err == nil {
+		t.Errorf("opened a ciphertext with the wrong additional data with unbound ciphertexts disallowed")
+	}
+}
+
+func TestOpenUnbound(t *testing.T) {
+	u := newKeyring(t, map[string]string{LegacyKeyID: legacyKey}, LegacyKeyID)
+	ad := []byte("account/a/accesstoken")
+
+	legacy := sealLegacy(t, u)
+	headerOnly := sealHeaderOnly(t, u, LegacyKeyID)
+	bound, err := u.Seal(plaintext, ad)
+	if err != nil {
+		t.Fatalf("sealing: %s", err)
+	}
+
+	// unbound ciphertexts open whatever additional data is passed until
+	// they are disallowed
+	got, err := u.Open(legacy, ad)
+	expectPlaintext(t, got, err)
+	got, err = u.Open(headerOnly, ad)
+	expectPlaintext(t, got, err)
+
+	u.DisallowUnbound()
+
+	_, err = u.Open(legacy, ad)
+	if err == nil {
+		t.Errorf("opened a ciphertext without a header with unbound ciphertexts disallowed")
+	}
+	_, err = u.Open(headerOnly, ad)
+	if err == nil {
+		t.Errorf("opened a ciphertext in the first header format with unbound ciphertexts disallowed")
+	}
+
+	got, err = u.Open(bound, ad)
+	expectPlaintext(t, got, err)
+}
@@ -0,0 +1,261 @@
+package datadog
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-api-client-go/v2/api/datadogV2"
+	"go.uber.org/zap"
+)
+
+// MetricNameDropped counts the metrics the aggregator had to throw away, it
+// is submitted along with the metrics of each flush.
+const MetricNameDropped = "metrics.dropped"
+
+const shutdownFlushTimeout = 10 * time.Second
+
+// maxHistogramSamples bounds the samples kept for a histogram series between
+// flushes. Later samples still count towards the count, avg and max.
+const maxHistogramSamples = 1000
+
+type AggregatorConfig struct {
+	// FlushInterval is how often buffered metrics are submitted.
+	FlushInterval time.Duration
+	// FlushSize is the number of buffered series that triggers a flush before
+	// the interval is up. It is also the most series sent in one payload.
+	FlushSize int
+	// BufferSize is the most series that are buffered, metrics for new series
+	// are dropped while the buffer is full.
+	BufferSize int
+	// MaxRetries is how many times a failed payload is submitted again.
+	MaxRetries int
+	// RetryBackoff is the wait before the first retry, it doubles for each
+	// retry after that.
+	RetryBackoff time.Duration
+}
+
+// Aggregator buffers metrics in memory and submits them to Datadog in the
+// background. Counts of the same series are summed, gauges keep their latest
+// value and histograms are summarized until the next flush.
+type Aggregator struct {
+	client Client
+	logger *zap.SugaredLogger
+	cfg    AggregatorConfig
+
+	mu      sync.Mutex
+	buffer  map[string]*bufferedSeries
+	flushCh chan struct{}
+	dropped atomic.Int64
+}
+
+type bufferedSeries struct {
+	metric CustomMetric
+	// count, sum, max and samples aggregate histogram values.
+	count   int
+	sum     float64
+	max     float64
+	samples []float64
+}
+
+func (b *bufferedSeries) add(value float64) {
+	switch b.metric.MetricType {
+	case MetricTypeCount:
+		b.metric.MetricValue += value
+	case MetricTypeHistogram:
+		if b.count == 0 || value > b.max {
+			b.max = value
+		}
+		b.count++
+		b.sum += value
+		if len(b.samples) < maxHistogramSamples {
+			b.samples = append(b.samples, value)
+		}
+	default:
+		b.metric.MetricValue = value
+	}
+}
+
+// histogram returns the count, avg, max and p95 of a histogram series.
+func (b *bufferedSeries) histogram() []CustomMetric {
+	sort.Float64s(b.samples)
+	p95 := b.samples[int(float64(len(b.samples)-1)*0.95)]
+
+	aggregate := func(suffix string, metricType MetricType, value float64) CustomMetric {
+		return CustomMetric{
+			MetricName:  b.metric.MetricName + "." + suffix,
+			MetricType:  metricType,
+			MetricValue: value,
+			Tags:        b.metric.Tags,
+		}
+	}
+
+	return []CustomMetric{
+		aggregate("count", MetricTypeCount, float64(b.count)),
+		aggregate("avg", MetricTypeGauge, b.sum/float64(b.count)),
+		aggregate("max", MetricTypeGauge, b.max),
+		aggregate("95percentile", MetricTypeGauge, p95),
+	}
+}
+
+func NewAggregator(logger *zap.SugaredLogger, client Client, cfg AggregatorConfig) *Aggregator {
+	return &Aggregator{
+		client:  client,
+		logger:  logger,
+		cfg:     cfg,
+		buffer:  map[string]*bufferedSeries{},
+		flushCh: make(chan struct{}, 1),
+	}
+}
+
+// Add buffers a metric without blocking on Datadog.
+func (a *Aggregator) Add(customMetric CustomMetric) {
+	key := seriesKey(customMetric)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	buffered, ok := a.buffer[key]
+	if !ok {
+		if len(a.buffer) >= a.cfg.BufferSize {
+			a.dropped.Add(1)
+			return
+		}
+
+		tags := make(map[string]string, len(customMetric.Tags))
+		for k, v := range customMetric.Tags {
+			tags[k] = v
+		}
+		value := customMetric.MetricValue
+		customMetric.Tags = tags
+		customMetric.MetricValue = 0
+		buffered = &bufferedSeries{metric: customMetric}
+		a.buffer[key] = buffered
+
+		if len(a.buffer) >= a.cfg.FlushSize {
+			select {
+			case a.flushCh <- struct{}{}:
+			default:
+			}
+		}
+		buffered.add(value)
+		return
+	}
+
+	buffered.add(customMetric.MetricValue)
+}
+
+// Dropped returns how many metrics have been dropped since the aggregator
+// was created, because the buffer was full or Datadog kept failing.
+func (a *Aggregator) Dropped() int64 {
+	return a.dropped.Load()
+}
+
+// Run flushes the buffer every flush interval, or sooner when it fills up to
+// the flush size. Once ctx is cancelled the buffer is flushed one last time
+// before it returns.
+func (a *Aggregator) Run(ctx context.Context) {
+	ticker := time.NewTicker(a.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	var reportedDropped int64
+	for {
+		select {
+		case <-ctx.Done():
+			a.flush(shutdownFlushTimeout, &reportedDropped)
+			return
+		case <-ticker.C:
+		case <-a.flushCh:
+		}
+
+		a.flush(a.cfg.FlushInterval, &reportedDropped)
+	}
+}
+
+// flush submits everything buffered, along with the number of metrics
+// dropped since the last report. Submitting, retries included, is given up to
+// timeout so that a flush in progress isn't cut short by shutdown.
+func (a *Aggregator) flush(timeout time.Duration, reportedDropped *int64) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	a.mu.Lock()
+	buffered := a.buffer
+	a.buffer = map[string]*bufferedSeries{}
+	a.mu.Unlock()
+
+	now := time.Now()
+	series := make([]datadogV2.MetricSeries, 0, len(buffered)+1)
+	for _, b := range buffered {
+		if b.metric.MetricType != MetricTypeHistogram {
+			series = append(series, a.client.series(b.metric, now, a.cfg.FlushInterval))
+			continue
+		}
+
+		for _, m := range b.histogram() {
+			series = append(series, a.client.series(m, now, a.cfg.FlushInterval))
+		}
+	}
+
+	dropped := a.dropped.Load()
+	if dropped > *reportedDropped {
+		series = append(series, a.client.series(CustomMetric{
+			MetricName:  MetricNameDropped,
+			MetricType:  MetricTypeCount,
+			MetricValue: float64(dropped - *reportedDropped),
+		}, now, a.cfg.FlushInterval))
+		*reportedDropped = dropped
+	}
+
+	for start := 0; start < len(series); start += a.cfg.FlushSize {
+		end := start + a.cfg.FlushSize
+		if end > len(series) {
+			end = len(series)
+		}
+
+		err := a.submit(ctx, series[start:end])
+		if err != nil {
+			a.dropped.Add(int64(end - start))
+			a.logger.Errorf("dropping %d metric series: %s", end-start, err)
+		}
+	}
+}
+
+// submit sends a payload, retrying with exponential backoff while the error
+// is retryable.
+func (a *Aggregator) submit(ctx context.Context, series []datadogV2.MetricSeries) error {
+	backoff := a.cfg.RetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := a.client.Submit(ctx, series)
+		if err == nil {
+			return nil
+		}
+
+		var submitErr *SubmitError
+		if !errors.As(err, &submitErr) || !submitErr.Retryable || attempt >= a.cfg.MaxRetries {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+	}
+}
+
+// seriesKey identifies a series by metric name, type and tags.
+func seriesKey(customMetric CustomMetric) string {
+	tags := make([]string, 0, len(customMetric.Tags))
+	for k, v := range customMetric.Tags {
+		tags = append(tags, k+":"+v)
+	}
+	sort.Strings(tags)
+
+	return string(customMetric.MetricType) + "|" + customMetric.MetricName + "|" + strings.Join(tags, ",")
+}
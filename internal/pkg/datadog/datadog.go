@@ -2,7 +2,7 @@ package datadog
 
 import (
 	"context"
-	"fmt"
+	"net/http"
 	"time"
 
 	"github.com/DataDog/datadog-api-client-go/v2/api/datadog"
@@ -32,7 +32,9 @@ func NewDatadogClient(apiKey string, testMode bool) Client {
 	}
 }
 
-func (c *Client) Publish(ctx context.Context, customMetric CustomMetric) error {
+// Submit sends a batch of series to Datadog. Errors that are worth retrying
+// are returned as a *SubmitError with Retryable set.
+func (c *Client) Submit(ctx context.Context, series []datadogV2.MetricSeries) error {
 	valueCtx := context.WithValue(
 		ctx,
 		datadog.ContextAPIKeys,
@@ -43,6 +45,22 @@ func (c *Client) Publish(ctx context.Context, customMetric CustomMetric) error {
 		},
 	)
 
+	body := datadogV2.MetricPayload{
+		Series: series,
+	}
+
+	_, resp, err := c.api.SubmitMetrics(valueCtx, body, *datadogV2.NewSubmitMetricsOptionalParameters())
+	if err != nil {
+		retryable := resp == nil || resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError
+		return &SubmitError{Err: err, Retryable: retryable}
+	}
+
+	return nil
+}
+
+// series converts a metric to a Datadog series with a single point, tagged
+// with the source and env along with the metric's own tags.
+func (c *Client) series(customMetric CustomMetric, timestamp time.Time, interval time.Duration) datadogV2.MetricSeries {
 	resources := []datadogV2.MetricResource{
 		{
 			Type: datadog.PtrString("source"),
@@ -61,26 +79,22 @@ func (c *Client) Publish(ctx context.Context, customMetric CustomMetric) error {
 		})
 	}
 
-	body := datadogV2.MetricPayload{
-		Series: []datadogV2.MetricSeries{
+	series := datadogV2.MetricSeries{
+		Metric: customMetric.MetricName,
+		Type:   datadogV2.METRICINTAKETYPE_GAUGE.Ptr(),
+		Points: []datadogV2.MetricPoint{
 			{
-				Metric: string(customMetric.MetricName),
-				Type:   datadogV2.METRICINTAKETYPE_COUNT.Ptr(),
-				Points: []datadogV2.MetricPoint{
-					{
-						Timestamp: datadog.PtrInt64(time.Now().Unix()),
-						Value:     datadog.PtrFloat64(customMetric.MetricValue),
-					},
-				},
-				Resources: resources,
+				Timestamp: datadog.PtrInt64(timestamp.Unix()),
+				Value:     datadog.PtrFloat64(customMetric.MetricValue),
 			},
 		},
+		Resources: resources,
 	}
 
-	_, _, err := c.api.SubmitMetrics(valueCtx, body, *datadogV2.NewSubmitMetricsOptionalParameters())
-	if err != nil {
-		return fmt.Errorf("submitting metrics: %s", err)
+	if customMetric.MetricType == MetricTypeCount {
+		series.Type = datadogV2.METRICINTAKETYPE_COUNT.Ptr()
+		series.Interval = datadog.PtrInt64(int64(interval.Seconds()))
 	}
 
-	return nil
+	return series
 }
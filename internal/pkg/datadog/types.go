@@ -1,24 +1,33 @@
 package datadog
 
-type MetricName string
+import "fmt"
 
-const (
-	MetricNameLogin              MetricName = "login"
-	MetricNameProvision          MetricName = "instance.provision"
-	MetricNameDeprovision        MetricName = "instance.deprovision"
-	MetricNameDeleteInstance     MetricName = "instance.delete"
-	MetricNameStripeWebhookEvent MetricName = "stripe.webhook_event"
-)
-
-type MetricTag string
+type MetricType string
 
 const (
-	MetricTagGithub MetricTag = "github"
-	MetricTagHeroku MetricTag = "heroku"
+	MetricTypeCount MetricType = "count"
+	MetricTypeGauge MetricType = "gauge"
+	// MetricTypeHistogram values are aggregated into count, avg, max and p95
+	// series when they are flushed.
+	MetricTypeHistogram MetricType = "histogram"
 )
 
 type CustomMetric struct {
-	MetricName  MetricName
+	MetricName  string
+	MetricType  MetricType
 	MetricValue float64
 	Tags        map[string]string
 }
+
+type SubmitError struct {
+	Err       error
+	Retryable bool
+}
+
+func (m *SubmitError) Error() string {
+	return fmt.Sprintf("submitting metrics: %s", m.Err)
+}
+
+func (m *SubmitError) Unwrap() error {
+	return m.Err
+}
@@ -0,0 +1,414 @@
+// Package fake is a local stand-in for the Heroku Platform and Identity APIs.
+// It serves the endpoints the heroku package calls from an httptest server,
+// keeps what it is sent and can be scripted to fail, so that provisioning can
+// be exercised without reaching Heroku. Point a heroku.HerokuClient at it by
+// using URL as both its APIURL and IdentityURL.
+package fake
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/heroku"
+)
+
+type Endpoint string
+
+const (
+	EndpointToken           Endpoint = "token"
+	EndpointAddonInfo       Endpoint = "addon-info"
+	EndpointCollaborators   Endpoint = "collaborators"
+	EndpointConfigVars      Endpoint = "config-vars"
+	EndpointMarkProvisioned Endpoint = "mark-provisioned"
+)
+
+// TokenLifetime is the expires_in of the access tokens the server issues.
+const TokenLifetime = 8 * time.Hour
+
+// App is the Heroku app an add-on is attached to.
+type App struct {
+	ID         string
+	Name       string
+	OwnerEmail string
+}
+
+// Failure is the error response an endpoint returns while it is set.
+type Failure struct {
+	StatusCode int
+	ID         string
+	Message    string
+}
+
+// Request is a request the server received.
+type Request struct {
+	Endpoint     Endpoint
+	ResourceUUID string
+}
+
+type Server struct {
+	server       *httptest.Server
+	clientSecret string
+	ssoSalt      string
+
+	mu sync.Mutex
+	// resources maps resource UUIDs to the app the add-on is attached to.
+	resources map[string]App
+	// grants, accessTokens and refreshTokens map the credentials the server
+	// handed out to the resource UUID they were issued for.
+	grants        map[string]string
+	accessTokens  map[string]string
+	refreshTokens map[string]string
+	configVars    map[string]map[string]string
+	provisioned   map[string]bool
+	failures      map[Endpoint]Failure
+	requests      []Request
+	seq           int
+}
+
+// NewServer starts a server that accepts token requests made with
+// clientSecret and signs SSO forms with ssoSalt. It is stopped with Close.
+func NewServer(clientSecret, ssoSalt string) *Server {
+	s := &Server{
+		clientSecret:  clientSecret,
+		ssoSalt:       ssoSalt,
+		resources:     map[string]App{},
+		grants:        map[string]string{},
+		accessTokens:  map[string]string{},
+		refreshTokens: map[string]string{},
+		configVars:    map[string]map[string]string{},
+		provisioned:   map[string]bool{},
+		failures:      map[Endpoint]Failure{},
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/oauth/token", s.handleToken)
+	mux.HandleFunc("/addons/", s.handleAddons)
+	mux.HandleFunc("/apps/", s.handleApps)
+	s.server = httptest.NewServer(mux)
+
+	return s
+}
+
+// URL is the base URL of both APIs.
+func (s *Server) URL() string {
+	return s.server.URL
+}
+
+func (s *Server) Close() {
+	s.server.Close()
+}
+
+// AddAddon attaches an add-on with resourceUUID to app and returns the OAuth
+// grant code Heroku sends in the provisioning request for it.
+func (s *Server) AddAddon(resourceUUID string, app App) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.resources[resourceUUID] = app
+	code := s.newSecret("grant")
+	s.grants[code] = resourceUUID
+	return code
+}
+
+// SetFailure makes every request to endpoint fail with failure until it is
+// set to nil.
+func (s *Server) SetFailure(endpoint Endpoint, failure *Failure) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if failure == nil {
+		delete(s.failures, endpoint)
+		return
+	}
+	s.failures[endpoint] = *failure
+}
+
+// RevokeTokens invalidates the access tokens issued for resourceUUID, as if
+// they had expired. Refresh tokens keep working.
+func (s *Server) RevokeTokens(resourceUUID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for token, id := range s.accessTokens {
+		if id == resourceUUID {
+			delete(s.accessTokens, token)
+		}
+	}
+}
+
+// ConfigVars returns the config vars set on the add-on's app, or nil if none
+// were set.
+func (s *Server) ConfigVars(resourceUUID string) map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	vars, ok := s.configVars[resourceUUID]
+	if !ok {
+		return nil
+	}
+
+	cp := make(map[string]string, len(vars))
+	for k, v := range vars {
+		cp[k] = v
+	}
+	return cp
+}
+
+// Provisioned reports whether the add-on was marked as provisioned.
+func (s *Server) Provisioned(resourceUUID string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.provisioned[resourceUUID]
+}
+
+// Requests returns the requests received so far, oldest first.
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	requests := make([]Request, len(s.requests))
+	copy(requests, s.requests)
+	return requests
+}
+
+// RequestsTo returns the requests received by endpoint, oldest first.
+func (s *Server) RequestsTo(endpoint Endpoint) []Request {
+	var requests []Request
+	for _, r := range s.Requests() {
+		if r.Endpoint == endpoint {
+			requests = append(requests, r)
+		}
+	}
+	return requests
+}
+
+// SSOForm returns the form Heroku posts to the add-on's SSO URL when the
+// app's owner opens the add-on from the dashboard.
+func (s *Server) SSOForm(resourceUUID string) url.Values {
+	s.mu.Lock()
+	app := s.resources[resourceUUID]
+	s.mu.Unlock()
+
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	hasher := sha1.New()
+	hasher.Write([]byte(fmt.Sprintf("%s:%s:%s", resourceUUID, s.ssoSalt, timestamp)))
+
+	return url.Values{
+		"resource_id":    {resourceUUID},
+		"resource_token": {hex.EncodeToString(hasher.Sum(nil))},
+		"timestamp":      {timestamp},
+		"app":            {app.Name},
+		"email":          {app.OwnerEmail},
+		"user_id":        {app.ID + "-owner"},
+	}
+}
+
+func (s *Server) handleToken(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if req.Method != http.MethodPost {
+		writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", "Method not allowed.")
+		return
+	}
+
+	req.ParseForm()
+	var resourceUUID string
+	switch req.PostForm.Get("grant_type") {
+	case "authorization_code":
+		resourceUUID = s.grants[req.PostForm.Get("code")]
+	case "refresh_token":
+		resourceUUID = s.refreshTokens[req.PostForm.Get("refresh_token")]
+	}
+
+	if s.fail(w, EndpointToken, resourceUUID) {
+		return
+	}
+
+	if req.PostForm.Get("client_secret") != s.clientSecret || resourceUUID == "" {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid credentials provided.")
+		return
+	}
+
+	// grants can only be exchanged once
+	delete(s.grants, req.PostForm.Get("code"))
+
+	accessToken := s.newSecret("access")
+	s.accessTokens[accessToken] = resourceUUID
+	refreshToken := req.PostForm.Get("refresh_token")
+	if refreshToken == "" {
+		refreshToken = s.newSecret("refresh")
+		s.refreshTokens[refreshToken] = resourceUUID
+	}
+
+	writeJSON(w, http.StatusOK, heroku.TokenResponse{
+		AccessToken:  accessToken,
+		ExpiresIn:    int(TokenLifetime.Seconds()),
+		RefreshToken: refreshToken,
+		TokenType:    "Bearer",
+	})
+}
+
+// handleAddons serves GET /addons/{id}, PATCH /addons/{id}/config and
+// POST /addons/{id}/actions/provision.
+func (s *Server) handleAddons(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/addons/"), "/")
+	switch {
+	case len(parts) == 1 && req.Method == http.MethodGet:
+		s.getAddon(w, req)
+	case len(parts) == 2 && parts[1] == "config" && req.Method == http.MethodPatch:
+		s.updateConfigVars(w, req, parts[0])
+	case len(parts) == 3 && parts[1] == "actions" && parts[2] == "provision" && req.Method == http.MethodPost:
+		s.markProvisioned(w, req, parts[0])
+	default:
+		writeError(w, http.StatusNotFound, "not_found", "Couldn't find that resource.")
+	}
+}
+
+// getAddon answers with the add-on the token was issued for, the add-on
+// in the path is the add-on service's name.
+func (s *Server) getAddon(w http.ResponseWriter, req *http.Request) {
+	resourceUUID, ok := s.authorize(w, req, EndpointAddonInfo)
+	if !ok {
+		return
+	}
+
+	app := s.resources[resourceUUID]
+	var info heroku.AddonInfo
+	info.App.Id = app.ID
+	info.App.Name = app.Name
+	writeJSON(w, http.StatusOK, info)
+}
+
+func (s *Server) updateConfigVars(w http.ResponseWriter, req *http.Request, resourceUUID string) {
+	tokenResourceUUID, ok := s.authorize(w, req, EndpointConfigVars)
+	if !ok {
+		return
+	}
+	if tokenResourceUUID != resourceUUID {
+		writeError(w, http.StatusForbidden, "forbidden", "You do not have access to the add-on.")
+		return
+	}
+
+	var configVars heroku.ConfigVars
+	err := json.NewDecoder(req.Body).Decode(&configVars)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_params", "Invalid JSON body.")
+		return
+	}
+
+	vars := s.configVars[resourceUUID]
+	if vars == nil {
+		vars = map[string]string{}
+		s.configVars[resourceUUID] = vars
+	}
+	for _, v := range configVars.Config {
+		vars[v.Name] = v.Value
+	}
+
+	writeJSON(w, http.StatusOK, configVars.Config)
+}
+
+func (s *Server) markProvisioned(w http.ResponseWriter, req *http.Request, resourceUUID string) {
+	tokenResourceUUID, ok := s.authorize(w, req, EndpointMarkProvisioned)
+	if !ok {
+		return
+	}
+	if tokenResourceUUID != resourceUUID {
+		writeError(w, http.StatusForbidden, "forbidden", "You do not have access to the add-on.")
+		return
+	}
+
+	s.provisioned[resourceUUID] = true
+	writeJSON(w, http.StatusOK, map[string]string{"id": resourceUUID, "state": "provisioned"})
+}
+
+// handleApps serves GET /apps/{id}/collaborators.
+func (s *Server) handleApps(w http.ResponseWriter, req *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parts := strings.Split(strings.TrimPrefix(req.URL.Path, "/apps/"), "/")
+	if len(parts) != 2 || parts[1] != "collaborators" || req.Method != http.MethodGet {
+		writeError(w, http.StatusNotFound, "not_found", "Couldn't find that resource.")
+		return
+	}
+
+	resourceUUID, ok := s.authorize(w, req, EndpointCollaborators)
+	if !ok {
+		return
+	}
+
+	app := s.resources[resourceUUID]
+	if app.ID != parts[0] {
+		writeError(w, http.StatusNotFound, "not_found", "Couldn't find that app.")
+		return
+	}
+
+	collaborator := heroku.AppCollaborator{Role: "owner"}
+	collaborator.User.Email = app.OwnerEmail
+	writeJSON(w, http.StatusOK, []heroku.AppCollaborator{collaborator})
+}
+
+// authorize records the request and returns the resource UUID its bearer
+// token was issued for. It writes the error response when the endpoint is
+// set to fail or the token is not valid. It must be called with the lock
+// held.
+func (s *Server) authorize(w http.ResponseWriter, req *http.Request, endpoint Endpoint) (string, bool) {
+	token := strings.TrimPrefix(req.Header.Get("Authorization"), "Bearer ")
+	resourceUUID := s.accessTokens[token]
+
+	if s.fail(w, endpoint, resourceUUID) {
+		return "", false
+	}
+
+	if resourceUUID == "" {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Invalid credentials provided.")
+		return "", false
+	}
+
+	return resourceUUID, true
+}
+
+// fail records the request and writes the endpoint's failure, if it has
+// one. It must be called with the lock held.
+func (s *Server) fail(w http.ResponseWriter, endpoint Endpoint, resourceUUID string) bool {
+	s.requests = append(s.requests, Request{Endpoint: endpoint, ResourceUUID: resourceUUID})
+
+	failure, ok := s.failures[endpoint]
+	if !ok {
+		return false
+	}
+
+	writeError(w, failure.StatusCode, failure.ID, failure.Message)
+	return true
+}
+
+// newSecret must be called with the lock held.
+func (s *Server) newSecret(prefix string) string {
+	s.seq++
+	return fmt.Sprintf("%s-fake%06d", prefix, s.seq)
+}
+
+func writeJSON(w http.ResponseWriter, statusCode int, body any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	json.NewEncoder(w).Encode(body)
+}
+
+func writeError(w http.ResponseWriter, statusCode int, id, message string) {
+	writeJSON(w, statusCode, map[string]string{"id": id, "message": message})
+}
@@ -2,6 +2,7 @@ package heroku
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/hex"
 	"encoding/json"
@@ -12,13 +13,48 @@ import (
 	"strconv"
 	"strings"
 	"time"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/tracing"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/trace"
+)
+
+var tracer = otel.Tracer("github.com/andrewmarklloyd/heroku-addon/internal/pkg/heroku")
+
+const (
+	DefaultAPIURL      = "https://api.heroku.com"
+	DefaultIdentityURL = "https://id.heroku.com"
+	DefaultTimeout     = 10 * time.Second
+
+	// maxErrorBodyBytes bounds how much of an error response is read.
+	maxErrorBodyBytes = 64 * 1024
 )
 
+// HerokuClient calls the Heroku Platform and Identity APIs on behalf of the
+// add-on, and validates the requests Heroku makes to it.
 type HerokuClient struct {
 	clientSecret  string
 	addonUsername string
 	addonPassword string
 	ssoSalt       string
+	apiURL        string
+	identityURL   string
+	httpClient    *http.Client
+}
+
+type ClientConfig struct {
+	ClientSecret  string
+	AddonUsername string
+	AddonPassword string
+	SSOSalt       string
+	// APIURL and IdentityURL are the base URLs of the Platform and Identity
+	// APIs. They default to Heroku's and are only changed to point the
+	// client at a fake.
+	APIURL      string
+	IdentityURL string
+	// Timeout bounds each request, including reading the response body.
+	Timeout time.Duration
 }
 
 type ConfigVars struct {
@@ -30,12 +66,32 @@ type Vars struct {
 	Value string `json:"value"`
 }
 
-func NewHerokuClient(clientSecret, addonUsername, addonPassword, ssoSalt string) HerokuClient {
+func NewHerokuClient(cfg ClientConfig) HerokuClient {
+	if cfg.APIURL == "" {
+		cfg.APIURL = DefaultAPIURL
+	}
+	if cfg.IdentityURL == "" {
+		cfg.IdentityURL = DefaultIdentityURL
+	}
+	if cfg.Timeout == 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSHandshakeTimeout = 5 * time.Second
+	transport.ResponseHeaderTimeout = cfg.Timeout
+
 	return HerokuClient{
-		clientSecret:  clientSecret,
-		addonUsername: addonUsername,
-		addonPassword: addonPassword,
-		ssoSalt:       ssoSalt,
+		clientSecret:  cfg.ClientSecret,
+		addonUsername: cfg.AddonUsername,
+		addonPassword: cfg.AddonPassword,
+		ssoSalt:       cfg.SSOSalt,
+		apiURL:        strings.TrimSuffix(cfg.APIURL, "/"),
+		identityURL:   strings.TrimSuffix(cfg.IdentityURL, "/"),
+		httpClient: &http.Client{
+			Timeout:   cfg.Timeout,
+			Transport: otelhttp.NewTransport(transport),
+		},
 	}
 }
 
@@ -112,12 +168,15 @@ func (c *HerokuClient) ValidateSSO(req *http.Request) (SSOUser, error) {
 	}, nil
 }
 
-func (c *HerokuClient) ExchangeToken(code string) (OauthResponse, error) {
+func (c *HerokuClient) ExchangeToken(ctx context.Context, code string) (_ OauthResponse, err error) {
+	ctx, span := tracer.Start(ctx, "heroku.ExchangeToken", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
 	data := url.Values{}
 	data.Set("grant_type", "authorization_code")
 	data.Set("code", code)
 
-	oauthResponse, err := c.tokenRequest(data)
+	oauthResponse, err := c.tokenRequest(ctx, data)
 	if err != nil {
 		return OauthResponse{}, fmt.Errorf("making auth request: %w", err)
 	}
@@ -125,12 +184,15 @@ func (c *HerokuClient) ExchangeToken(code string) (OauthResponse, error) {
 	return oauthResponse, nil
 }
 
-func (c *HerokuClient) RefreshToken(refreshToken string) (OauthResponse, error) {
+func (c *HerokuClient) RefreshToken(ctx context.Context, refreshToken string) (_ OauthResponse, err error) {
+	ctx, span := tracer.Start(ctx, "heroku.RefreshToken", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
 	data := url.Values{}
 	data.Set("grant_type", "refresh_token")
 	data.Set("refresh_token", refreshToken)
 
-	oauthResponse, err := c.tokenRequest(data)
+	oauthResponse, err := c.tokenRequest(ctx, data)
 	if err != nil {
 		return OauthResponse{}, fmt.Errorf("making auth request: %w", err)
 	}
@@ -138,59 +200,37 @@ func (c *HerokuClient) RefreshToken(refreshToken string) (OauthResponse, error)
 	return oauthResponse, nil
 }
 
-func (c *HerokuClient) GetAppAddonInfo(token string) (AddonInfo, error) {
-	url := fmt.Sprintf("https://api.heroku.com/addons/%s", c.addonUsername)
-	req, err := http.NewRequest(http.MethodGet, url, nil)
-	if err != nil {
-		return AddonInfo{}, err
-	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/vnd.heroku+json; version=3")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
+func (c *HerokuClient) GetAppAddonInfo(ctx context.Context, token string) (_ AddonInfo, err error) {
+	ctx, span := tracer.Start(ctx, "heroku.GetAppAddonInfo", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	req, err := c.newAPIRequest(ctx, http.MethodGet, fmt.Sprintf("/addons/%s", c.addonUsername), token, nil)
 	if err != nil {
-		return AddonInfo{}, fmt.Errorf("performing request to heroku: %s", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return AddonInfo{}, fmt.Errorf("response from heroku, receieved status code: %d", resp.StatusCode)
+		return AddonInfo{}, err
 	}
 
 	var addonInfo AddonInfo
-	err = json.NewDecoder(resp.Body).Decode(&addonInfo)
+	err = c.do(req, &addonInfo)
 	if err != nil {
-		return AddonInfo{}, fmt.Errorf("decoding token response: %w", err)
+		return AddonInfo{}, fmt.Errorf("getting addon info: %w", err)
 	}
 
 	return addonInfo, nil
 }
 
-func GetOwnerEmail(token, appId string) (string, error) {
-	url := fmt.Sprintf("https://api.heroku.com/apps/%s/collaborators", appId)
+func (c *HerokuClient) GetOwnerEmail(ctx context.Context, token, appId string) (_ string, err error) {
+	ctx, span := tracer.Start(ctx, "heroku.GetOwnerEmail", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
 
-	req, err := http.NewRequest(http.MethodGet, url, nil)
+	req, err := c.newAPIRequest(ctx, http.MethodGet, fmt.Sprintf("/apps/%s/collaborators", appId), token, nil)
 	if err != nil {
 		return "", err
 	}
-	req.Header.Set("Accept", "application/vnd.heroku+json; version=3")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
-
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		return "", fmt.Errorf("performing request to heroku: %s", err)
-	}
-
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("response from heroku, receieved status code: %d", resp.StatusCode)
-	}
 
 	var appCollaborators []AppCollaborator
-	err = json.NewDecoder(resp.Body).Decode(&appCollaborators)
+	err = c.do(req, &appCollaborators)
 	if err != nil {
-		return "", fmt.Errorf("decoding token response: %w", err)
+		return "", fmt.Errorf("getting app collaborators: %w", err)
 	}
 
 	if len(appCollaborators) == 0 {
@@ -206,83 +246,126 @@ func GetOwnerEmail(token, appId string) (string, error) {
 	return "", fmt.Errorf("did not find owner")
 }
 
-func UpdateConfigVars(token, resourceUUID string, configVars ConfigVars) error {
+func (c *HerokuClient) UpdateConfigVars(ctx context.Context, token, resourceUUID string, configVars ConfigVars) (err error) {
+	ctx, span := tracer.Start(ctx, "heroku.UpdateConfigVars", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
 	j, err := json.Marshal(configVars)
 	if err != nil {
-		return fmt.Errorf("marshalling heartbeat: %s", err)
+		return fmt.Errorf("marshalling config vars: %w", err)
 	}
 
-	req, err := http.NewRequest(http.MethodPatch, fmt.Sprintf("https://api.heroku.com/addons/%s/config", resourceUUID), bytes.NewBuffer(j))
+	req, err := c.newAPIRequest(ctx, http.MethodPatch, fmt.Sprintf("/addons/%s/config", resourceUUID), token, bytes.NewReader(j))
 	if err != nil {
 		return err
 	}
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Accept", "application/vnd.heroku+json; version=3")
-	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+	err = c.do(req, nil)
 	if err != nil {
-		return fmt.Errorf("performing request to heroku: %s", err)
+		return fmt.Errorf("updating config vars: %w", err)
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	return nil
+}
+
+// MarkProvisioned tells Heroku that an asynchronously provisioned add-on is
+// ready to use.
+func (c *HerokuClient) MarkProvisioned(ctx context.Context, token, resourceUUID string) (err error) {
+	ctx, span := tracer.Start(ctx, "heroku.MarkProvisioned", trace.WithSpanKind(trace.SpanKindClient))
+	defer func() { tracing.End(span, err) }()
+
+	req, err := c.newAPIRequest(ctx, http.MethodPost, fmt.Sprintf("/addons/%s/actions/provision", resourceUUID), token, nil)
 	if err != nil {
-		return fmt.Errorf("reading response body from heroku: %s", err)
+		return err
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("response from heroku, receieved status code: %d, response: %s", resp.StatusCode, string(body))
+	err = c.do(req, nil)
+	if err != nil {
+		return fmt.Errorf("marking addon as provisioned: %w", err)
 	}
 
 	return nil
 }
 
-func (c *HerokuClient) authRequest(url string, data url.Values) (string, error) {
+func (c *HerokuClient) tokenRequest(ctx context.Context, data url.Values) (OauthResponse, error) {
 	data.Set("client_secret", c.clientSecret)
 
-	client := &http.Client{}
-	r, _ := http.NewRequest(http.MethodPost, url, strings.NewReader(data.Encode()))
-	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := client.Do(r)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.identityURL+"/oauth/token", strings.NewReader(data.Encode()))
 	if err != nil {
-		return "", fmt.Errorf("making token request: %w", err)
+		return OauthResponse{}, err
 	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
 
-	if resp.StatusCode != http.StatusOK {
-		return "", fmt.Errorf("received non 200 status code %d", resp.StatusCode)
+	var oauthResponse OauthResponse
+	err = c.do(req, &oauthResponse)
+	if err != nil {
+		return OauthResponse{}, err
 	}
 
-	body, err := io.ReadAll(resp.Body)
+	return oauthResponse, nil
+}
+
+// newAPIRequest builds a Platform API request authenticated with the
+// account's OAuth token.
+func (c *HerokuClient) newAPIRequest(ctx context.Context, method, path, token string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.apiURL+path, body)
 	if err != nil {
-		return "", fmt.Errorf("reading response body: %s", err)
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
 	}
+	req.Header.Set("Accept", "application/vnd.heroku+json; version=3")
+	req.Header.Set("Authorization", fmt.Sprintf("Bearer %s", token))
 
-	return string(body), nil
+	return req, nil
 }
 
-func (c *HerokuClient) tokenRequest(data url.Values) (OauthResponse, error) {
-	data.Set("client_secret", c.clientSecret)
+// do sends req and decodes a successful response into out, when it isn't
+// nil. Error statuses are returned as an *APIError.
+func (c *HerokuClient) do(req *http.Request, out any) error {
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("performing request to heroku: %w", err)
+	}
+	defer resp.Body.Close()
 
-	client := &http.Client{}
-	r, _ := http.NewRequest(http.MethodPost, "https://id.heroku.com/oauth/token", strings.NewReader(data.Encode()))
-	r.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return newAPIError(resp)
+	}
+
+	if out == nil {
+		_, err = io.Copy(io.Discard, resp.Body)
+		if err != nil {
+			return fmt.Errorf("reading response body from heroku: %w", err)
+		}
+		return nil
+	}
 
-	resp, err := client.Do(r)
+	err = json.NewDecoder(resp.Body).Decode(out)
 	if err != nil {
-		return OauthResponse{}, fmt.Errorf("making token request: %w", err)
+		return fmt.Errorf("decoding response from heroku: %w", err)
 	}
 
-	var oauthResponse OauthResponse
-	err = json.NewDecoder(resp.Body).Decode(&oauthResponse)
+	return nil
+}
+
+func newAPIError(resp *http.Response) *APIError {
+	apiErr := &APIError{
+		StatusCode: resp.StatusCode,
+		Method:     resp.Request.Method,
+		URL:        resp.Request.URL.Redacted(),
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxErrorBodyBytes))
 	if err != nil {
-		return OauthResponse{}, fmt.Errorf("decoding token response: %w", err)
+		return apiErr
 	}
 
-	if resp.StatusCode != http.StatusOK {
-		return OauthResponse{}, fmt.Errorf("received non 200 status code %d", resp.StatusCode)
+	err = json.Unmarshal(body, apiErr)
+	if err != nil || apiErr.ID == "" && apiErr.Message == "" {
+		apiErr.Body = string(body)
 	}
 
-	return oauthResponse, nil
+	return apiErr
 }
@@ -1,5 +1,26 @@
 package heroku
 
+import "fmt"
+
+// APIError is returned when Heroku responds with an error status. ID and
+// Message come from Heroku's JSON error body, Body holds the response when it
+// isn't one.
+type APIError struct {
+	StatusCode int    `json:"-"`
+	Method     string `json:"-"`
+	URL        string `json:"-"`
+	ID         string `json:"id"`
+	Message    string `json:"message"`
+	Body       string `json:"-"`
+}
+
+func (m *APIError) Error() string {
+	if m.ID != "" || m.Message != "" {
+		return fmt.Sprintf("%s %s: heroku responded with status code %d: %s: %s", m.Method, m.URL, m.StatusCode, m.ID, m.Message)
+	}
+	return fmt.Sprintf("%s %s: heroku responded with status code %d: %s", m.Method, m.URL, m.StatusCode, m.Body)
+}
+
 type PlanProvisionPayload struct {
 	Plan       string     `json:"plan"`
 	Region     string     `json:"region"`
@@ -7,6 +28,12 @@ type PlanProvisionPayload struct {
 	OauthGrant OauthGrant `json:"oauth_grant"`
 }
 
+type PlanChangePayload struct {
+	Plan     string `json:"plan"`
+	HerokuID string `json:"heroku_id"`
+	UUID     string `json:"uuid"`
+}
+
 type TokenResponse struct {
 	AccessToken  string `json:"access_token"`
 	ExpiresIn    int    `json:"expires_in"`
@@ -0,0 +1,54 @@
+package metrics
+
+import (
+	"context"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/datadog"
+)
+
+// Datadog buffers metrics in an aggregator that submits them to the Datadog
+// API in the background, so recording never waits on the network.
+type Datadog struct {
+	aggregator *datadog.Aggregator
+}
+
+func NewDatadogRecorder(aggregator *datadog.Aggregator) Datadog {
+	return Datadog{
+		aggregator: aggregator,
+	}
+}
+
+func (d Datadog) Count(ctx context.Context, name Name, value float64, tags Tags) {
+	d.aggregator.Add(datadog.CustomMetric{
+		MetricName:  string(name),
+		MetricType:  datadog.MetricTypeCount,
+		MetricValue: value,
+		Tags:        tags,
+	})
+}
+
+func (d Datadog) Gauge(ctx context.Context, name Name, value float64, tags Tags) {
+	d.aggregator.Add(datadog.CustomMetric{
+		MetricName:  string(name),
+		MetricType:  datadog.MetricTypeGauge,
+		MetricValue: value,
+		Tags:        tags,
+	})
+}
+
+// Histogram is submitted as count, avg, max and 95percentile series, like
+// DogStatsD histograms.
+func (d Datadog) Histogram(ctx context.Context, name Name, value float64, tags Tags) {
+	d.aggregator.Add(datadog.CustomMetric{
+		MetricName:  string(name),
+		MetricType:  datadog.MetricTypeHistogram,
+		MetricValue: value,
+		Tags:        tags,
+	})
+}
+
+// Run flushes the aggregator until ctx is cancelled, then flushes what is
+// left.
+func (d Datadog) Run(ctx context.Context) {
+	d.aggregator.Run(ctx)
+}
@@ -0,0 +1,51 @@
+package metrics
+
+import "context"
+
+type Name string
+
+const (
+	NameLogin              Name = "login"
+	NameProvision          Name = "instance.provision"
+	NameDeprovision        Name = "instance.deprovision"
+	NamePlanChange         Name = "instance.plan_change"
+	NameDeleteInstance     Name = "instance.delete"
+	NameSuspend            Name = "instance.suspend"
+	NameStripeWebhookEvent Name = "stripe.webhook_event"
+	NameHTTPRequests       Name = "http.requests"
+	// NameHTTPRequestDuration is recorded in seconds.
+	NameHTTPRequestDuration Name = "http.request.duration"
+)
+
+const (
+	TagGithub = "github"
+	TagHeroku = "heroku"
+)
+
+type Tags map[string]string
+
+// Recorder records application metrics. Recording never fails the caller,
+// implementations log the errors they run into. Each metric name must always
+// be recorded with the same set of tag keys.
+type Recorder interface {
+	Count(ctx context.Context, name Name, value float64, tags Tags)
+	Gauge(ctx context.Context, name Name, value float64, tags Tags)
+	// Histogram records one observation of a distribution, such as a latency.
+	Histogram(ctx context.Context, name Name, value float64, tags Tags)
+	// Run does the recorder's background work until ctx is cancelled. Metrics
+	// that are still buffered are flushed before it returns.
+	Run(ctx context.Context)
+}
+
+// Noop discards every metric, for running without a metrics backend.
+type Noop struct{}
+
+func (Noop) Count(ctx context.Context, name Name, value float64, tags Tags) {}
+
+func (Noop) Gauge(ctx context.Context, name Name, value float64, tags Tags) {}
+
+func (Noop) Histogram(ctx context.Context, name Name, value float64, tags Tags) {}
+
+func (Noop) Run(ctx context.Context) {
+	<-ctx.Done()
+}
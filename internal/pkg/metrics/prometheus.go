@@ -0,0 +1,187 @@
+package metrics
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.uber.org/zap"
+)
+
+const prometheusNamespace = "heroku_addon"
+
+var invalidPrometheusChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// Prometheus keeps metrics in a registry that is scraped from /metrics on its
+// own listener.
+// Collectors are created the first time a metric name is recorded, with the
+// tag keys it was recorded with as labels.
+type Prometheus struct {
+	addr       string
+	registry   *prometheus.Registry
+	registerer prometheus.Registerer
+	logger     *zap.SugaredLogger
+
+	mu         sync.Mutex
+	counters   map[Name]*prometheus.CounterVec
+	gauges     map[Name]*prometheus.GaugeVec
+	histograms map[Name]*prometheus.HistogramVec
+	labels     map[Name][]string
+}
+
+func NewPrometheusRecorder(logger *zap.SugaredLogger, env, addr string) *Prometheus {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+	)
+
+	return &Prometheus{
+		addr:       addr,
+		registry:   registry,
+		registerer: prometheus.WrapRegistererWith(prometheus.Labels{"env": env}, registry),
+		logger:     logger,
+		counters:   map[Name]*prometheus.CounterVec{},
+		gauges:     map[Name]*prometheus.GaugeVec{},
+		histograms: map[Name]*prometheus.HistogramVec{},
+		labels:     map[Name][]string{},
+	}
+}
+
+// Handler serves the metrics in the Prometheus exposition format.
+func (p *Prometheus) Handler() http.Handler {
+	return promhttp.HandlerFor(p.registry, promhttp.HandlerOpts{})
+}
+
+// Run serves /metrics until ctx is cancelled.
+func (p *Prometheus) Run(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", p.Handler())
+	server := &http.Server{
+		Addr:    p.addr,
+		Handler: mux,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	p.logger.Infof("starting metrics server on address %s", p.addr)
+	err := server.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		p.logger.Errorf("metrics server stopped: %s", err)
+	}
+}
+
+func (p *Prometheus) Count(ctx context.Context, name Name, value float64, tags Tags) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	counter, ok := p.counters[name]
+	if !ok {
+		counter = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: prometheusNamespace,
+			Name:      prometheusName(name) + "_total",
+			Help:      string(name),
+		}, p.labelNames(name, tags))
+		err := p.registerer.Register(counter)
+		if err != nil {
+			p.logger.Errorf("registering %s counter: %s", name, err)
+			return
+		}
+		p.counters[name] = counter
+	}
+
+	c, err := counter.GetMetricWith(prometheus.Labels(tags))
+	if err != nil {
+		p.logger.Errorf("recording %s counter: %s", name, err)
+		return
+	}
+	c.Add(value)
+}
+
+func (p *Prometheus) Gauge(ctx context.Context, name Name, value float64, tags Tags) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	gauge, ok := p.gauges[name]
+	if !ok {
+		gauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: prometheusNamespace,
+			Name:      prometheusName(name),
+			Help:      string(name),
+		}, p.labelNames(name, tags))
+		err := p.registerer.Register(gauge)
+		if err != nil {
+			p.logger.Errorf("registering %s gauge: %s", name, err)
+			return
+		}
+		p.gauges[name] = gauge
+	}
+
+	g, err := gauge.GetMetricWith(prometheus.Labels(tags))
+	if err != nil {
+		p.logger.Errorf("recording %s gauge: %s", name, err)
+		return
+	}
+	g.Set(value)
+}
+
+// Histogram uses the default buckets, which suit latencies in seconds.
+func (p *Prometheus) Histogram(ctx context.Context, name Name, value float64, tags Tags) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	histogram, ok := p.histograms[name]
+	if !ok {
+		histogram = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: prometheusNamespace,
+			Name:      prometheusName(name),
+			Help:      string(name),
+			Buckets:   prometheus.DefBuckets,
+		}, p.labelNames(name, tags))
+		err := p.registerer.Register(histogram)
+		if err != nil {
+			p.logger.Errorf("registering %s histogram: %s", name, err)
+			return
+		}
+		p.histograms[name] = histogram
+	}
+
+	h, err := histogram.GetMetricWith(prometheus.Labels(tags))
+	if err != nil {
+		p.logger.Errorf("recording %s histogram: %s", name, err)
+		return
+	}
+	h.Observe(value)
+}
+
+// labelNames returns the sorted tag keys of the first recording of a metric.
+// It must be called with the lock held.
+func (p *Prometheus) labelNames(name Name, tags Tags) []string {
+	if labels, ok := p.labels[name]; ok {
+		return labels
+	}
+
+	labels := make([]string, 0, len(tags))
+	for k := range tags {
+		labels = append(labels, k)
+	}
+	sort.Strings(labels)
+	p.labels[name] = labels
+	return labels
+}
+
+func prometheusName(name Name) string {
+	return invalidPrometheusChars.ReplaceAllString(string(name), "_")
+}
@@ -0,0 +1,239 @@
+package postgres
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+// migrationLockID is the key for the advisory lock held while migrating so
+// that multiple dynos starting at once do not race.
+const migrationLockID = 7305481922
+
+const createTableSchemaMigrationsStmt = `CREATE TABLE IF NOT EXISTS schema_migrations(
+	version integer PRIMARY KEY,
+	name text,
+	appliedat timestamptz DEFAULT now()
+	);`
+
+// Migration is a versioned schema change. Files in the migrations directory
+// are named <version>_<name>.up.sql and <version>_<name>.down.sql.
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+type MigrationStatus struct {
+	Version   int
+	Name      string
+	Applied   bool
+	AppliedAt time.Time
+}
+
+func loadMigrations() ([]Migration, error) {
+	entries, err := fs.ReadDir(migrationFiles, "migrations")
+	if err != nil {
+		return nil, fmt.Errorf("reading migrations directory: %w", err)
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, e := range entries {
+		fileName := e.Name()
+		var direction string
+		switch {
+		case strings.HasSuffix(fileName, ".up.sql"):
+			direction = "up"
+		case strings.HasSuffix(fileName, ".down.sql"):
+			direction = "down"
+		default:
+			return nil, fmt.Errorf("migration %s must end in .up.sql or .down.sql", fileName)
+		}
+
+		base := strings.TrimSuffix(fileName, fmt.Sprintf(".%s.sql", direction))
+		versionStr, name, ok := strings.Cut(base, "_")
+		if !ok {
+			return nil, fmt.Errorf("migration %s is not named <version>_<name>", fileName)
+		}
+
+		version, err := strconv.Atoi(versionStr)
+		if err != nil {
+			return nil, fmt.Errorf("parsing version of migration %s: %w", fileName, err)
+		}
+
+		contents, err := migrationFiles.ReadFile("migrations/" + fileName)
+		if err != nil {
+			return nil, fmt.Errorf("reading migration %s: %w", fileName, err)
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("migration version %d is used by both %s and %s", version, m.Name, name)
+		}
+
+		if direction == "up" {
+			m.Up = string(contents)
+		} else {
+			m.Down = string(contents)
+		}
+	}
+
+	migrations := []Migration{}
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("migration %d_%s must have both an up and a down file", m.Version, m.Name)
+		}
+		migrations = append(migrations, *m)
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+
+	return migrations, nil
+}
+
+// MigrateUp applies all pending migrations and returns how many were applied.
+func (c *Client) MigrateUp(ctx context.Context) (int, error) {
+	applied := 0
+	err := c.withMigrationLock(ctx, func(conn *sql.Conn, migrations []Migration, done map[int]time.Time) error {
+		for _, m := range migrations {
+			if _, ok := done[m.Version]; ok {
+				continue
+			}
+
+			err := runMigration(ctx, conn, m.Up, "INSERT INTO schema_migrations(version, name) VALUES($1, $2);", m.Version, m.Name)
+			if err != nil {
+				return fmt.Errorf("applying migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			applied++
+		}
+		return nil
+	})
+
+	return applied, err
+}
+
+// MigrateDown rolls back the given number of most recently applied
+// migrations and returns how many were rolled back.
+func (c *Client) MigrateDown(ctx context.Context, steps int) (int, error) {
+	rolledBack := 0
+	err := c.withMigrationLock(ctx, func(conn *sql.Conn, migrations []Migration, done map[int]time.Time) error {
+		for i := len(migrations) - 1; i >= 0 && rolledBack < steps; i-- {
+			m := migrations[i]
+			if _, ok := done[m.Version]; !ok {
+				continue
+			}
+
+			err := runMigration(ctx, conn, m.Down, "DELETE FROM schema_migrations WHERE version = $1;", m.Version)
+			if err != nil {
+				return fmt.Errorf("rolling back migration %d_%s: %w", m.Version, m.Name, err)
+			}
+			rolledBack++
+		}
+		return nil
+	})
+
+	return rolledBack, err
+}
+
+func (c *Client) MigrationStatus(ctx context.Context) ([]MigrationStatus, error) {
+	var statuses []MigrationStatus
+	err := c.withMigrationLock(ctx, func(conn *sql.Conn, migrations []Migration, done map[int]time.Time) error {
+		for _, m := range migrations {
+			appliedAt, ok := done[m.Version]
+			statuses = append(statuses, MigrationStatus{
+				Version:   m.Version,
+				Name:      m.Name,
+				Applied:   ok,
+				AppliedAt: appliedAt,
+			})
+		}
+		return nil
+	})
+
+	return statuses, err
+}
+
+func (c *Client) withMigrationLock(ctx context.Context, fn func(conn *sql.Conn, migrations []Migration, done map[int]time.Time) error) error {
+	migrations, err := loadMigrations()
+	if err != nil {
+		return err
+	}
+
+	// advisory locks are held by a session, so everything has to run on the
+	// same connection
+	conn, err := c.sqlDB.Conn(ctx)
+	if err != nil {
+		return fmt.Errorf("getting connection: %w", err)
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, "SELECT pg_advisory_lock($1);", migrationLockID)
+	if err != nil {
+		return fmt.Errorf("acquiring migration lock: %w", err)
+	}
+	defer conn.ExecContext(context.Background(), "SELECT pg_advisory_unlock($1);", migrationLockID)
+
+	_, err = conn.ExecContext(ctx, createTableSchemaMigrationsStmt)
+	if err != nil {
+		return fmt.Errorf("executing create table schema_migrations statement: %w", err)
+	}
+
+	rows, err := conn.QueryContext(ctx, "SELECT version, appliedat FROM schema_migrations;")
+	if err != nil {
+		return fmt.Errorf("getting applied migrations: %w", err)
+	}
+	defer rows.Close()
+
+	done := map[int]time.Time{}
+	for rows.Next() {
+		var version int
+		var appliedAt time.Time
+		err := rows.Scan(&version, &appliedAt)
+		if err != nil {
+			return err
+		}
+		done[version] = appliedAt
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	rows.Close()
+
+	return fn(conn, migrations, done)
+}
+
+func runMigration(ctx context.Context, conn *sql.Conn, migrationSQL, recordStmt string, recordArgs ...any) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, migrationSQL)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, recordStmt, recordArgs...)
+	if err != nil {
+		return fmt.Errorf("recording migration: %w", err)
+	}
+
+	return tx.Commit()
+}
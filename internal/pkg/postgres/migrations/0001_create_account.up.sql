@@ -0,0 +1,8 @@
+CREATE TABLE IF NOT EXISTS account(
+	uuid text PRIMARY KEY,
+	email text,
+	name text,
+	accounttype text,
+	accesstoken bytea,
+	refreshtoken bytea
+);
@@ -0,0 +1,9 @@
+CREATE TABLE IF NOT EXISTS instance(
+	id text PRIMARY KEY,
+	accountid text,
+	plan text,
+	name text,
+	CONSTRAINT fk_accountid
+		FOREIGN KEY(accountid)
+		REFERENCES account(uuid)
+);
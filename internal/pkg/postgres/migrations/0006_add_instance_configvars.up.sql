@@ -0,0 +1 @@
+ALTER TABLE instance ADD COLUMN IF NOT EXISTS configvars bytea;
@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS provisioning_job(
+	resourceuuid text PRIMARY KEY,
+	plan text,
+	region text,
+	oauthcode bytea,
+	status text,
+	attempts integer DEFAULT 0,
+	lasterror text,
+	createdat timestamptz DEFAULT now(),
+	updatedat timestamptz DEFAULT now()
+);
@@ -0,0 +1,4 @@
+DROP INDEX IF EXISTS instance_stripesubscriptionid_idx;
+ALTER TABLE instance DROP COLUMN IF EXISTS paymentfailedat;
+ALTER TABLE instance DROP COLUMN IF EXISTS stripesubscriptionid;
+ALTER TABLE instance DROP COLUMN IF EXISTS status;
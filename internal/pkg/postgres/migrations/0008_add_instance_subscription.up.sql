@@ -0,0 +1,4 @@
+ALTER TABLE instance ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'active';
+ALTER TABLE instance ADD COLUMN IF NOT EXISTS stripesubscriptionid text;
+ALTER TABLE instance ADD COLUMN IF NOT EXISTS paymentfailedat timestamptz;
+CREATE UNIQUE INDEX IF NOT EXISTS instance_stripesubscriptionid_idx ON instance(stripesubscriptionid);
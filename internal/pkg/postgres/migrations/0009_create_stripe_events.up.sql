@@ -0,0 +1,11 @@
+CREATE TABLE IF NOT EXISTS stripe_events(
+	id text PRIMARY KEY,
+	type text,
+	payload jsonb,
+	status text,
+	attempts integer DEFAULT 0,
+	lasterror text,
+	receivedat timestamptz DEFAULT now(),
+	processedat timestamptz
+);
+CREATE INDEX IF NOT EXISTS stripe_events_status_idx ON stripe_events(status);
@@ -0,0 +1,3 @@
+ALTER TABLE instance DROP COLUMN IF EXISTS currentperiodend;
+ALTER TABLE instance DROP COLUMN IF EXISTS subscriptionstatus;
+ALTER TABLE instance DROP COLUMN IF EXISTS stripepriceid;
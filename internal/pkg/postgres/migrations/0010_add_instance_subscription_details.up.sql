@@ -0,0 +1,3 @@
+ALTER TABLE instance ADD COLUMN IF NOT EXISTS stripepriceid text;
+ALTER TABLE instance ADD COLUMN IF NOT EXISTS subscriptionstatus text;
+ALTER TABLE instance ADD COLUMN IF NOT EXISTS currentperiodend timestamptz;
@@ -0,0 +1 @@
+ALTER TABLE instance DROP COLUMN IF EXISTS cancelatperiodend;
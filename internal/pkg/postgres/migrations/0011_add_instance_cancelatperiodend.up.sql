@@ -0,0 +1 @@
+ALTER TABLE instance ADD COLUMN IF NOT EXISTS cancelatperiodend boolean NOT NULL DEFAULT false;
@@ -0,0 +1 @@
+ALTER TABLE stripe_events DROP COLUMN IF EXISTS claimedat;
@@ -0,0 +1 @@
+ALTER TABLE stripe_events ADD COLUMN IF NOT EXISTS claimedat timestamptz;
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS instance_deletion(
+	id bigserial PRIMARY KEY,
+	accountid text,
+	instanceid text,
+	stripesubscriptionid text,
+	outcome text,
+	error text,
+	deletedat timestamptz DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS instance_deletion_outcome_idx ON instance_deletion(outcome);
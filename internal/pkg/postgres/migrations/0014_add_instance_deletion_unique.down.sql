@@ -0,0 +1 @@
+DROP INDEX IF EXISTS instance_deletion_instanceid_outcome_idx;
@@ -0,0 +1,3 @@
+DELETE FROM instance_deletion a USING instance_deletion b
+	WHERE a.instanceid = b.instanceid AND a.outcome = b.outcome AND a.id > b.id;
+CREATE UNIQUE INDEX IF NOT EXISTS instance_deletion_instanceid_outcome_idx ON instance_deletion(instanceid, outcome);
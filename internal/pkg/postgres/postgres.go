@@ -1,37 +1,29 @@
 package postgres
 
 import (
+	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
+	"time"
 
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/crypto"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/tracing"
 	_ "github.com/lib/pq"
 )
 
 const (
-	createTableAccountStmt = `CREATE TABLE IF NOT EXISTS account(
-		uuid text PRIMARY KEY,
-		email text,
-		name text,
-		accounttype text,
-		accesstoken bytea,
-		refreshtoken bytea
-		);`
-
-	alterTableAccountStripeIDStmt = `ALTER TABLE account ADD COLUMN IF NOT EXISTS stripecustid text;`
-
-	createTableInstancesStmt = `CREATE TABLE IF NOT EXISTS instance(
-		id text PRIMARY KEY,
-		accountid text,
-		plan text,
-		name text,
-		CONSTRAINT fk_accountid
-			FOREIGN KEY(accountid)
-			REFERENCES account(uuid)
-		);`
+	instanceColumns = "id, accountid, plan, name, configvars, status, paymentfailedat, stripesubscriptionid, stripepriceid, subscriptionstatus, currentperiodend, cancelatperiodend"
+
+	stripeEventColumns = "id, type, payload, status, attempts, COALESCE(lasterror, ''), receivedat, processedat, claimedat"
+
+	accountColumns = "uuid, email, name, accounttype, accesstoken, refreshtoken, stripecustid, tokenexpiresat, deprovisionedat"
 )
 
+var _ store.Store = &Client{}
+
 type Client struct {
 	sqlDB *sql.DB
 }
@@ -45,48 +37,87 @@ func NewPostgresClient(databaseURL string) (Client, error) {
 	}
 	postgresClient.sqlDB = db
 
-	_, err = db.Exec(createTableAccountStmt)
+	err = db.Ping()
 	if err != nil {
-		return postgresClient, fmt.Errorf("executing create table account statement: %w", err)
+		return postgresClient, fmt.Errorf("connecting to database: %w", err)
 	}
 
-	_, err = db.Exec(alterTableAccountStripeIDStmt)
+	return postgresClient, nil
+}
+
+func (c *Client) CreateOrUpdateAccount(ctx context.Context, cryptoUtil crypto.Util, account account.Account) (err error) {
+	ctx, span := startSpan(ctx, "CreateOrUpdateAccount")
+	defer func() { tracing.End(span, err) }()
+
+	accessEnc, err := cryptoUtil.Seal([]byte(account.AccessToken), associatedData("account", account.UUID, "accesstoken"))
 	if err != nil {
-		return postgresClient, fmt.Errorf("executing alter table account statement: %w", err)
+		return fmt.Errorf("encrypting access token: %w", err)
 	}
 
-	_, err = db.Exec(createTableInstancesStmt)
+	refreshEnc, err := cryptoUtil.Seal([]byte(account.RefreshToken), associatedData("account", account.UUID, "refreshtoken"))
 	if err != nil {
-		return postgresClient, fmt.Errorf("executing create table instances statement: %w", err)
+		return fmt.Errorf("encrypting refresh token: %w", err)
 	}
 
-	return postgresClient, nil
+	tokenExpiresAt := sql.NullTime{
+		Time:  account.TokenExpiresAt,
+		Valid: !account.TokenExpiresAt.IsZero(),
+	}
+
+	// TODO: ensure excluded.* is encrypted
+	stmt := "INSERT INTO account(uuid, email, name, accounttype, accesstoken, refreshtoken, stripecustid, tokenexpiresat) VALUES($1, $2, $3, $4, $5, $6, $7, $8) ON CONFLICT (uuid) DO UPDATE SET email = excluded.email, name = excluded.name, accounttype = excluded.accounttype, accesstoken = excluded.accesstoken, refreshtoken = excluded.refreshtoken, stripecustid = excluded.stripecustid, tokenexpiresat = excluded.tokenexpiresat, deprovisionedat = NULL;"
+	_, err = c.sqlDB.ExecContext(ctx, stmt, account.UUID, account.Email, account.Name, account.AccountType, string(accessEnc), string(refreshEnc), account.StripeCustID, tokenExpiresAt)
+	if err != nil {
+		return err
+	}
+
+	return nil
 }
 
-func (c *Client) CreateOrUpdateAccount(cryptoUtil crypto.Util, account account.Account) error {
-	accessEnc, err := cryptoUtil.Encrypt([]byte(account.AccessToken))
+// UpdateAccountTokens stores refreshed tokens for an account that hasn't
+// been deprovisioned.
+func (c *Client) UpdateAccountTokens(ctx context.Context, cryptoUtil crypto.Util, account account.Account) (err error) {
+	ctx, span := startSpan(ctx, "UpdateAccountTokens")
+	defer func() { tracing.End(span, err) }()
+
+	accessEnc, err := cryptoUtil.Seal([]byte(account.AccessToken), associatedData("account", account.UUID, "accesstoken"))
 	if err != nil {
 		return fmt.Errorf("encrypting access token: %w", err)
 	}
 
-	refreshEnc, err := cryptoUtil.Encrypt([]byte(account.RefreshToken))
+	refreshEnc, err := cryptoUtil.Seal([]byte(account.RefreshToken), associatedData("account", account.UUID, "refreshtoken"))
 	if err != nil {
 		return fmt.Errorf("encrypting refresh token: %w", err)
 	}
 
-	// TODO: ensure excluded.* is encrypted
-	stmt := "INSERT INTO account(uuid, email, name, accounttype, accesstoken, refreshtoken, stripecustid) VALUES($1, $2, $3, $4, $5, $6, $7) ON CONFLICT (uuid) DO UPDATE SET email = excluded.email, name = excluded.name, accounttype = excluded.accounttype, accesstoken = excluded.accesstoken, refreshtoken = excluded.refreshtoken, stripecustid = excluded.stripecustid;"
-	_, err = c.sqlDB.Exec(stmt, account.UUID, account.Email, account.Name, account.AccountType, string(accessEnc), string(refreshEnc), account.StripeCustID)
+	tokenExpiresAt := sql.NullTime{
+		Time:  account.TokenExpiresAt,
+		Valid: !account.TokenExpiresAt.IsZero(),
+	}
+
+	stmt := "UPDATE account SET accesstoken = $2, refreshtoken = $3, tokenexpiresat = $4 WHERE uuid = $1 AND deprovisionedat IS NULL;"
+	res, err := c.sqlDB.ExecContext(ctx, stmt, account.UUID, string(accessEnc), string(refreshEnc), tokenExpiresAt)
 	if err != nil {
-		return err
+		return fmt.Errorf("updating account tokens: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("getting rows affected: %w", err)
+	}
+	if n == 0 {
+		return &store.AccountNotFound{}
 	}
 
 	return nil
 }
 
-func (c *Client) DeleteAccout(uuid string) error {
+func (c *Client) DeleteAccout(ctx context.Context, uuid string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteAccout")
+	defer func() { tracing.End(span, err) }()
+
 	stmt := "DELETE FROM account WHERE uuid = $1;"
-	_, err := c.sqlDB.Exec(stmt, uuid)
+	_, err = c.sqlDB.ExecContext(ctx, stmt, uuid)
 	if err != nil {
 		return err
 	}
@@ -94,9 +125,25 @@ func (c *Client) DeleteAccout(uuid string) error {
 	return nil
 }
 
-func (c *Client) DeleteInstance(accountid, uuid string) error {
+func (c *Client) DeleteInstances(ctx context.Context, accountid string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteInstances")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := "DELETE FROM instance WHERE accountid = $1;"
+	_, err = c.sqlDB.ExecContext(ctx, stmt, accountid)
+	if err != nil {
+		return err
+	}
+
+	return nil
+}
+
+func (c *Client) DeleteInstance(ctx context.Context, accountid, uuid string) (err error) {
+	ctx, span := startSpan(ctx, "DeleteInstance")
+	defer func() { tracing.End(span, err) }()
+
 	stmt := "DELETE FROM instance WHERE accountid = $1 AND id = $2;"
-	_, err := c.sqlDB.Exec(stmt, accountid, uuid)
+	_, err = c.sqlDB.ExecContext(ctx, stmt, accountid, uuid)
 	if err != nil {
 		return err
 	}
@@ -104,40 +151,72 @@ func (c *Client) DeleteInstance(accountid, uuid string) error {
 	return nil
 }
 
-func (c *Client) GetAccountFromEmail(cryptoUtil crypto.Util, email, accountType string) (account.Account, error) {
-	var accounts []account.Account
-	var acct account.Account
-	stmt := `SELECT * FROM account WHERE email = $1 AND accounttype = $2 LIMIT 1`
-	rows, err := c.sqlDB.Query(stmt, email, accountType)
+func (c *Client) RecordInstanceDeletion(ctx context.Context, deletion account.InstanceDeletion) (err error) {
+	ctx, span := startSpan(ctx, "RecordInstanceDeletion")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := "INSERT INTO instance_deletion(accountid, instanceid, stripesubscriptionid, outcome, error) VALUES($1, $2, $3, $4, $5) ON CONFLICT (instanceid, outcome) DO NOTHING;"
+	_, err = c.sqlDB.ExecContext(ctx, stmt, deletion.AccountID, deletion.InstanceID, deletion.SubscriptionID, deletion.Outcome, deletion.Error)
+	if err != nil {
+		return fmt.Errorf("writing instance deletion: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Client) GetInstanceDeletions(ctx context.Context, outcome string) (_ []account.InstanceDeletion, err error) {
+	ctx, span := startSpan(ctx, "GetInstanceDeletions")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := "SELECT accountid, instanceid, stripesubscriptionid, outcome, error, deletedat FROM instance_deletion WHERE outcome = $1 ORDER BY deletedat, id;"
+	rows, err := c.sqlDB.QueryContext(ctx, stmt, outcome)
 	if err != nil {
-		return acct, fmt.Errorf("executing select query: %s", err)
+		return nil, fmt.Errorf("executing select query: %w", err)
 	}
 	defer rows.Close()
 
+	var deletions []account.InstanceDeletion
 	for rows.Next() {
-		var a account.Account
-		err := rows.Scan(&a.UUID, &a.Email, &a.Name, &a.AccountType, &a.AccessToken, &a.RefreshToken, &a.StripeCustID)
+		var d account.InstanceDeletion
+		err = rows.Scan(&d.AccountID, &d.InstanceID, &d.SubscriptionID, &d.Outcome, &d.Error, &d.DeletedAt)
 		if err != nil {
-			return acct, err
+			return nil, err
 		}
+		deletions = append(deletions, d)
+	}
 
-		accessToken, err := cryptoUtil.Decrypt([]byte(a.AccessToken))
-		if err != nil {
-			return acct, err
-		}
+	return deletions, rows.Err()
+}
 
-		refreshToken, err := cryptoUtil.Decrypt([]byte(a.RefreshToken))
-		if err != nil {
-			return acct, err
-		}
+func (c *Client) GetAccount(ctx context.Context, cryptoUtil crypto.Util, uuid string) (_ account.Account, err error) {
+	ctx, span := startSpan(ctx, "GetAccount")
+	defer func() { tracing.End(span, err) }()
 
-		a.AccessToken = string(accessToken)
-		a.RefreshToken = string(refreshToken)
-		accounts = append(accounts, a)
+	stmt := fmt.Sprintf(`SELECT %s FROM account WHERE uuid = $1`, accountColumns)
+	accounts, err := c.queryAccounts(ctx, cryptoUtil, stmt, uuid)
+	if err != nil {
+		return account.Account{}, err
+	}
+
+	if len(accounts) == 0 {
+		return account.Account{}, &store.AccountNotFound{}
+	}
+
+	return accounts[0], nil
+}
+
+func (c *Client) GetAccountFromEmail(ctx context.Context, cryptoUtil crypto.Util, email, accountType string) (_ account.Account, err error) {
+	ctx, span := startSpan(ctx, "GetAccountFromEmail")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := fmt.Sprintf(`SELECT %s FROM account WHERE email = $1 AND accounttype = $2 AND deprovisionedat IS NULL LIMIT 1`, accountColumns)
+	accounts, err := c.queryAccounts(ctx, cryptoUtil, stmt, email, accountType)
+	if err != nil {
+		return account.Account{}, err
 	}
 
 	if len(accounts) == 0 {
-		return account.Account{}, &AccountNotFound{
+		return account.Account{}, &store.AccountNotFound{
 			Email: email,
 		}
 	}
@@ -149,52 +228,154 @@ func (c *Client) GetAccountFromEmail(cryptoUtil crypto.Util, email, accountType
 	return accounts[0], nil
 }
 
-func (c *Client) GetAccountFromStripeCustID(cryptoUtil crypto.Util, stripeCustID string) (account.Account, error) {
+func (c *Client) GetAccountFromStripeCustID(ctx context.Context, cryptoUtil crypto.Util, stripeCustID string) (_ account.Account, err error) {
+	ctx, span := startSpan(ctx, "GetAccountFromStripeCustID")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := fmt.Sprintf(`SELECT %s FROM account WHERE stripecustid = $1 LIMIT 1`, accountColumns)
+	accounts, err := c.queryAccounts(ctx, cryptoUtil, stmt, stripeCustID)
+	if err != nil {
+		return account.Account{}, err
+	}
+
+	if len(accounts) == 0 {
+		return account.Account{}, &store.AccountNotFound{}
+	}
+
+	if len(accounts) > 1 {
+		return account.Account{}, fmt.Errorf("more than 1 account was returned for stripecustid %s", stripeCustID)
+	}
+
+	return accounts[0], nil
+}
+
+// GetAccountsWithExpiringTokens returns active Heroku accounts whose access
+// token expires before the given time.
+func (c *Client) GetAccountsWithExpiringTokens(ctx context.Context, cryptoUtil crypto.Util, before time.Time) (_ []account.Account, err error) {
+	ctx, span := startSpan(ctx, "GetAccountsWithExpiringTokens")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := fmt.Sprintf(`SELECT %s FROM account WHERE accounttype = $1 AND deprovisionedat IS NULL AND (tokenexpiresat IS NULL OR tokenexpiresat < $2)`, accountColumns)
+	return c.queryAccounts(ctx, cryptoUtil, stmt, account.AccountTypeHeroku, before)
+}
+
+// DeprovisionAccount clears the stored tokens for an account and marks it as
+// deprovisioned. The row itself is kept until PurgeDeprovisionedAccounts
+// removes it after the retention period.
+func (c *Client) DeprovisionAccount(ctx context.Context, cryptoUtil crypto.Util, uuid string) (err error) {
+	ctx, span := startSpan(ctx, "DeprovisionAccount")
+	defer func() { tracing.End(span, err) }()
+
+	accessEnc, err := cryptoUtil.Seal([]byte(""), associatedData("account", uuid, "accesstoken"))
+	if err != nil {
+		return fmt.Errorf("encrypting access token: %w", err)
+	}
+
+	refreshEnc, err := cryptoUtil.Seal([]byte(""), associatedData("account", uuid, "refreshtoken"))
+	if err != nil {
+		return fmt.Errorf("encrypting refresh token: %w", err)
+	}
+
+	stmt := "UPDATE account SET accesstoken = $1, refreshtoken = $2, tokenexpiresat = NULL, deprovisionedat = now() WHERE uuid = $3;"
+	_, err = c.sqlDB.ExecContext(ctx, stmt, string(accessEnc), string(refreshEnc), uuid)
+	if err != nil {
+		return fmt.Errorf("deprovisioning account: %w", err)
+	}
+
+	return nil
+}
+
+// PurgeDeprovisionedAccounts deletes accounts, and any remaining instances,
+// that were deprovisioned before the given time.
+func (c *Client) PurgeDeprovisionedAccounts(ctx context.Context, before time.Time) (_ int64, err error) {
+	ctx, span := startSpan(ctx, "PurgeDeprovisionedAccounts")
+	defer func() { tracing.End(span, err) }()
+
+	tx, err := c.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	stmt := "DELETE FROM instance WHERE accountid IN (SELECT uuid FROM account WHERE deprovisionedat < $1);"
+	_, err = tx.ExecContext(ctx, stmt, before)
+	if err != nil {
+		return 0, fmt.Errorf("deleting instances: %w", err)
+	}
+
+	stmt = "DELETE FROM account WHERE deprovisionedat < $1;"
+	res, err := tx.ExecContext(ctx, stmt, before)
+	if err != nil {
+		return 0, fmt.Errorf("deleting accounts: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("getting rows affected: %w", err)
+	}
+
+	return n, tx.Commit()
+}
+
+func (c *Client) queryAccounts(ctx context.Context, cryptoUtil crypto.Util, stmt string, args ...any) ([]account.Account, error) {
 	var accounts []account.Account
-	var acct account.Account
-	stmt := `SELECT * FROM account WHERE stripecustid = $1 LIMIT 1`
-	rows, err := c.sqlDB.Query(stmt, stripeCustID)
+	rows, err := c.sqlDB.QueryContext(ctx, stmt, args...)
 	if err != nil {
-		return acct, fmt.Errorf("executing select query: %s", err)
+		return accounts, fmt.Errorf("executing select query: %s", err)
 	}
 	defer rows.Close()
 
 	for rows.Next() {
 		var a account.Account
-		err := rows.Scan(&a.UUID, &a.Email, &a.Name, &a.AccountType, &a.AccessToken, &a.RefreshToken, &a.StripeCustID)
+		var tokenExpiresAt, deprovisionedAt sql.NullTime
+		err := rows.Scan(&a.UUID, &a.Email, &a.Name, &a.AccountType, &a.AccessToken, &a.RefreshToken, &a.StripeCustID, &tokenExpiresAt, &deprovisionedAt)
 		if err != nil {
-			return acct, err
+			return accounts, err
 		}
 
-		accessToken, err := cryptoUtil.Decrypt([]byte(a.AccessToken))
+		accessToken, err := cryptoUtil.Open([]byte(a.AccessToken), associatedData("account", a.UUID, "accesstoken"))
 		if err != nil {
-			return acct, err
+			return accounts, err
 		}
 
-		refreshToken, err := cryptoUtil.Decrypt([]byte(a.RefreshToken))
+		refreshToken, err := cryptoUtil.Open([]byte(a.RefreshToken), associatedData("account", a.UUID, "refreshtoken"))
 		if err != nil {
-			return acct, err
+			return accounts, err
 		}
 
 		a.AccessToken = string(accessToken)
 		a.RefreshToken = string(refreshToken)
+		a.TokenExpiresAt = tokenExpiresAt.Time
+		a.DeprovisionedAt = deprovisionedAt.Time
 		accounts = append(accounts, a)
 	}
 
-	if len(accounts) == 0 {
-		return account.Account{}, &AccountNotFound{}
+	return accounts, rows.Err()
+}
+
+func (c *Client) CreateOrUpdateInstance(ctx context.Context, cryptoUtil crypto.Util, instance account.Instance) (err error) {
+	ctx, span := startSpan(ctx, "CreateOrUpdateInstance")
+	defer func() { tracing.End(span, err) }()
+
+	configVarsEnc, err := encryptConfigVars(cryptoUtil, instance.Id, instance.ConfigVars)
+	if err != nil {
+		return err
 	}
 
-	if len(accounts) > 1 {
-		return account.Account{}, fmt.Errorf("more than 1 account was returned for stripecustid %s", stripeCustID)
+	if instance.Status == "" {
+		instance.Status = account.InstanceStatusActive
 	}
 
-	return accounts[0], nil
-}
+	paymentFailedAt := sql.NullTime{
+		Time:  instance.PaymentFailedAt,
+		Valid: !instance.PaymentFailedAt.IsZero(),
+	}
+
+	args := []any{instance.Id, instance.AccountID, instance.Plan, instance.Name, string(configVarsEnc), instance.Status, paymentFailedAt}
+	args = append(args, subscriptionValues(instance.Subscription)...)
 
-func (c *Client) CreateOrUpdateInstance(instance account.Instance) error {
-	stmt := "INSERT INTO instance(id, accountid, plan, name) VALUES($1, $2, $3, $4);"
-	_, err := c.sqlDB.Exec(stmt, instance.Id, instance.AccountID, instance.Plan, instance.Name)
+	stmt := "INSERT INTO instance(id, accountid, plan, name, configvars, status, paymentfailedat, stripesubscriptionid, stripepriceid, subscriptionstatus, currentperiodend, cancelatperiodend) VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12) ON CONFLICT (id) DO UPDATE SET plan = excluded.plan, name = excluded.name, configvars = excluded.configvars, status = excluded.status, paymentfailedat = excluded.paymentfailedat, stripesubscriptionid = excluded.stripesubscriptionid, stripepriceid = excluded.stripepriceid, subscriptionstatus = excluded.subscriptionstatus, currentperiodend = excluded.currentperiodend, cancelatperiodend = excluded.cancelatperiodend;"
+	_, err = c.sqlDB.ExecContext(ctx, stmt, args...)
 	if err != nil {
 		return fmt.Errorf("writing instance: %w", err)
 	}
@@ -202,10 +383,116 @@ func (c *Client) CreateOrUpdateInstance(instance account.Instance) error {
 	return nil
 }
 
-func (c *Client) GetInstances(accountID string) ([]account.Instance, error) {
+func (c *Client) GetInstances(ctx context.Context, cryptoUtil crypto.Util, accountID string) (_ []account.Instance, err error) {
+	ctx, span := startSpan(ctx, "GetInstances")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := fmt.Sprintf(`SELECT %s FROM instance WHERE accountid = $1;`, instanceColumns)
+	return c.queryInstances(ctx, cryptoUtil, stmt, accountID)
+}
+
+func (c *Client) GetInstance(ctx context.Context, cryptoUtil crypto.Util, accountID, id string) (_ account.Instance, err error) {
+	ctx, span := startSpan(ctx, "GetInstance")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := fmt.Sprintf(`SELECT %s FROM instance WHERE accountid = $1 AND id = $2;`, instanceColumns)
+	instances, err := c.queryInstances(ctx, cryptoUtil, stmt, accountID, id)
+	if err != nil {
+		return account.Instance{}, err
+	}
+
+	if len(instances) == 0 {
+		return account.Instance{}, &store.InstanceNotFound{
+			ID: id,
+		}
+	}
+
+	return instances[0], nil
+}
+
+// GetInstanceFromStripeSubscriptionID returns the instance paid for by a
+// Stripe subscription.
+func (c *Client) GetInstanceFromStripeSubscriptionID(ctx context.Context, cryptoUtil crypto.Util, subscriptionID string) (_ account.Instance, err error) {
+	ctx, span := startSpan(ctx, "GetInstanceFromStripeSubscriptionID")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := fmt.Sprintf(`SELECT %s FROM instance WHERE stripesubscriptionid = $1;`, instanceColumns)
+	instances, err := c.queryInstances(ctx, cryptoUtil, stmt, subscriptionID)
+	if err != nil {
+		return account.Instance{}, err
+	}
+
+	if len(instances) == 0 {
+		return account.Instance{}, &store.InstanceNotFound{}
+	}
+
+	return instances[0], nil
+}
+
+// GetInstancesWithFailedPayments returns active instances whose latest
+// payment failed before the given time.
+func (c *Client) GetInstancesWithFailedPayments(ctx context.Context, cryptoUtil crypto.Util, before time.Time) (_ []account.Instance, err error) {
+	ctx, span := startSpan(ctx, "GetInstancesWithFailedPayments")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := fmt.Sprintf(`SELECT %s FROM instance WHERE status = $1 AND paymentfailedat < $2;`, instanceColumns)
+	return c.queryInstances(ctx, cryptoUtil, stmt, account.InstanceStatusActive, before)
+}
+
+func (c *Client) UpdateInstanceStatus(ctx context.Context, accountID, id string, status account.InstanceStatus) (err error) {
+	ctx, span := startSpan(ctx, "UpdateInstanceStatus")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := "UPDATE instance SET status = $1 WHERE accountid = $2 AND id = $3;"
+	_, err = c.sqlDB.ExecContext(ctx, stmt, status, accountID, id)
+	if err != nil {
+		return fmt.Errorf("updating instance status: %w", err)
+	}
+
+	return nil
+}
+
+// UpdateInstancePaymentFailedAt records when a payment for the instance
+// failed, the zero time clears it.
+func (c *Client) UpdateInstancePaymentFailedAt(ctx context.Context, accountID, id string, failedAt time.Time) (err error) {
+	ctx, span := startSpan(ctx, "UpdateInstancePaymentFailedAt")
+	defer func() { tracing.End(span, err) }()
+
+	paymentFailedAt := sql.NullTime{
+		Time:  failedAt,
+		Valid: !failedAt.IsZero(),
+	}
+
+	stmt := "UPDATE instance SET paymentfailedat = $1 WHERE accountid = $2 AND id = $3;"
+	_, err = c.sqlDB.ExecContext(ctx, stmt, paymentFailedAt, accountID, id)
+	if err != nil {
+		return fmt.Errorf("updating instance payment failure: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Client) UpdateInstanceConfigVars(ctx context.Context, cryptoUtil crypto.Util, accountID, id string, configVars map[string]string) (err error) {
+	ctx, span := startSpan(ctx, "UpdateInstanceConfigVars")
+	defer func() { tracing.End(span, err) }()
+
+	configVarsEnc, err := encryptConfigVars(cryptoUtil, id, configVars)
+	if err != nil {
+		return err
+	}
+
+	stmt := "UPDATE instance SET configvars = $1 WHERE accountid = $2 AND id = $3;"
+	_, err = c.sqlDB.ExecContext(ctx, stmt, string(configVarsEnc), accountID, id)
+	if err != nil {
+		return fmt.Errorf("updating instance config vars: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Client) queryInstances(ctx context.Context, cryptoUtil crypto.Util, stmt string, args ...any) ([]account.Instance, error) {
 	instances := []account.Instance{}
-	stmt := `SELECT * FROM instance WHERE accountid = $1;`
-	rows, err := c.sqlDB.Query(stmt, accountID)
+	rows, err := c.sqlDB.QueryContext(ctx, stmt, args...)
 	if err != nil {
 		return instances, fmt.Errorf("executing select query: %s", err)
 	}
@@ -213,11 +500,297 @@ func (c *Client) GetInstances(accountID string) ([]account.Instance, error) {
 
 	for rows.Next() {
 		var i account.Instance
-		err := rows.Scan(&i.Id, &i.AccountID, &i.Plan, &i.Name)
+		var configVarsEnc []byte
+		var paymentFailedAt, currentPeriodEnd sql.NullTime
+		var subscriptionID, priceID, subscriptionStatus sql.NullString
+		var cancelAtPeriodEnd bool
+		err := rows.Scan(&i.Id, &i.AccountID, &i.Plan, &i.Name, &configVarsEnc, &i.Status, &paymentFailedAt, &subscriptionID, &priceID, &subscriptionStatus, &currentPeriodEnd, &cancelAtPeriodEnd)
+		if err != nil {
+			return instances, err
+		}
+		i.PaymentFailedAt = paymentFailedAt.Time
+
+		if subscriptionID.Valid {
+			i.Subscription = &account.Subscription{
+				ID:                subscriptionID.String,
+				PriceID:           priceID.String,
+				Status:            subscriptionStatus.String,
+				CurrentPeriodEnd:  currentPeriodEnd.Time,
+				CancelAtPeriodEnd: cancelAtPeriodEnd,
+			}
+		}
+
+		i.ConfigVars, err = decryptConfigVars(cryptoUtil, i.Id, configVarsEnc)
 		if err != nil {
 			return instances, err
 		}
 		instances = append(instances, i)
 	}
-	return instances, nil
+	return instances, rows.Err()
+}
+
+// UpdateInstanceSubscription stores the latest billing state reported by
+// Stripe for an instance. A subscription without an ID unlinks the instance
+// from Stripe.
+func (c *Client) UpdateInstanceSubscription(ctx context.Context, accountID, id string, subscription account.Subscription) (err error) {
+	ctx, span := startSpan(ctx, "UpdateInstanceSubscription")
+	defer func() { tracing.End(span, err) }()
+
+	args := append(subscriptionValues(&subscription), accountID, id)
+
+	stmt := "UPDATE instance SET stripesubscriptionid = $1, stripepriceid = $2, subscriptionstatus = $3, currentperiodend = $4, cancelatperiodend = $5 WHERE accountid = $6 AND id = $7;"
+	_, err = c.sqlDB.ExecContext(ctx, stmt, args...)
+	if err != nil {
+		return fmt.Errorf("updating instance subscription: %w", err)
+	}
+
+	return nil
+}
+
+// subscriptionValues returns the values of the subscription columns of an
+// instance, in the order they appear in instanceColumns. A nil subscription
+// is stored as NULLs.
+func subscriptionValues(subscription *account.Subscription) []any {
+	if subscription == nil || subscription.ID == "" {
+		return []any{sql.NullString{}, sql.NullString{}, sql.NullString{}, sql.NullTime{}, false}
+	}
+
+	return []any{
+		sql.NullString{String: subscription.ID, Valid: true},
+		sql.NullString{String: subscription.PriceID, Valid: subscription.PriceID != ""},
+		sql.NullString{String: subscription.Status, Valid: subscription.Status != ""},
+		sql.NullTime{Time: subscription.CurrentPeriodEnd, Valid: !subscription.CurrentPeriodEnd.IsZero()},
+		subscription.CancelAtPeriodEnd,
+	}
+}
+
+func encryptConfigVars(cryptoUtil crypto.Util, instanceID string, configVars map[string]string) ([]byte, error) {
+	if len(configVars) == 0 {
+		return nil, nil
+	}
+
+	j, err := json.Marshal(configVars)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling config vars: %w", err)
+	}
+
+	configVarsEnc, err := cryptoUtil.Seal(j, associatedData("instance", instanceID, "configvars"))
+	if err != nil {
+		return nil, fmt.Errorf("encrypting config vars: %w", err)
+	}
+
+	return configVarsEnc, nil
+}
+
+func decryptConfigVars(cryptoUtil crypto.Util, instanceID string, configVarsEnc []byte) (map[string]string, error) {
+	if len(configVarsEnc) == 0 {
+		return nil, nil
+	}
+
+	j, err := cryptoUtil.Open(configVarsEnc, associatedData("instance", instanceID, "configvars"))
+	if err != nil {
+		return nil, fmt.Errorf("decrypting config vars: %w", err)
+	}
+
+	var configVars map[string]string
+	err = json.Unmarshal(j, &configVars)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshalling config vars: %w", err)
+	}
+
+	return configVars, nil
+}
+
+func (c *Client) UpdateInstancePlan(ctx context.Context, accountID, id, plan string) (err error) {
+	ctx, span := startSpan(ctx, "UpdateInstancePlan")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := "UPDATE instance SET plan = $1 WHERE accountid = $2 AND id = $3;"
+	res, err := c.sqlDB.ExecContext(ctx, stmt, plan, accountID, id)
+	if err != nil {
+		return fmt.Errorf("updating instance plan: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("getting rows affected: %w", err)
+	}
+
+	if n == 0 {
+		return fmt.Errorf("instance %s not found for account %s", id, accountID)
+	}
+
+	return nil
+}
+
+func (c *Client) CreateProvisioningJob(ctx context.Context, cryptoUtil crypto.Util, job account.ProvisioningJob) (err error) {
+	ctx, span := startSpan(ctx, "CreateProvisioningJob")
+	defer func() { tracing.End(span, err) }()
+
+	codeEnc, err := cryptoUtil.Seal([]byte(job.OauthCode), associatedData("provisioning_job", job.ResourceUUID, "oauthcode"))
+	if err != nil {
+		return fmt.Errorf("encrypting oauth code: %w", err)
+	}
+
+	stmt := "INSERT INTO provisioning_job(resourceuuid, plan, region, oauthcode, status) VALUES($1, $2, $3, $4, $5) ON CONFLICT (resourceuuid) DO NOTHING;"
+	_, err = c.sqlDB.ExecContext(ctx, stmt, job.ResourceUUID, job.Plan, job.Region, string(codeEnc), job.Status)
+	if err != nil {
+		return fmt.Errorf("writing provisioning job: %w", err)
+	}
+
+	return nil
+}
+
+// ClaimProvisioningJob marks the oldest pending job as running and returns it.
+// Jobs left running by a worker that died are reclaimed after
+// store.StaleProvisioningJobAge. The bool is false when there is nothing to claim.
+func (c *Client) ClaimProvisioningJob(ctx context.Context, cryptoUtil crypto.Util) (_ account.ProvisioningJob, _ bool, err error) {
+	ctx, span := startSpan(ctx, "ClaimProvisioningJob")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := `UPDATE provisioning_job SET status = $1, attempts = attempts + 1, updatedat = now()
+		WHERE resourceuuid = (
+			SELECT resourceuuid FROM provisioning_job
+			WHERE status = $2 OR (status = $1 AND updatedat < $3)
+			ORDER BY createdat
+			FOR UPDATE SKIP LOCKED
+			LIMIT 1
+		)
+		RETURNING resourceuuid, plan, region, oauthcode, status, attempts, COALESCE(lasterror, '');`
+
+	var job account.ProvisioningJob
+	var codeEnc []byte
+	row := c.sqlDB.QueryRowContext(ctx, stmt, account.ProvisioningJobStatusRunning, account.ProvisioningJobStatusPending, time.Now().Add(-store.StaleProvisioningJobAge))
+	err = row.Scan(&job.ResourceUUID, &job.Plan, &job.Region, &codeEnc, &job.Status, &job.Attempts, &job.LastError)
+	if err == sql.ErrNoRows {
+		return job, false, nil
+	}
+	if err != nil {
+		return job, false, fmt.Errorf("claiming provisioning job: %w", err)
+	}
+
+	code, err := cryptoUtil.Open(codeEnc, associatedData("provisioning_job", job.ResourceUUID, "oauthcode"))
+	if err != nil {
+		return job, false, fmt.Errorf("decrypting oauth code: %w", err)
+	}
+	job.OauthCode = string(code)
+
+	return job, true, nil
+}
+
+func (c *Client) UpdateProvisioningJob(ctx context.Context, job account.ProvisioningJob) (err error) {
+	ctx, span := startSpan(ctx, "UpdateProvisioningJob")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := "UPDATE provisioning_job SET status = $1, lasterror = $2, updatedat = now() WHERE resourceuuid = $3;"
+	_, err = c.sqlDB.ExecContext(ctx, stmt, job.Status, job.LastError, job.ResourceUUID)
+	if err != nil {
+		return fmt.Errorf("updating provisioning job: %w", err)
+	}
+
+	return nil
+}
+
+// ClaimStripeEvent records a received webhook event, or takes over one that
+// is waiting to be processed, in a single statement so that concurrent
+// deliveries of the same event can't both claim it.
+func (c *Client) ClaimStripeEvent(ctx context.Context, event account.StripeEvent) (_ account.StripeEvent, _ bool, err error) {
+	ctx, span := startSpan(ctx, "ClaimStripeEvent")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := fmt.Sprintf(`INSERT INTO stripe_events(id, type, payload, status, claimedat) VALUES($1, $2, $3, $4, now())
+		ON CONFLICT (id) DO UPDATE SET status = excluded.status, claimedat = excluded.claimedat
+		WHERE stripe_events.status IN ($5, $6) OR (stripe_events.status = $4 AND stripe_events.claimedat < $7)
+		RETURNING %s;`, stripeEventColumns)
+	events, err := c.queryStripeEvents(ctx, stmt, event.ID, event.Type, string(event.Payload), account.StripeEventStatusProcessing,
+		account.StripeEventStatusReceived, account.StripeEventStatusFailed, time.Now().Add(-store.StaleStripeEventAge))
+	if err != nil {
+		return account.StripeEvent{}, false, fmt.Errorf("claiming stripe event: %w", err)
+	}
+	if len(events) > 0 {
+		return events[0], true, nil
+	}
+
+	existing, err := c.GetStripeEvent(ctx, event.ID)
+	if err != nil {
+		return account.StripeEvent{}, false, err
+	}
+	return existing, false, nil
+}
+
+func (c *Client) GetStripeEvent(ctx context.Context, id string) (_ account.StripeEvent, err error) {
+	ctx, span := startSpan(ctx, "GetStripeEvent")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := fmt.Sprintf(`SELECT %s FROM stripe_events WHERE id = $1;`, stripeEventColumns)
+	events, err := c.queryStripeEvents(ctx, stmt, id)
+	if err != nil {
+		return account.StripeEvent{}, err
+	}
+
+	if len(events) == 0 {
+		return account.StripeEvent{}, &store.StripeEventNotFound{
+			ID: id,
+		}
+	}
+
+	return events[0], nil
+}
+
+// GetStripeEventsByStatus returns the events with the given status, oldest
+// first.
+func (c *Client) GetStripeEventsByStatus(ctx context.Context, status account.StripeEventStatus) (_ []account.StripeEvent, err error) {
+	ctx, span := startSpan(ctx, "GetStripeEventsByStatus")
+	defer func() { tracing.End(span, err) }()
+
+	stmt := fmt.Sprintf(`SELECT %s FROM stripe_events WHERE status = $1 ORDER BY receivedat;`, stripeEventColumns)
+	return c.queryStripeEvents(ctx, stmt, status)
+}
+
+func (c *Client) UpdateStripeEvent(ctx context.Context, event account.StripeEvent) (err error) {
+	ctx, span := startSpan(ctx, "UpdateStripeEvent")
+	defer func() { tracing.End(span, err) }()
+
+	processedAt := sql.NullTime{
+		Time:  event.ProcessedAt,
+		Valid: !event.ProcessedAt.IsZero(),
+	}
+
+	stmt := "UPDATE stripe_events SET status = $1, attempts = $2, lasterror = $3, processedat = $4 WHERE id = $5;"
+	_, err = c.sqlDB.ExecContext(ctx, stmt, event.Status, event.Attempts, event.LastError, processedAt, event.ID)
+	if err != nil {
+		return fmt.Errorf("updating stripe event: %w", err)
+	}
+
+	return nil
+}
+
+func (c *Client) queryStripeEvents(ctx context.Context, stmt string, args ...any) ([]account.StripeEvent, error) {
+	var events []account.StripeEvent
+	rows, err := c.sqlDB.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return events, fmt.Errorf("executing select query: %s", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var e account.StripeEvent
+		var processedAt, claimedAt sql.NullTime
+		err := rows.Scan(&e.ID, &e.Type, &e.Payload, &e.Status, &e.Attempts, &e.LastError, &e.ReceivedAt, &processedAt, &claimedAt)
+		if err != nil {
+			return events, err
+		}
+
+		e.ProcessedAt = processedAt.Time
+		e.ClaimedAt = claimedAt.Time
+		events = append(events, e)
+	}
+
+	return events, rows.Err()
+}
+
+// associatedData binds an encrypted value to the row and column it is stored
+// in, so that a ciphertext copied to another row fails to decrypt.
+func associatedData(table, id, column string) []byte {
+	return []byte(fmt.Sprintf("%s:%s:%s", table, id, column))
 }
@@ -0,0 +1,62 @@
+package postgres
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store/storetest"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/web/webtest"
+)
+
+// testDatabaseURL skips the test unless DATABASE_URL points at a database the
+// tests may wipe.
+func testDatabaseURL(t *testing.T) string {
+	t.Helper()
+
+	databaseURL := os.Getenv("DATABASE_URL")
+	if databaseURL == "" {
+		t.Skip("DATABASE_URL is not set")
+	}
+	return databaseURL
+}
+
+// newTestClient connects to the database, migrates it and empties every
+// table. The database is shared between tests, so they don't run in parallel.
+func newTestClient(t *testing.T, databaseURL string) *Client {
+	t.Helper()
+
+	client, err := NewPostgresClient(databaseURL)
+	if err != nil {
+		t.Fatalf("connecting to postgres: %s", err)
+	}
+	t.Cleanup(func() { client.sqlDB.Close() })
+
+	ctx := context.Background()
+	_, err = client.MigrateUp(ctx)
+	if err != nil {
+		t.Fatalf("migrating: %s", err)
+	}
+
+	_, err = client.sqlDB.ExecContext(ctx, "TRUNCATE account, instance, instance_deletion, provisioning_job, stripe_events CASCADE;")
+	if err != nil {
+		t.Fatalf("truncating tables: %s", err)
+	}
+
+	return &client
+}
+
+func TestStore(t *testing.T) {
+	databaseURL := testDatabaseURL(t)
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return newTestClient(t, databaseURL)
+	})
+}
+
+func TestHerokuAddon(t *testing.T) {
+	databaseURL := testDatabaseURL(t)
+	webtest.Run(t, func(t *testing.T) store.Store {
+		return newTestClient(t, databaseURL)
+	})
+}
@@ -0,0 +1,197 @@
+package postgres
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/crypto"
+)
+
+// ReencryptAccountTokens re-seals the access and refresh tokens of every
+// account that was encrypted with a key other than the active key, or before
+// tokens were bound to their row with additional data. Accounts
+// are processed in batches of batchSize, each in its own transaction, and
+// the number of updated accounts is returned.
+func (c *Client) ReencryptAccountTokens(ctx context.Context, cryptoUtil crypto.Util, batchSize int) (int, error) {
+	updated := 0
+	lastUUID := ""
+	for {
+		n, last, err := c.reencryptAccountBatch(ctx, cryptoUtil, lastUUID, batchSize)
+		if err != nil {
+			return updated, err
+		}
+		updated += n
+
+		if last == "" {
+			return updated, nil
+		}
+		lastUUID = last
+	}
+}
+
+// ReencryptInstanceConfigVars is ReencryptAccountTokens for the config vars
+// stored with each instance.
+func (c *Client) ReencryptInstanceConfigVars(ctx context.Context, cryptoUtil crypto.Util, batchSize int) (int, error) {
+	updated := 0
+	lastID := ""
+	for {
+		n, last, err := c.reencryptInstanceBatch(ctx, cryptoUtil, lastID, batchSize)
+		if err != nil {
+			return updated, err
+		}
+		updated += n
+
+		if last == "" {
+			return updated, nil
+		}
+		lastID = last
+	}
+}
+
+// reencryptAccountBatch returns the number of accounts updated and the last
+// uuid in the batch, which is empty once there are no more rows.
+func (c *Client) reencryptAccountBatch(ctx context.Context, cryptoUtil crypto.Util, afterUUID string, batchSize int) (int, string, error) {
+	tx, err := c.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	type tokens struct {
+		uuid         string
+		accessToken  []byte
+		refreshToken []byte
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT uuid, accesstoken, refreshtoken FROM account WHERE uuid > $1 ORDER BY uuid LIMIT $2 FOR UPDATE;", afterUUID, batchSize)
+	if err != nil {
+		return 0, "", fmt.Errorf("selecting accounts: %w", err)
+	}
+
+	var batch []tokens
+	for rows.Next() {
+		var t tokens
+		err := rows.Scan(&t.uuid, &t.accessToken, &t.refreshToken)
+		if err != nil {
+			rows.Close()
+			return 0, "", err
+		}
+		batch = append(batch, t)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, "", err
+	}
+
+	if len(batch) == 0 {
+		return 0, "", nil
+	}
+
+	updated := 0
+	for _, t := range batch {
+		accessAD := associatedData("account", t.uuid, "accesstoken")
+		refreshAD := associatedData("account", t.uuid, "refreshtoken")
+		if !cryptoUtil.NeedsRotation(t.accessToken, accessAD) && !cryptoUtil.NeedsRotation(t.refreshToken, refreshAD) {
+			continue
+		}
+
+		accessEnc, err := reencrypt(cryptoUtil, t.accessToken, accessAD)
+		if err != nil {
+			return 0, "", fmt.Errorf("re-encrypting access token for account %s: %w", t.uuid, err)
+		}
+
+		refreshEnc, err := reencrypt(cryptoUtil, t.refreshToken, refreshAD)
+		if err != nil {
+			return 0, "", fmt.Errorf("re-encrypting refresh token for account %s: %w", t.uuid, err)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE account SET accesstoken = $1, refreshtoken = $2 WHERE uuid = $3;", string(accessEnc), string(refreshEnc), t.uuid)
+		if err != nil {
+			return 0, "", fmt.Errorf("updating account %s: %w", t.uuid, err)
+		}
+		updated++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, "", fmt.Errorf("committing batch: %w", err)
+	}
+
+	return updated, batch[len(batch)-1].uuid, nil
+}
+
+func (c *Client) reencryptInstanceBatch(ctx context.Context, cryptoUtil crypto.Util, afterID string, batchSize int) (int, string, error) {
+	tx, err := c.sqlDB.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, "", fmt.Errorf("beginning transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	type configVars struct {
+		id  string
+		enc []byte
+	}
+
+	rows, err := tx.QueryContext(ctx, "SELECT id, configvars FROM instance WHERE id > $1 ORDER BY id LIMIT $2 FOR UPDATE;", afterID, batchSize)
+	if err != nil {
+		return 0, "", fmt.Errorf("selecting instances: %w", err)
+	}
+
+	var batch []configVars
+	for rows.Next() {
+		var cv configVars
+		err := rows.Scan(&cv.id, &cv.enc)
+		if err != nil {
+			rows.Close()
+			return 0, "", err
+		}
+		batch = append(batch, cv)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, "", err
+	}
+
+	if len(batch) == 0 {
+		return 0, "", nil
+	}
+
+	updated := 0
+	for _, cv := range batch {
+		ad := associatedData("instance", cv.id, "configvars")
+		if len(cv.enc) == 0 || !cryptoUtil.NeedsRotation(cv.enc, ad) {
+			continue
+		}
+
+		enc, err := reencrypt(cryptoUtil, cv.enc, ad)
+		if err != nil {
+			return 0, "", fmt.Errorf("re-encrypting config vars for instance %s: %w", cv.id, err)
+		}
+
+		_, err = tx.ExecContext(ctx, "UPDATE instance SET configvars = $1 WHERE id = $2;", string(enc), cv.id)
+		if err != nil {
+			return 0, "", fmt.Errorf("updating instance %s: %w", cv.id, err)
+		}
+		updated++
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return 0, "", fmt.Errorf("committing batch: %w", err)
+	}
+
+	return updated, batch[len(batch)-1].id, nil
+}
+
+func reencrypt(cryptoUtil crypto.Util, ciphertext, additionalData []byte) ([]byte, error) {
+	if !cryptoUtil.NeedsRotation(ciphertext, additionalData) {
+		return ciphertext, nil
+	}
+
+	plaintext, err := cryptoUtil.Open(ciphertext, additionalData)
+	if err != nil {
+		return nil, fmt.Errorf("decrypting: %w", err)
+	}
+
+	return cryptoUtil.Seal(plaintext, additionalData)
+}
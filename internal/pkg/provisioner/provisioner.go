@@ -1,5 +1,54 @@
 package provisioner
 
-func ProvisionResource() error {
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+)
+
+const (
+	ConfigVarURL    = "ALLOYD_URL"
+	ConfigVarAPIKey = "ALLOYD_API_KEY"
+
+	resourceURLFormat = "https://%s.alloyd.dev"
+	apiKeyBytes       = 32
+)
+
+// ProvisionResource creates or resizes the backing resource for an instance
+// so that it matches the instance's plan.
+func ProvisionResource(instance account.Instance) error {
+	return nil
+}
+
+// DeprovisionResource tears down the backing resource for an instance.
+func DeprovisionResource(instance account.Instance) error {
+	return nil
+}
+
+// SuspendResource stops the backing resource for an instance without
+// deleting its data.
+func SuspendResource(instance account.Instance) error {
+	return nil
+}
+
+// ResumeResource restarts the backing resource for a suspended instance.
+func ResumeResource(instance account.Instance) error {
 	return nil
 }
+
+// GenerateConfigVars creates the connection details for an instance. Calling
+// it again for the same instance keeps the URL and rotates the API key.
+func GenerateConfigVars(instance account.Instance) (map[string]string, error) {
+	key := make([]byte, apiKeyBytes)
+	_, err := rand.Read(key)
+	if err != nil {
+		return nil, fmt.Errorf("generating api key: %w", err)
+	}
+
+	return map[string]string{
+		ConfigVarURL:    fmt.Sprintf(resourceURLFormat, instance.Id),
+		ConfigVarAPIKey: hex.EncodeToString(key),
+	}, nil
+}
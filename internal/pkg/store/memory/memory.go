@@ -0,0 +1,564 @@
+package memory
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/crypto"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store"
+)
+
+var _ store.Store = &Store{}
+
+// Store is an in-memory store.Store for tests and local development. Nothing
+// is encrypted, the crypto.Util arguments are ignored.
+type Store struct {
+	mu        sync.Mutex
+	accounts  map[string]account.Account
+	instances map[string]account.Instance
+	jobs      map[string]provisioningJob
+	events    map[string]account.StripeEvent
+	deletions []account.InstanceDeletion
+}
+
+type provisioningJob struct {
+	job       account.ProvisioningJob
+	createdAt time.Time
+	updatedAt time.Time
+}
+
+func NewStore() *Store {
+	return &Store{
+		accounts:  map[string]account.Account{},
+		instances: map[string]account.Instance{},
+		jobs:      map[string]provisioningJob{},
+		events:    map[string]account.StripeEvent{},
+	}
+}
+
+func (s *Store) CreateOrUpdateAccount(ctx context.Context, cryptoUtil crypto.Util, a account.Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a.DeprovisionedAt = time.Time{}
+	s.accounts[a.UUID] = a
+	return nil
+}
+
+func (s *Store) UpdateAccountTokens(ctx context.Context, cryptoUtil crypto.Util, a account.Account) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	existing, ok := s.accounts[a.UUID]
+	if !ok || !existing.DeprovisionedAt.IsZero() {
+		return &store.AccountNotFound{}
+	}
+
+	existing.AccessToken = a.AccessToken
+	existing.RefreshToken = a.RefreshToken
+	existing.TokenExpiresAt = a.TokenExpiresAt
+	s.accounts[a.UUID] = existing
+	return nil
+}
+
+func (s *Store) GetAccount(ctx context.Context, cryptoUtil crypto.Util, uuid string) (account.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.accounts[uuid]
+	if !ok {
+		return account.Account{}, &store.AccountNotFound{}
+	}
+
+	return a, nil
+}
+
+func (s *Store) GetAccountFromEmail(ctx context.Context, cryptoUtil crypto.Util, email, accountType string) (account.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range s.sortedAccounts() {
+		if a.Email == email && string(a.AccountType) == accountType && a.DeprovisionedAt.IsZero() {
+			return a, nil
+		}
+	}
+
+	return account.Account{}, &store.AccountNotFound{
+		Email: email,
+	}
+}
+
+func (s *Store) GetAccountFromStripeCustID(ctx context.Context, cryptoUtil crypto.Util, stripeCustID string) (account.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, a := range s.sortedAccounts() {
+		if a.StripeCustID == stripeCustID {
+			return a, nil
+		}
+	}
+
+	return account.Account{}, &store.AccountNotFound{}
+}
+
+func (s *Store) GetAccountsWithExpiringTokens(ctx context.Context, cryptoUtil crypto.Util, before time.Time) ([]account.Account, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var accounts []account.Account
+	for _, a := range s.sortedAccounts() {
+		if a.AccountType != account.AccountTypeHeroku || !a.DeprovisionedAt.IsZero() {
+			continue
+		}
+		if a.TokenExpiresAt.IsZero() || a.TokenExpiresAt.Before(before) {
+			accounts = append(accounts, a)
+		}
+	}
+
+	return accounts, nil
+}
+
+func (s *Store) DeprovisionAccount(ctx context.Context, cryptoUtil crypto.Util, uuid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.accounts[uuid]
+	if !ok {
+		return nil
+	}
+
+	a.AccessToken = ""
+	a.RefreshToken = ""
+	a.TokenExpiresAt = time.Time{}
+	a.DeprovisionedAt = time.Now()
+	s.accounts[uuid] = a
+	return nil
+}
+
+func (s *Store) PurgeDeprovisionedAccounts(ctx context.Context, before time.Time) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var n int64
+	for uuid, a := range s.accounts {
+		if a.DeprovisionedAt.IsZero() || !a.DeprovisionedAt.Before(before) {
+			continue
+		}
+
+		s.deleteInstances(uuid)
+		delete(s.accounts, uuid)
+		n++
+	}
+
+	return n, nil
+}
+
+func (s *Store) DeleteAccout(ctx context.Context, uuid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, i := range s.instances {
+		if i.AccountID == uuid {
+			return fmt.Errorf("account %s still has instances", uuid)
+		}
+	}
+
+	delete(s.accounts, uuid)
+	return nil
+}
+
+func (s *Store) CreateOrUpdateInstance(ctx context.Context, cryptoUtil crypto.Util, instance account.Instance) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.accounts[instance.AccountID]; !ok {
+		return fmt.Errorf("writing instance: account %s does not exist", instance.AccountID)
+	}
+
+	if existing, ok := s.instances[instance.Id]; ok {
+		instance.AccountID = existing.AccountID
+	}
+
+	if instance.Status == "" {
+		instance.Status = account.InstanceStatusActive
+	}
+
+	s.instances[instance.Id] = copyInstance(instance)
+	return nil
+}
+
+func (s *Store) GetInstances(ctx context.Context, cryptoUtil crypto.Util, accountID string) ([]account.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	instances := []account.Instance{}
+	for _, i := range s.instances {
+		if i.AccountID == accountID {
+			instances = append(instances, copyInstance(i))
+		}
+	}
+
+	sort.Slice(instances, func(a, b int) bool {
+		return instances[a].Id < instances[b].Id
+	})
+
+	return instances, nil
+}
+
+func (s *Store) GetInstance(ctx context.Context, cryptoUtil crypto.Util, accountID, id string) (account.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.instances[id]
+	if !ok || i.AccountID != accountID {
+		return account.Instance{}, &store.InstanceNotFound{
+			ID: id,
+		}
+	}
+
+	return copyInstance(i), nil
+}
+
+func (s *Store) GetInstanceFromStripeSubscriptionID(ctx context.Context, cryptoUtil crypto.Util, subscriptionID string) (account.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, i := range s.instances {
+		if i.Subscription != nil && i.Subscription.ID == subscriptionID {
+			return copyInstance(i), nil
+		}
+	}
+
+	return account.Instance{}, &store.InstanceNotFound{}
+}
+
+func (s *Store) GetInstancesWithFailedPayments(ctx context.Context, cryptoUtil crypto.Util, before time.Time) ([]account.Instance, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var instances []account.Instance
+	for _, i := range s.instances {
+		if i.Status != account.InstanceStatusActive || i.PaymentFailedAt.IsZero() {
+			continue
+		}
+		if i.PaymentFailedAt.Before(before) {
+			instances = append(instances, copyInstance(i))
+		}
+	}
+
+	sort.Slice(instances, func(a, b int) bool {
+		return instances[a].Id < instances[b].Id
+	})
+
+	return instances, nil
+}
+
+func (s *Store) UpdateInstanceStatus(ctx context.Context, accountID, id string, status account.InstanceStatus) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.instances[id]
+	if !ok || i.AccountID != accountID {
+		return nil
+	}
+
+	i.Status = status
+	s.instances[id] = i
+	return nil
+}
+
+func (s *Store) UpdateInstancePaymentFailedAt(ctx context.Context, accountID, id string, failedAt time.Time) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.instances[id]
+	if !ok || i.AccountID != accountID {
+		return nil
+	}
+
+	i.PaymentFailedAt = failedAt
+	s.instances[id] = i
+	return nil
+}
+
+func (s *Store) UpdateInstanceSubscription(ctx context.Context, accountID, id string, subscription account.Subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.instances[id]
+	if !ok || i.AccountID != accountID {
+		return nil
+	}
+
+	i.Subscription = nil
+	if subscription.ID != "" {
+		i.Subscription = &subscription
+	}
+	s.instances[id] = i
+	return nil
+}
+
+func (s *Store) UpdateInstancePlan(ctx context.Context, accountID, id, plan string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.instances[id]
+	if !ok || i.AccountID != accountID {
+		return fmt.Errorf("instance %s not found for account %s", id, accountID)
+	}
+
+	i.Plan = plan
+	s.instances[id] = i
+	return nil
+}
+
+func (s *Store) UpdateInstanceConfigVars(ctx context.Context, cryptoUtil crypto.Util, accountID, id string, configVars map[string]string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	i, ok := s.instances[id]
+	if !ok || i.AccountID != accountID {
+		return nil
+	}
+
+	i.ConfigVars = copyConfigVars(configVars)
+	s.instances[id] = i
+	return nil
+}
+
+func (s *Store) DeleteInstance(ctx context.Context, accountid, uuid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if i, ok := s.instances[uuid]; ok && i.AccountID == accountid {
+		delete(s.instances, uuid)
+	}
+
+	return nil
+}
+
+func (s *Store) RecordInstanceDeletion(ctx context.Context, deletion account.InstanceDeletion) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, d := range s.deletions {
+		if d.InstanceID == deletion.InstanceID && d.Outcome == deletion.Outcome {
+			return nil
+		}
+	}
+
+	deletion.DeletedAt = time.Now()
+	s.deletions = append(s.deletions, deletion)
+	return nil
+}
+
+func (s *Store) GetInstanceDeletions(ctx context.Context, outcome string) ([]account.InstanceDeletion, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var deletions []account.InstanceDeletion
+	for _, d := range s.deletions {
+		if d.Outcome == outcome {
+			deletions = append(deletions, d)
+		}
+	}
+
+	return deletions, nil
+}
+
+func (s *Store) DeleteInstances(ctx context.Context, accountid string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.deleteInstances(accountid)
+	return nil
+}
+
+func (s *Store) CreateProvisioningJob(ctx context.Context, cryptoUtil crypto.Util, job account.ProvisioningJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.jobs[job.ResourceUUID]; ok {
+		return nil
+	}
+
+	now := time.Now()
+	job.Attempts = 0
+	job.LastError = ""
+	s.jobs[job.ResourceUUID] = provisioningJob{
+		job:       job,
+		createdAt: now,
+		updatedAt: now,
+	}
+	return nil
+}
+
+func (s *Store) ClaimProvisioningJob(ctx context.Context, cryptoUtil crypto.Util) (account.ProvisioningJob, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	staleBefore := time.Now().Add(-store.StaleProvisioningJobAge)
+	var claimed *provisioningJob
+	for uuid := range s.jobs {
+		j := s.jobs[uuid]
+		claimable := j.job.Status == account.ProvisioningJobStatusPending ||
+			(j.job.Status == account.ProvisioningJobStatusRunning && j.updatedAt.Before(staleBefore))
+		if !claimable {
+			continue
+		}
+		if claimed == nil || j.createdAt.Before(claimed.createdAt) {
+			claimed = &j
+		}
+	}
+
+	if claimed == nil {
+		return account.ProvisioningJob{}, false, nil
+	}
+
+	claimed.job.Status = account.ProvisioningJobStatusRunning
+	claimed.job.Attempts++
+	claimed.updatedAt = time.Now()
+	s.jobs[claimed.job.ResourceUUID] = *claimed
+
+	return claimed.job, true, nil
+}
+
+func (s *Store) UpdateProvisioningJob(ctx context.Context, job account.ProvisioningJob) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	j, ok := s.jobs[job.ResourceUUID]
+	if !ok {
+		return nil
+	}
+
+	j.job.Status = job.Status
+	j.job.LastError = job.LastError
+	j.updatedAt = time.Now()
+	s.jobs[job.ResourceUUID] = j
+	return nil
+}
+
+func (s *Store) ClaimStripeEvent(ctx context.Context, event account.StripeEvent) (account.StripeEvent, bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	e, ok := s.events[event.ID]
+	if !ok {
+		e = account.StripeEvent{
+			ID:         event.ID,
+			Type:       event.Type,
+			Payload:    append([]byte(nil), event.Payload...),
+			ReceivedAt: now,
+		}
+	} else {
+		stale := e.Status == account.StripeEventStatusProcessing && e.ClaimedAt.Before(now.Add(-store.StaleStripeEventAge))
+		if e.Status != account.StripeEventStatusReceived && e.Status != account.StripeEventStatusFailed && !stale {
+			return e, false, nil
+		}
+	}
+
+	e.Status = account.StripeEventStatusProcessing
+	e.ClaimedAt = now
+	s.events[event.ID] = e
+	return e, true, nil
+}
+
+func (s *Store) GetStripeEvent(ctx context.Context, id string) (account.StripeEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.events[id]
+	if !ok {
+		return account.StripeEvent{}, &store.StripeEventNotFound{
+			ID: id,
+		}
+	}
+
+	return e, nil
+}
+
+func (s *Store) GetStripeEventsByStatus(ctx context.Context, status account.StripeEventStatus) ([]account.StripeEvent, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var events []account.StripeEvent
+	for _, e := range s.events {
+		if e.Status == status {
+			events = append(events, e)
+		}
+	}
+
+	sort.Slice(events, func(a, b int) bool {
+		return events[a].ReceivedAt.Before(events[b].ReceivedAt)
+	})
+
+	return events, nil
+}
+
+func (s *Store) UpdateStripeEvent(ctx context.Context, event account.StripeEvent) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	e, ok := s.events[event.ID]
+	if !ok {
+		return nil
+	}
+
+	e.Status = event.Status
+	e.Attempts = event.Attempts
+	e.LastError = event.LastError
+	e.ProcessedAt = event.ProcessedAt
+	s.events[event.ID] = e
+	return nil
+}
+
+func (s *Store) deleteInstances(accountID string) {
+	for id, i := range s.instances {
+		if i.AccountID == accountID {
+			delete(s.instances, id)
+		}
+	}
+}
+
+// sortedAccounts gives lookups that return the first match a stable order.
+func (s *Store) sortedAccounts() []account.Account {
+	accounts := make([]account.Account, 0, len(s.accounts))
+	for _, a := range s.accounts {
+		accounts = append(accounts, a)
+	}
+
+	sort.Slice(accounts, func(i, j int) bool {
+		return accounts[i].UUID < accounts[j].UUID
+	})
+
+	return accounts
+}
+
+// copyInstance copies the parts of an instance that are shared by reference
+// so callers can't modify the stored instance.
+func copyInstance(i account.Instance) account.Instance {
+	i.ConfigVars = copyConfigVars(i.ConfigVars)
+	if i.Subscription != nil {
+		subscription := *i.Subscription
+		i.Subscription = &subscription
+	}
+	return i
+}
+
+func copyConfigVars(configVars map[string]string) map[string]string {
+	if len(configVars) == 0 {
+		return nil
+	}
+
+	c := make(map[string]string, len(configVars))
+	for k, v := range configVars {
+		c[k] = v
+	}
+	return c
+}
@@ -0,0 +1,15 @@
+package memory_test
+
+import (
+	"testing"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store/memory"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store/storetest"
+)
+
+func TestStore(t *testing.T) {
+	storetest.Run(t, func(t *testing.T) store.Store {
+		return memory.NewStore()
+	})
+}
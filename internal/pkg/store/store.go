@@ -0,0 +1,94 @@
+package store
+
+import (
+	"context"
+	"time"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/crypto"
+)
+
+// AccountStore persists accounts. Heroku tokens are encrypted at rest with
+// the given crypto.Util by implementations that store them outside memory.
+type AccountStore interface {
+	// CreateOrUpdateAccount writes the whole account. It also clears a
+	// deprovision, it is only for new and re-provisioned accounts.
+	CreateOrUpdateAccount(ctx context.Context, cryptoUtil crypto.Util, account account.Account) error
+	// UpdateAccountTokens stores refreshed Heroku tokens. It returns
+	// *AccountNotFound, and changes nothing, if the account has been
+	// deprovisioned.
+	UpdateAccountTokens(ctx context.Context, cryptoUtil crypto.Util, account account.Account) error
+	GetAccount(ctx context.Context, cryptoUtil crypto.Util, uuid string) (account.Account, error)
+	GetAccountFromEmail(ctx context.Context, cryptoUtil crypto.Util, email, accountType string) (account.Account, error)
+	GetAccountFromStripeCustID(ctx context.Context, cryptoUtil crypto.Util, stripeCustID string) (account.Account, error)
+	GetAccountsWithExpiringTokens(ctx context.Context, cryptoUtil crypto.Util, before time.Time) ([]account.Account, error)
+	DeprovisionAccount(ctx context.Context, cryptoUtil crypto.Util, uuid string) error
+	PurgeDeprovisionedAccounts(ctx context.Context, before time.Time) (int64, error)
+	DeleteAccout(ctx context.Context, uuid string) error
+}
+
+// InstanceStore persists instances. Config vars are encrypted at rest with
+// the given crypto.Util by implementations that store them outside memory.
+type InstanceStore interface {
+	CreateOrUpdateInstance(ctx context.Context, cryptoUtil crypto.Util, instance account.Instance) error
+	GetInstances(ctx context.Context, cryptoUtil crypto.Util, accountID string) ([]account.Instance, error)
+	GetInstance(ctx context.Context, cryptoUtil crypto.Util, accountID, id string) (account.Instance, error)
+	GetInstanceFromStripeSubscriptionID(ctx context.Context, cryptoUtil crypto.Util, subscriptionID string) (account.Instance, error)
+	GetInstancesWithFailedPayments(ctx context.Context, cryptoUtil crypto.Util, before time.Time) ([]account.Instance, error)
+	UpdateInstancePlan(ctx context.Context, accountID, id, plan string) error
+	UpdateInstanceStatus(ctx context.Context, accountID, id string, status account.InstanceStatus) error
+	UpdateInstancePaymentFailedAt(ctx context.Context, accountID, id string, failedAt time.Time) error
+	UpdateInstanceSubscription(ctx context.Context, accountID, id string, subscription account.Subscription) error
+	UpdateInstanceConfigVars(ctx context.Context, cryptoUtil crypto.Util, accountID, id string, configVars map[string]string) error
+	DeleteInstance(ctx context.Context, accountid, uuid string) error
+	DeleteInstances(ctx context.Context, accountid string) error
+}
+
+// InstanceDeletionStore is the audit log of instances deleted by customers.
+type InstanceDeletionStore interface {
+	// RecordInstanceDeletion records a deletion once per instance and
+	// outcome, deleting an instance that is waiting to be cancelled at the
+	// end of its period again doesn't add another row.
+	RecordInstanceDeletion(ctx context.Context, deletion account.InstanceDeletion) error
+	// GetInstanceDeletions returns the deletions with the given outcome,
+	// oldest first.
+	GetInstanceDeletions(ctx context.Context, outcome string) ([]account.InstanceDeletion, error)
+}
+
+// ProvisioningJobStore persists async Heroku provisioning jobs, one per
+// resource. Creating a job for a resource that already has one leaves the
+// existing job as it is, so that Heroku retrying a request doesn't fail.
+type ProvisioningJobStore interface {
+	CreateProvisioningJob(ctx context.Context, cryptoUtil crypto.Util, job account.ProvisioningJob) error
+	ClaimProvisioningJob(ctx context.Context, cryptoUtil crypto.Util) (account.ProvisioningJob, bool, error)
+	UpdateProvisioningJob(ctx context.Context, job account.ProvisioningJob) error
+}
+
+// StripeEventStore is the ledger of received Stripe webhook events.
+type StripeEventStore interface {
+	// ClaimStripeEvent records the event if it is new and marks it as
+	// processing. The bool is false, and the event is left alone, when it
+	// was already processed or another delivery is processing it. Events left
+	// processing by a worker that died are reclaimed after
+	// StaleStripeEventAge. The ledger's copy of the event is returned.
+	ClaimStripeEvent(ctx context.Context, event account.StripeEvent) (account.StripeEvent, bool, error)
+	GetStripeEvent(ctx context.Context, id string) (account.StripeEvent, error)
+	GetStripeEventsByStatus(ctx context.Context, status account.StripeEventStatus) ([]account.StripeEvent, error)
+	UpdateStripeEvent(ctx context.Context, event account.StripeEvent) error
+}
+
+type Store interface {
+	AccountStore
+	InstanceStore
+	InstanceDeletionStore
+	ProvisioningJobStore
+	StripeEventStore
+}
+
+// StaleStripeEventAge is how long an event can stay processing before
+// ClaimStripeEvent assumes its worker died and hands it out again.
+const StaleStripeEventAge = 10 * time.Minute
+
+// StaleProvisioningJobAge is how long a job can stay running before
+// ClaimProvisioningJob assumes its worker died and hands it out again.
+const StaleProvisioningJobAge = 10 * time.Minute
@@ -0,0 +1,876 @@
+// Package storetest is a conformance suite for store.Store implementations.
+// Every implementation should have a test that calls Run with a constructor
+// returning an empty store.
+package storetest
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/crypto"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store"
+	"github.com/google/uuid"
+)
+
+const testEncryptionKey = "0123456789abcdef0123456789abcdef"
+
+var ctx = context.Background()
+
+// Run runs the conformance suite. newStore is called once per subtest and
+// must return a store with no data in it.
+func Run(t *testing.T, newStore func(t *testing.T) store.Store) {
+	cryptoUtil, err := crypto.NewUtil(testEncryptionKey)
+	if err != nil {
+		t.Fatalf("creating crypto util: %s", err)
+	}
+
+	tests := []struct {
+		name string
+		fn   func(t *testing.T, s store.Store, cryptoUtil crypto.Util)
+	}{
+		{"CreateAndGetAccount", testCreateAndGetAccount},
+		{"UpdateAccount", testUpdateAccount},
+		{"UpdateAccountTokens", testUpdateAccountTokens},
+		{"UpdateAccountTokensAfterDeprovision", testUpdateAccountTokensAfterDeprovision},
+		{"AccountNotFound", testAccountNotFound},
+		{"GetAccountFromEmail", testGetAccountFromEmail},
+		{"GetAccountFromStripeCustID", testGetAccountFromStripeCustID},
+		{"GetAccountsWithExpiringTokens", testGetAccountsWithExpiringTokens},
+		{"DeprovisionAndPurgeAccount", testDeprovisionAndPurgeAccount},
+		{"CreateAndGetInstances", testCreateAndGetInstances},
+		{"InstanceRequiresAccount", testInstanceRequiresAccount},
+		{"UpdateInstance", testUpdateInstance},
+		{"DeleteInstance", testDeleteInstance},
+		{"InstanceSubscriptions", testInstanceSubscriptions},
+		{"InstanceDeletions", testInstanceDeletions},
+		{"ProvisioningJobs", testProvisioningJobs},
+		{"StripeEvents", testStripeEvents},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newStore(t), cryptoUtil)
+		})
+	}
+}
+
+func newHerokuAccount() account.Account {
+	id := uuid.New().String()
+	return account.Account{
+		UUID:           id,
+		Email:          id + "@example.com",
+		Name:           "heroku-app",
+		AccountType:    account.AccountTypeHeroku,
+		AccessToken:    "access-" + id,
+		RefreshToken:   "refresh-" + id,
+		TokenExpiresAt: time.Now().Add(8 * time.Hour).Truncate(time.Second),
+	}
+}
+
+func newGithubAccount() account.Account {
+	id := uuid.New().String()
+	return account.Account{
+		UUID:         id,
+		Email:        id + "@example.com",
+		Name:         "Github User",
+		AccountType:  account.AccountTypeGithub,
+		StripeCustID: "cus_" + id,
+	}
+}
+
+func mustCreateAccount(t *testing.T, s store.Store, cryptoUtil crypto.Util, a account.Account) {
+	t.Helper()
+	err := s.CreateOrUpdateAccount(ctx, cryptoUtil, a)
+	if err != nil {
+		t.Fatalf("creating account: %s", err)
+	}
+}
+
+func assertAccount(t *testing.T, got, want account.Account) {
+	t.Helper()
+	if got.UUID != want.UUID || got.Email != want.Email || got.Name != want.Name ||
+		got.AccountType != want.AccountType || got.AccessToken != want.AccessToken ||
+		got.RefreshToken != want.RefreshToken || got.StripeCustID != want.StripeCustID ||
+		!got.TokenExpiresAt.Equal(want.TokenExpiresAt) {
+		t.Fatalf("got account %+v, want %+v", got, want)
+	}
+}
+
+func assertAccountNotFound(t *testing.T, err error) {
+	t.Helper()
+	var notFoundErr *store.AccountNotFound
+	if !errors.As(err, &notFoundErr) {
+		t.Fatalf("got error %v, want *store.AccountNotFound", err)
+	}
+}
+
+func testCreateAndGetAccount(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	a := newHerokuAccount()
+	mustCreateAccount(t, s, cryptoUtil, a)
+
+	got, err := s.GetAccount(ctx, cryptoUtil, a.UUID)
+	if err != nil {
+		t.Fatalf("getting account: %s", err)
+	}
+	assertAccount(t, got, a)
+
+	if !got.DeprovisionedAt.IsZero() {
+		t.Fatalf("new account should not be deprovisioned, got %s", got.DeprovisionedAt)
+	}
+}
+
+func testUpdateAccount(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	a := newHerokuAccount()
+	mustCreateAccount(t, s, cryptoUtil, a)
+
+	a.AccessToken = "rotated"
+	a.RefreshToken = "rotated-refresh"
+	a.TokenExpiresAt = a.TokenExpiresAt.Add(time.Hour)
+	mustCreateAccount(t, s, cryptoUtil, a)
+
+	got, err := s.GetAccount(ctx, cryptoUtil, a.UUID)
+	if err != nil {
+		t.Fatalf("getting account: %s", err)
+	}
+	assertAccount(t, got, a)
+}
+
+func testUpdateAccountTokens(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	a := newHerokuAccount()
+	mustCreateAccount(t, s, cryptoUtil, a)
+
+	a.AccessToken = "refreshed"
+	a.RefreshToken = "refreshed-refresh"
+	a.TokenExpiresAt = a.TokenExpiresAt.Add(time.Hour)
+	err := s.UpdateAccountTokens(ctx, cryptoUtil, a)
+	if err != nil {
+		t.Fatalf("updating account tokens: %s", err)
+	}
+
+	got, err := s.GetAccount(ctx, cryptoUtil, a.UUID)
+	if err != nil {
+		t.Fatalf("getting account: %s", err)
+	}
+	assertAccount(t, got, a)
+
+	err = s.UpdateAccountTokens(ctx, cryptoUtil, newHerokuAccount())
+	assertAccountNotFound(t, err)
+}
+
+// A token refresh that finishes after the account was deprovisioned must not
+// bring the account or its tokens back.
+func testUpdateAccountTokensAfterDeprovision(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	a := newHerokuAccount()
+	mustCreateAccount(t, s, cryptoUtil, a)
+
+	err := s.DeprovisionAccount(ctx, cryptoUtil, a.UUID)
+	if err != nil {
+		t.Fatalf("deprovisioning account: %s", err)
+	}
+
+	a.AccessToken = "refreshed"
+	a.RefreshToken = "refreshed-refresh"
+	a.TokenExpiresAt = a.TokenExpiresAt.Add(time.Hour)
+	err = s.UpdateAccountTokens(ctx, cryptoUtil, a)
+	assertAccountNotFound(t, err)
+
+	got, err := s.GetAccount(ctx, cryptoUtil, a.UUID)
+	if err != nil {
+		t.Fatalf("getting account: %s", err)
+	}
+	if got.DeprovisionedAt.IsZero() {
+		t.Fatalf("account should still be deprovisioned")
+	}
+	if got.AccessToken != "" || got.RefreshToken != "" {
+		t.Fatalf("deprovisioned account should have no tokens, got %q and %q", got.AccessToken, got.RefreshToken)
+	}
+
+	accounts, err := s.GetAccountsWithExpiringTokens(ctx, cryptoUtil, time.Now().Add(24*time.Hour))
+	if err != nil {
+		t.Fatalf("getting accounts with expiring tokens: %s", err)
+	}
+	for _, e := range accounts {
+		if e.UUID == a.UUID {
+			t.Fatalf("deprovisioned account %s should not be refreshed", a.UUID)
+		}
+	}
+}
+
+func testAccountNotFound(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	_, err := s.GetAccount(ctx, cryptoUtil, uuid.New().String())
+	assertAccountNotFound(t, err)
+
+	_, err = s.GetAccountFromEmail(ctx, cryptoUtil, "nobody@example.com", string(account.AccountTypeGithub))
+	assertAccountNotFound(t, err)
+
+	_, err = s.GetAccountFromStripeCustID(ctx, cryptoUtil, "cus_missing")
+	assertAccountNotFound(t, err)
+}
+
+func testGetAccountFromEmail(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	a := newGithubAccount()
+	mustCreateAccount(t, s, cryptoUtil, a)
+
+	got, err := s.GetAccountFromEmail(ctx, cryptoUtil, a.Email, string(account.AccountTypeGithub))
+	if err != nil {
+		t.Fatalf("getting account from email: %s", err)
+	}
+	assertAccount(t, got, a)
+
+	_, err = s.GetAccountFromEmail(ctx, cryptoUtil, a.Email, string(account.AccountTypeHeroku))
+	assertAccountNotFound(t, err)
+}
+
+func testGetAccountFromStripeCustID(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	a := newGithubAccount()
+	mustCreateAccount(t, s, cryptoUtil, a)
+
+	got, err := s.GetAccountFromStripeCustID(ctx, cryptoUtil, a.StripeCustID)
+	if err != nil {
+		t.Fatalf("getting account from stripe customer id: %s", err)
+	}
+	assertAccount(t, got, a)
+}
+
+func testGetAccountsWithExpiringTokens(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	expiring := newHerokuAccount()
+	expiring.TokenExpiresAt = time.Now().Add(time.Minute).Truncate(time.Second)
+	mustCreateAccount(t, s, cryptoUtil, expiring)
+
+	fresh := newHerokuAccount()
+	mustCreateAccount(t, s, cryptoUtil, fresh)
+
+	// accounts created before token expiry was recorded have no expiry
+	unknown := newHerokuAccount()
+	unknown.TokenExpiresAt = time.Time{}
+	mustCreateAccount(t, s, cryptoUtil, unknown)
+
+	deprovisioned := newHerokuAccount()
+	mustCreateAccount(t, s, cryptoUtil, deprovisioned)
+	err := s.DeprovisionAccount(ctx, cryptoUtil, deprovisioned.UUID)
+	if err != nil {
+		t.Fatalf("deprovisioning account: %s", err)
+	}
+
+	github := newGithubAccount()
+	mustCreateAccount(t, s, cryptoUtil, github)
+
+	accounts, err := s.GetAccountsWithExpiringTokens(ctx, cryptoUtil, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("getting accounts with expiring tokens: %s", err)
+	}
+
+	got := map[string]account.Account{}
+	for _, a := range accounts {
+		got[a.UUID] = a
+	}
+	if len(accounts) != 2 || len(got) != 2 {
+		t.Fatalf("got %d accounts with expiring tokens, want 2", len(accounts))
+	}
+	assertAccount(t, got[expiring.UUID], expiring)
+	assertAccount(t, got[unknown.UUID], unknown)
+}
+
+func testDeprovisionAndPurgeAccount(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	a := newHerokuAccount()
+	mustCreateAccount(t, s, cryptoUtil, a)
+
+	i := account.Instance{AccountID: a.UUID, Id: uuid.New().String(), Plan: "free", Name: "kept"}
+	err := s.CreateOrUpdateInstance(ctx, cryptoUtil, i)
+	if err != nil {
+		t.Fatalf("creating instance: %s", err)
+	}
+
+	err = s.DeprovisionAccount(ctx, cryptoUtil, a.UUID)
+	if err != nil {
+		t.Fatalf("deprovisioning account: %s", err)
+	}
+
+	got, err := s.GetAccount(ctx, cryptoUtil, a.UUID)
+	if err != nil {
+		t.Fatalf("getting deprovisioned account: %s", err)
+	}
+	if got.DeprovisionedAt.IsZero() {
+		t.Fatalf("account should be marked as deprovisioned")
+	}
+	if got.AccessToken != "" || got.RefreshToken != "" || !got.TokenExpiresAt.IsZero() {
+		t.Fatalf("deprovisioned account should not have tokens, got %+v", got)
+	}
+
+	_, err = s.GetAccountFromEmail(ctx, cryptoUtil, a.Email, string(account.AccountTypeHeroku))
+	assertAccountNotFound(t, err)
+
+	n, err := s.PurgeDeprovisionedAccounts(ctx, time.Now().Add(-time.Hour))
+	if err != nil {
+		t.Fatalf("purging accounts: %s", err)
+	}
+	if n != 0 {
+		t.Fatalf("purged %d accounts inside the retention period, want 0", n)
+	}
+
+	n, err = s.PurgeDeprovisionedAccounts(ctx, time.Now().Add(time.Hour))
+	if err != nil {
+		t.Fatalf("purging accounts: %s", err)
+	}
+	if n != 1 {
+		t.Fatalf("purged %d accounts, want 1", n)
+	}
+
+	_, err = s.GetAccount(ctx, cryptoUtil, a.UUID)
+	assertAccountNotFound(t, err)
+
+	instances, err := s.GetInstances(ctx, cryptoUtil, a.UUID)
+	if err != nil {
+		t.Fatalf("getting instances: %s", err)
+	}
+	if len(instances) != 0 {
+		t.Fatalf("got %d instances for purged account, want 0", len(instances))
+	}
+}
+
+func testCreateAndGetInstances(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	a := newGithubAccount()
+	mustCreateAccount(t, s, cryptoUtil, a)
+
+	instances, err := s.GetInstances(ctx, cryptoUtil, a.UUID)
+	if err != nil {
+		t.Fatalf("getting instances: %s", err)
+	}
+	if instances == nil || len(instances) != 0 {
+		t.Fatalf("got %#v for account without instances, want an empty slice", instances)
+	}
+
+	want := map[string]account.Instance{}
+	for _, name := range []string{"one", "two"} {
+		i := account.Instance{
+			AccountID: a.UUID,
+			Id:        uuid.New().String(),
+			Plan:      "staging",
+			Name:      name,
+			ConfigVars: map[string]string{
+				"ALLOYD_URL": "https://" + name,
+			},
+		}
+		err := s.CreateOrUpdateInstance(ctx, cryptoUtil, i)
+		if err != nil {
+			t.Fatalf("creating instance: %s", err)
+		}
+		want[i.Id] = i
+	}
+
+	instances, err = s.GetInstances(ctx, cryptoUtil, a.UUID)
+	if err != nil {
+		t.Fatalf("getting instances: %s", err)
+	}
+	if len(instances) != len(want) {
+		t.Fatalf("got %d instances, want %d", len(instances), len(want))
+	}
+
+	for _, got := range instances {
+		assertInstance(t, got, want[got.Id])
+
+		single, err := s.GetInstance(ctx, cryptoUtil, a.UUID, got.Id)
+		if err != nil {
+			t.Fatalf("getting instance: %s", err)
+		}
+		assertInstance(t, single, want[got.Id])
+	}
+
+	_, err = s.GetInstance(ctx, cryptoUtil, uuid.New().String(), instances[0].Id)
+	var notFoundErr *store.InstanceNotFound
+	if !errors.As(err, &notFoundErr) {
+		t.Fatalf("getting instance for another account: got error %v, want *store.InstanceNotFound", err)
+	}
+}
+
+func testInstanceRequiresAccount(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	i := account.Instance{AccountID: uuid.New().String(), Id: uuid.New().String(), Plan: "free", Name: "orphan"}
+	err := s.CreateOrUpdateInstance(ctx, cryptoUtil, i)
+	if err == nil {
+		t.Fatalf("creating an instance for a missing account should fail")
+	}
+}
+
+func testUpdateInstance(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	a := newHerokuAccount()
+	mustCreateAccount(t, s, cryptoUtil, a)
+
+	i := account.Instance{AccountID: a.UUID, Id: uuid.New().String(), Plan: "free", Name: "instance"}
+	err := s.CreateOrUpdateInstance(ctx, cryptoUtil, i)
+	if err != nil {
+		t.Fatalf("creating instance: %s", err)
+	}
+
+	err = s.UpdateInstancePlan(ctx, a.UUID, i.Id, "production")
+	if err != nil {
+		t.Fatalf("updating plan: %s", err)
+	}
+	i.Plan = "production"
+
+	err = s.UpdateInstancePlan(ctx, a.UUID, uuid.New().String(), "production")
+	if err == nil {
+		t.Fatalf("updating the plan of a missing instance should fail")
+	}
+
+	i.ConfigVars = map[string]string{"ALLOYD_API_KEY": "rotated"}
+	err = s.UpdateInstanceConfigVars(ctx, cryptoUtil, a.UUID, i.Id, i.ConfigVars)
+	if err != nil {
+		t.Fatalf("updating config vars: %s", err)
+	}
+
+	got, err := s.GetInstance(ctx, cryptoUtil, a.UUID, i.Id)
+	if err != nil {
+		t.Fatalf("getting instance: %s", err)
+	}
+	assertInstance(t, got, i)
+
+	i.Name = "renamed"
+	err = s.CreateOrUpdateInstance(ctx, cryptoUtil, i)
+	if err != nil {
+		t.Fatalf("updating instance: %s", err)
+	}
+
+	got, err = s.GetInstance(ctx, cryptoUtil, a.UUID, i.Id)
+	if err != nil {
+		t.Fatalf("getting instance: %s", err)
+	}
+	assertInstance(t, got, i)
+}
+
+func testDeleteInstance(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	a := newGithubAccount()
+	mustCreateAccount(t, s, cryptoUtil, a)
+
+	var ids []string
+	for n := 0; n < 3; n++ {
+		i := account.Instance{AccountID: a.UUID, Id: uuid.New().String(), Plan: "free", Name: "instance"}
+		err := s.CreateOrUpdateInstance(ctx, cryptoUtil, i)
+		if err != nil {
+			t.Fatalf("creating instance: %s", err)
+		}
+		ids = append(ids, i.Id)
+	}
+
+	err := s.DeleteInstance(ctx, uuid.New().String(), ids[0])
+	if err != nil {
+		t.Fatalf("deleting instance with the wrong account: %s", err)
+	}
+	assertInstanceCount(t, s, cryptoUtil, a.UUID, 3)
+
+	err = s.DeleteInstance(ctx, a.UUID, ids[0])
+	if err != nil {
+		t.Fatalf("deleting instance: %s", err)
+	}
+	assertInstanceCount(t, s, cryptoUtil, a.UUID, 2)
+
+	err = s.DeleteAccout(ctx, a.UUID)
+	if err == nil {
+		t.Fatalf("deleting an account that still has instances should fail")
+	}
+
+	err = s.DeleteInstances(ctx, a.UUID)
+	if err != nil {
+		t.Fatalf("deleting instances: %s", err)
+	}
+	assertInstanceCount(t, s, cryptoUtil, a.UUID, 0)
+
+	err = s.DeleteAccout(ctx, a.UUID)
+	if err != nil {
+		t.Fatalf("deleting account: %s", err)
+	}
+	_, err = s.GetAccount(ctx, cryptoUtil, a.UUID)
+	assertAccountNotFound(t, err)
+}
+
+func testInstanceSubscriptions(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	a := newGithubAccount()
+	mustCreateAccount(t, s, cryptoUtil, a)
+
+	i := account.Instance{
+		AccountID: a.UUID,
+		Id:        uuid.New().String(),
+		Plan:      "staging",
+		Name:      "subscribed",
+		Subscription: &account.Subscription{
+			ID:               "sub_" + a.UUID,
+			PriceID:          "price_staging",
+			Status:           "incomplete",
+			CurrentPeriodEnd: time.Now().Add(30 * 24 * time.Hour).Truncate(time.Second),
+		},
+	}
+	err := s.CreateOrUpdateInstance(ctx, cryptoUtil, i)
+	if err != nil {
+		t.Fatalf("creating instance: %s", err)
+	}
+
+	free := account.Instance{AccountID: a.UUID, Id: uuid.New().String(), Plan: "free", Name: "free"}
+	err = s.CreateOrUpdateInstance(ctx, cryptoUtil, free)
+	if err != nil {
+		t.Fatalf("creating instance: %s", err)
+	}
+
+	got, err := s.GetInstanceFromStripeSubscriptionID(ctx, cryptoUtil, i.Subscription.ID)
+	if err != nil {
+		t.Fatalf("getting instance from subscription: %s", err)
+	}
+	assertInstance(t, got, i)
+
+	i.Subscription.Status = "active"
+	i.Subscription.CancelAtPeriodEnd = true
+	i.Subscription.CurrentPeriodEnd = i.Subscription.CurrentPeriodEnd.Add(30 * 24 * time.Hour)
+	err = s.UpdateInstanceSubscription(ctx, a.UUID, i.Id, *i.Subscription)
+	if err != nil {
+		t.Fatalf("updating subscription: %s", err)
+	}
+
+	got, err = s.GetInstance(ctx, cryptoUtil, a.UUID, i.Id)
+	if err != nil {
+		t.Fatalf("getting instance: %s", err)
+	}
+	assertInstance(t, got, i)
+
+	err = s.UpdateInstanceSubscription(ctx, a.UUID, free.Id, account.Subscription{ID: "sub_" + free.Id, Status: "incomplete"})
+	if err != nil {
+		t.Fatalf("linking subscription: %s", err)
+	}
+
+	err = s.UpdateInstanceSubscription(ctx, a.UUID, free.Id, account.Subscription{})
+	if err != nil {
+		t.Fatalf("unlinking subscription: %s", err)
+	}
+
+	got, err = s.GetInstance(ctx, cryptoUtil, a.UUID, free.Id)
+	if err != nil {
+		t.Fatalf("getting instance: %s", err)
+	}
+	assertInstance(t, got, free)
+
+	_, err = s.GetInstanceFromStripeSubscriptionID(ctx, cryptoUtil, "sub_missing")
+	var notFoundErr *store.InstanceNotFound
+	if !errors.As(err, &notFoundErr) {
+		t.Fatalf("getting instance for a missing subscription: got error %v, want *store.InstanceNotFound", err)
+	}
+
+	failedAt := time.Now().Add(-time.Hour).Truncate(time.Second)
+	err = s.UpdateInstancePaymentFailedAt(ctx, a.UUID, i.Id, failedAt)
+	if err != nil {
+		t.Fatalf("updating payment failure: %s", err)
+	}
+	i.PaymentFailedAt = failedAt
+
+	failed, err := s.GetInstancesWithFailedPayments(ctx, cryptoUtil, time.Now().Add(-2*time.Hour))
+	if err != nil {
+		t.Fatalf("getting instances with failed payments: %s", err)
+	}
+	if len(failed) != 0 {
+		t.Fatalf("got %d instances inside the grace period, want 0", len(failed))
+	}
+
+	failed, err = s.GetInstancesWithFailedPayments(ctx, cryptoUtil, time.Now())
+	if err != nil {
+		t.Fatalf("getting instances with failed payments: %s", err)
+	}
+	if len(failed) != 1 {
+		t.Fatalf("got %d instances with failed payments, want 1", len(failed))
+	}
+	assertInstance(t, failed[0], i)
+
+	err = s.UpdateInstanceStatus(ctx, a.UUID, i.Id, account.InstanceStatusSuspended)
+	if err != nil {
+		t.Fatalf("suspending instance: %s", err)
+	}
+	i.Status = account.InstanceStatusSuspended
+
+	failed, err = s.GetInstancesWithFailedPayments(ctx, cryptoUtil, time.Now())
+	if err != nil {
+		t.Fatalf("getting instances with failed payments: %s", err)
+	}
+	if len(failed) != 0 {
+		t.Fatalf("got %d suspended instances with failed payments, want 0", len(failed))
+	}
+
+	err = s.UpdateInstancePaymentFailedAt(ctx, a.UUID, i.Id, time.Time{})
+	if err != nil {
+		t.Fatalf("clearing payment failure: %s", err)
+	}
+	i.PaymentFailedAt = time.Time{}
+
+	got, err = s.GetInstance(ctx, cryptoUtil, a.UUID, i.Id)
+	if err != nil {
+		t.Fatalf("getting instance: %s", err)
+	}
+	assertInstance(t, got, i)
+}
+
+func testInstanceDeletions(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	failed := account.InstanceDeletion{
+		AccountID:      uuid.New().String(),
+		InstanceID:     uuid.New().String(),
+		SubscriptionID: "sub_" + uuid.New().String(),
+		Outcome:        "failed",
+		Error:          "stripe is down",
+	}
+	cancelled := account.InstanceDeletion{
+		AccountID:      failed.AccountID,
+		InstanceID:     uuid.New().String(),
+		SubscriptionID: "sub_" + uuid.New().String(),
+		Outcome:        "cancelled",
+	}
+
+	atPeriodEnd := account.InstanceDeletion{
+		AccountID:      failed.AccountID,
+		InstanceID:     uuid.New().String(),
+		SubscriptionID: "sub_" + uuid.New().String(),
+		Outcome:        "cancel_at_period_end",
+	}
+
+	// the instance waiting for the end of its period is deleted twice
+	for _, d := range []account.InstanceDeletion{failed, cancelled, atPeriodEnd, atPeriodEnd} {
+		err := s.RecordInstanceDeletion(ctx, d)
+		if err != nil {
+			t.Fatalf("recording instance deletion: %s", err)
+		}
+	}
+
+	got, err := s.GetInstanceDeletions(ctx, "cancel_at_period_end")
+	if err != nil {
+		t.Fatalf("getting cancel at period end instance deletions: %s", err)
+	}
+	if len(got) != 1 || got[0].InstanceID != atPeriodEnd.InstanceID {
+		t.Fatalf("got cancel at period end instance deletions %+v, want 1 for %s", got, atPeriodEnd.InstanceID)
+	}
+
+	got, err = s.GetInstanceDeletions(ctx, "failed")
+	if err != nil {
+		t.Fatalf("getting failed instance deletions: %s", err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("got %d failed instance deletions, want 1", len(got))
+	}
+	if got[0].AccountID != failed.AccountID || got[0].InstanceID != failed.InstanceID || got[0].SubscriptionID != failed.SubscriptionID ||
+		got[0].Error != failed.Error || got[0].DeletedAt.IsZero() {
+		t.Fatalf("got instance deletion %+v, want %+v", got[0], failed)
+	}
+}
+
+func testProvisioningJobs(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	_, ok, err := s.ClaimProvisioningJob(ctx, cryptoUtil)
+	if err != nil {
+		t.Fatalf("claiming from empty store: %s", err)
+	}
+	if ok {
+		t.Fatalf("claimed a job from an empty store")
+	}
+
+	job := account.ProvisioningJob{
+		ResourceUUID: uuid.New().String(),
+		Plan:         "staging",
+		Region:       "amazon-web-services::us-east-1",
+		OauthCode:    "grant-code",
+		Status:       account.ProvisioningJobStatusPending,
+	}
+	err = s.CreateProvisioningJob(ctx, cryptoUtil, job)
+	if err != nil {
+		t.Fatalf("creating job: %s", err)
+	}
+
+	duplicate := job
+	duplicate.OauthCode = "another-grant-code"
+	err = s.CreateProvisioningJob(ctx, cryptoUtil, duplicate)
+	if err != nil {
+		t.Fatalf("creating a duplicate job: %s", err)
+	}
+
+	claimed, ok, err := s.ClaimProvisioningJob(ctx, cryptoUtil)
+	if err != nil || !ok {
+		t.Fatalf("claiming job: ok %t, err %v", ok, err)
+	}
+	if claimed.ResourceUUID != job.ResourceUUID || claimed.OauthCode != job.OauthCode || claimed.Plan != job.Plan || claimed.Region != job.Region {
+		t.Fatalf("claimed %+v, want %+v", claimed, job)
+	}
+	if claimed.Status != account.ProvisioningJobStatusRunning || claimed.Attempts != 1 {
+		t.Fatalf("claimed job has status %s and %d attempts, want running and 1", claimed.Status, claimed.Attempts)
+	}
+
+	_, ok, err = s.ClaimProvisioningJob(ctx, cryptoUtil)
+	if err != nil {
+		t.Fatalf("claiming running job: %s", err)
+	}
+	if ok {
+		t.Fatalf("a running job should not be claimed twice")
+	}
+
+	claimed.Status = account.ProvisioningJobStatusPending
+	claimed.LastError = "heroku is down"
+	err = s.UpdateProvisioningJob(ctx, claimed)
+	if err != nil {
+		t.Fatalf("updating job: %s", err)
+	}
+
+	retried, ok, err := s.ClaimProvisioningJob(ctx, cryptoUtil)
+	if err != nil || !ok {
+		t.Fatalf("claiming retried job: ok %t, err %v", ok, err)
+	}
+	if retried.Attempts != 2 || retried.LastError != "heroku is down" {
+		t.Fatalf("retried job has %d attempts and error %q, want 2 and the previous error", retried.Attempts, retried.LastError)
+	}
+
+	retried.Status = account.ProvisioningJobStatusComplete
+	err = s.UpdateProvisioningJob(ctx, retried)
+	if err != nil {
+		t.Fatalf("completing job: %s", err)
+	}
+
+	_, ok, err = s.ClaimProvisioningJob(ctx, cryptoUtil)
+	if err != nil {
+		t.Fatalf("claiming after completion: %s", err)
+	}
+	if ok {
+		t.Fatalf("a complete job should not be claimed")
+	}
+}
+
+func testStripeEvents(t *testing.T, s store.Store, cryptoUtil crypto.Util) {
+	_, err := s.GetStripeEvent(ctx, "evt_missing")
+	var notFoundErr *store.StripeEventNotFound
+	if !errors.As(err, &notFoundErr) {
+		t.Fatalf("getting missing event: got error %v, want *store.StripeEventNotFound", err)
+	}
+
+	event := account.StripeEvent{
+		ID:      "evt_" + uuid.New().String(),
+		Type:    "invoice.paid",
+		Payload: []byte(`{"type":"invoice.paid"}`),
+	}
+	claimed, ok, err := s.ClaimStripeEvent(ctx, event)
+	if err != nil || !ok {
+		t.Fatalf("claiming new event: ok %t, err %v", ok, err)
+	}
+	if claimed.Status != account.StripeEventStatusProcessing || claimed.ClaimedAt.IsZero() {
+		t.Fatalf("claimed event %+v, want it processing", claimed)
+	}
+
+	_, ok, err = s.ClaimStripeEvent(ctx, event)
+	if err != nil {
+		t.Fatalf("claiming event being processed: %s", err)
+	}
+	if ok {
+		t.Fatalf("an event being processed should not be claimed twice")
+	}
+
+	got, err := s.GetStripeEvent(ctx, event.ID)
+	if err != nil {
+		t.Fatalf("getting event: %s", err)
+	}
+	if got.Type != event.Type || got.Status != account.StripeEventStatusProcessing || string(got.Payload) != string(event.Payload) {
+		t.Fatalf("got event %+v, want %+v", got, event)
+	}
+	if got.ReceivedAt.IsZero() || !got.ProcessedAt.IsZero() {
+		t.Fatalf("new event should have a receive time and no processed time, got %+v", got)
+	}
+
+	got.Status = account.StripeEventStatusFailed
+	got.Attempts = 1
+	got.LastError = "instance not found"
+	err = s.UpdateStripeEvent(ctx, got)
+	if err != nil {
+		t.Fatalf("updating event: %s", err)
+	}
+
+	failed, err := s.GetStripeEventsByStatus(ctx, account.StripeEventStatusFailed)
+	if err != nil {
+		t.Fatalf("getting failed events: %s", err)
+	}
+	if len(failed) != 1 || failed[0].ID != event.ID || failed[0].Attempts != 1 || failed[0].LastError != "instance not found" {
+		t.Fatalf("got failed events %+v, want the updated event", failed)
+	}
+
+	retried, ok, err := s.ClaimStripeEvent(ctx, event)
+	if err != nil || !ok {
+		t.Fatalf("claiming failed event: ok %t, err %v", ok, err)
+	}
+	if retried.Status != account.StripeEventStatusProcessing || retried.Attempts != 1 {
+		t.Fatalf("claimed failed event %+v, want it processing with its attempts kept", retried)
+	}
+
+	got.Status = account.StripeEventStatusProcessed
+	got.Attempts = 2
+	got.LastError = ""
+	got.ProcessedAt = time.Now()
+	err = s.UpdateStripeEvent(ctx, got)
+	if err != nil {
+		t.Fatalf("updating event: %s", err)
+	}
+
+	failed, err = s.GetStripeEventsByStatus(ctx, account.StripeEventStatusFailed)
+	if err != nil {
+		t.Fatalf("getting failed events: %s", err)
+	}
+	if len(failed) != 0 {
+		t.Fatalf("got %d failed events after processing, want 0", len(failed))
+	}
+
+	got, err = s.GetStripeEvent(ctx, event.ID)
+	if err != nil {
+		t.Fatalf("getting event: %s", err)
+	}
+	if got.Status != account.StripeEventStatusProcessed || got.ProcessedAt.IsZero() {
+		t.Fatalf("got event %+v, want it processed", got)
+	}
+
+	got, ok, err = s.ClaimStripeEvent(ctx, event)
+	if err != nil {
+		t.Fatalf("claiming processed event: %s", err)
+	}
+	if ok || got.Status != account.StripeEventStatusProcessed {
+		t.Fatalf("claimed processed event: ok %t, got %+v", ok, got)
+	}
+}
+
+func assertInstance(t *testing.T, got, want account.Instance) {
+	t.Helper()
+	wantStatus := want.Status
+	if wantStatus == "" {
+		wantStatus = account.InstanceStatusActive
+	}
+
+	if got.Id != want.Id || got.AccountID != want.AccountID || got.Plan != want.Plan || got.Name != want.Name ||
+		got.Status != wantStatus || !got.PaymentFailedAt.Equal(want.PaymentFailedAt) {
+		t.Fatalf("got instance %+v, want %+v", got, want)
+	}
+
+	if (got.Subscription == nil) != (want.Subscription == nil) {
+		t.Fatalf("got subscription %+v, want %+v", got.Subscription, want.Subscription)
+	}
+	if want.Subscription != nil {
+		if got.Subscription.ID != want.Subscription.ID || got.Subscription.PriceID != want.Subscription.PriceID ||
+			got.Subscription.Status != want.Subscription.Status || got.Subscription.CancelAtPeriodEnd != want.Subscription.CancelAtPeriodEnd ||
+			!got.Subscription.CurrentPeriodEnd.Equal(want.Subscription.CurrentPeriodEnd) {
+			t.Fatalf("got subscription %+v, want %+v", got.Subscription, want.Subscription)
+		}
+	}
+
+	if len(got.ConfigVars) != len(want.ConfigVars) {
+		t.Fatalf("got config vars %v, want %v", got.ConfigVars, want.ConfigVars)
+	}
+	for k, v := range want.ConfigVars {
+		if got.ConfigVars[k] != v {
+			t.Fatalf("got config vars %v, want %v", got.ConfigVars, want.ConfigVars)
+		}
+	}
+}
+
+func assertInstanceCount(t *testing.T, s store.Store, cryptoUtil crypto.Util, accountID string, want int) {
+	t.Helper()
+	instances, err := s.GetInstances(ctx, cryptoUtil, accountID)
+	if err != nil {
+		t.Fatalf("getting instances: %s", err)
+	}
+	if len(instances) != want {
+		t.Fatalf("got %d instances, want %d", len(instances), want)
+	}
+}
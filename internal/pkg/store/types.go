@@ -0,0 +1,28 @@
+package store
+
+import "fmt"
+
+// TODO: support email and stripecustid. Or an arbitrary field?
+type AccountNotFound struct {
+	Email string
+}
+
+func (m *AccountNotFound) Error() string {
+	return fmt.Sprintf("account not found")
+}
+
+type InstanceNotFound struct {
+	ID string
+}
+
+func (m *InstanceNotFound) Error() string {
+	return fmt.Sprintf("instance %s not found", m.ID)
+}
+
+type StripeEventNotFound struct {
+	ID string
+}
+
+func (m *StripeEventNotFound) Error() string {
+	return fmt.Sprintf("stripe event %s not found", m.ID)
+}
@@ -0,0 +1,174 @@
+package tokenmanager
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/crypto"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/heroku"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store"
+	"go.uber.org/zap"
+)
+
+const (
+	// refreshMargin is how long before expiry a token is refreshed.
+	refreshMargin = 10 * time.Minute
+	checkInterval = time.Minute
+)
+
+// Manager keeps the Heroku OAuth tokens stored in the account table fresh.
+type Manager struct {
+	logger       *zap.SugaredLogger
+	cryptoUtil   crypto.Util
+	store        store.AccountStore
+	herokuClient heroku.HerokuClient
+	// locks serializes refreshes of an account's token so that it is not
+	// refreshed twice concurrently by Run and TokenFor. Other accounts are
+	// not held up while a refresh is in flight.
+	locks *accountLocks
+}
+
+// accountLocks hands out a mutex per account. A mutex is dropped once no
+// caller holds or waits for it.
+type accountLocks struct {
+	mu    sync.Mutex
+	locks map[string]*accountLock
+}
+
+type accountLock struct {
+	sync.Mutex
+	refs int
+}
+
+// lock blocks until the account's mutex is held and returns the function that
+// releases it.
+func (l *accountLocks) lock(accountUUID string) func() {
+	l.mu.Lock()
+	al, ok := l.locks[accountUUID]
+	if !ok {
+		al = &accountLock{}
+		l.locks[accountUUID] = al
+	}
+	al.refs++
+	l.mu.Unlock()
+
+	al.Lock()
+	return func() {
+		al.Unlock()
+
+		l.mu.Lock()
+		al.refs--
+		if al.refs == 0 {
+			delete(l.locks, accountUUID)
+		}
+		l.mu.Unlock()
+	}
+}
+
+func NewManager(logger *zap.SugaredLogger, cryptoUtil crypto.Util, accountStore store.AccountStore, herokuClient heroku.HerokuClient) Manager {
+	return Manager{
+		logger:       logger,
+		cryptoUtil:   cryptoUtil,
+		store:        accountStore,
+		herokuClient: herokuClient,
+		locks:        &accountLocks{locks: map[string]*accountLock{}},
+	}
+}
+
+// Run refreshes tokens that are about to expire until ctx is cancelled.
+func (m Manager) Run(ctx context.Context) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	for {
+		m.refreshExpiring(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// TokenFor returns a valid access token for the account, refreshing it first
+// if it has expired or is about to.
+func (m Manager) TokenFor(ctx context.Context, accountUUID string) (string, error) {
+	unlock := m.locks.lock(accountUUID)
+	defer unlock()
+
+	a, err := m.store.GetAccount(ctx, m.cryptoUtil, accountUUID)
+	if err != nil {
+		return "", fmt.Errorf("getting account: %w", err)
+	}
+
+	if !a.DeprovisionedAt.IsZero() {
+		return "", fmt.Errorf("account %s is deprovisioned", accountUUID)
+	}
+
+	if !needsRefresh(a) {
+		return a.AccessToken, nil
+	}
+
+	a, err = m.refresh(ctx, a)
+	if err != nil {
+		return "", err
+	}
+
+	return a.AccessToken, nil
+}
+
+func (m Manager) refreshExpiring(ctx context.Context) {
+	accounts, err := m.store.GetAccountsWithExpiringTokens(ctx, m.cryptoUtil, time.Now().Add(refreshMargin))
+	if err != nil {
+		m.logger.Errorf("getting accounts with expiring tokens: %s", err)
+		return
+	}
+
+	for _, a := range accounts {
+		_, err := m.TokenFor(ctx, a.UUID)
+		if err != nil {
+			m.logger.Errorf("refreshing token for account %s: %s", a.UUID, err)
+		}
+	}
+}
+
+func (m Manager) refresh(ctx context.Context, a account.Account) (account.Account, error) {
+	if a.RefreshToken == "" {
+		return a, fmt.Errorf("account %s has no refresh token", a.UUID)
+	}
+
+	oauthResp, err := m.herokuClient.RefreshToken(ctx, a.RefreshToken)
+	if err != nil {
+		return a, fmt.Errorf("refreshing token: %w", err)
+	}
+
+	a.AccessToken = oauthResp.AccessToken
+	if oauthResp.RefreshToken != "" {
+		a.RefreshToken = oauthResp.RefreshToken
+	}
+	a.TokenExpiresAt = time.Now().Add(time.Duration(oauthResp.ExpiresIn) * time.Second)
+
+	// the account may have been deprovisioned while the token was refreshed,
+	// in which case the new tokens are dropped
+	err = m.store.UpdateAccountTokens(ctx, m.cryptoUtil, a)
+	if err != nil {
+		return a, fmt.Errorf("saving refreshed token: %w", err)
+	}
+
+	m.logger.Infof("refreshed token for account %s, expires at %s", a.UUID, a.TokenExpiresAt)
+	return a, nil
+}
+
+// needsRefresh is true for tokens that expire within refreshMargin, and for
+// accounts created before expiry was recorded.
+func needsRefresh(a account.Account) bool {
+	if a.TokenExpiresAt.IsZero() {
+		return true
+	}
+
+	return time.Now().Add(refreshMargin).After(a.TokenExpiresAt)
+}
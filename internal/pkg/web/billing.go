@@ -0,0 +1,127 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/stripe/stripe-go/v75"
+)
+
+const (
+	defaultInvoicePageSize = 10
+	maxInvoicePageSize     = 100
+)
+
+// createBillingPortalSession returns the URL of a Stripe customer portal
+// session where GitHub users can update their payment method and download
+// receipts.
+func (s WebServer) createBillingPortalSession(w http.ResponseWriter, req *http.Request) {
+	userInfo, err := s.getUserInfo(req)
+	if err != nil {
+		s.log(req.Context()).Errorf("getting user info: %s", err)
+		writeError(w, req, ErrorResponse{Error: "could not get user"}, http.StatusBadRequest)
+		return
+	}
+
+	if userInfo.Provenance == "heroku" {
+		s.log(req.Context()).Errorf("heroku user cannot open the billing portal")
+		writeError(w, req, ErrorResponse{Error: "heroku user cannot open the billing portal"}, http.StatusBadRequest)
+		return
+	}
+
+	params := &stripe.BillingPortalSessionParams{
+		Customer:  stripe.String(userInfo.StripeID),
+		ReturnURL: stripe.String(s.portalReturnURL),
+	}
+	ps, err := s.billingProvider.CreateBillingPortalSession(req.Context(), params)
+	if err != nil {
+		s.log(req.Context()).Errorf("creating billing portal session: %s", err)
+		writeError(w, req, ErrorResponse{Error: "error creating billing portal session"}, http.StatusBadGateway)
+		return
+	}
+
+	j, err := json.Marshal(BillingPortalResponse{Status: "success", URL: ps.URL})
+	if err != nil {
+		s.log(req.Context()).Errorf("marshalling billing portal session to json: %s", err)
+		writeError(w, req, ErrorResponse{Error: "error creating billing portal session"}, http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, string(j))
+}
+
+// getInvoices lists the customer's invoices, newest first. Pages are
+// requested with the limit and starting_after query parameters, the latter
+// being the ID of the last invoice of the previous page.
+func (s WebServer) getInvoices(w http.ResponseWriter, req *http.Request) {
+	userInfo, err := s.getUserInfo(req)
+	if err != nil {
+		s.log(req.Context()).Errorf("getting user info: %s", err)
+		writeError(w, req, ErrorResponse{Error: "could not get user"}, http.StatusBadRequest)
+		return
+	}
+
+	if userInfo.Provenance == "heroku" {
+		s.log(req.Context()).Errorf("heroku user cannot list invoices")
+		writeError(w, req, ErrorResponse{Error: "heroku user cannot list invoices"}, http.StatusBadRequest)
+		return
+	}
+
+	limit := defaultInvoicePageSize
+	if l := req.URL.Query().Get("limit"); l != "" {
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 || limit > maxInvoicePageSize {
+			writeError(w, req, ErrorResponse{Error: fmt.Sprintf("limit must be between 1 and %d", maxInvoicePageSize)}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	params := &stripe.InvoiceListParams{
+		Customer: stripe.String(userInfo.StripeID),
+	}
+	params.Limit = stripe.Int64(int64(limit))
+	if startingAfter := req.URL.Query().Get("starting_after"); startingAfter != "" {
+		params.StartingAfter = stripe.String(startingAfter)
+	}
+
+	invoices, hasMore, err := s.billingProvider.ListInvoices(req.Context(), params)
+	if err != nil {
+		s.log(req.Context()).Errorf("listing invoices: %s", err)
+		writeError(w, req, ErrorResponse{Error: "error listing invoices"}, http.StatusBadGateway)
+		return
+	}
+
+	resp := InvoicesResponse{
+		Invoices: make([]Invoice, 0, len(invoices)),
+		HasMore:  hasMore,
+	}
+	for _, inv := range invoices {
+		resp.Invoices = append(resp.Invoices, invoiceFromStripe(inv))
+	}
+
+	j, err := json.Marshal(resp)
+	if err != nil {
+		s.log(req.Context()).Errorf("marshalling invoices to json: %s", err)
+		writeError(w, req, ErrorResponse{Error: "error listing invoices"}, http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprint(w, string(j))
+}
+
+func invoiceFromStripe(i *stripe.Invoice) Invoice {
+	return Invoice{
+		ID:          i.ID,
+		Number:      i.Number,
+		Status:      string(i.Status),
+		AmountDue:   i.AmountDue,
+		AmountPaid:  i.AmountPaid,
+		Currency:    string(i.Currency),
+		Created:     time.Unix(i.Created, 0).UTC(),
+		PeriodStart: time.Unix(i.PeriodStart, 0).UTC(),
+		PeriodEnd:   time.Unix(i.PeriodEnd, 0).UTC(),
+		HostedURL:   i.HostedInvoiceURL,
+		PDF:         i.InvoicePDF,
+	}
+}
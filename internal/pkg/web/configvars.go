@@ -0,0 +1,121 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/heroku"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/provisioner"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store"
+)
+
+func (s WebServer) rotateCredentials(w http.ResponseWriter, req *http.Request) {
+	userInfo, err := s.getUserInfo(req)
+	if err != nil {
+		s.log(req.Context()).Errorf("getting user info: %s", err)
+		writeError(w, req, ErrorResponse{Error: "could not get user"}, http.StatusBadRequest)
+		return
+	}
+
+	type instanceRequest struct {
+		Id string `json:"id"`
+	}
+	var ir instanceRequest
+	err = json.NewDecoder(req.Body).Decode(&ir)
+	if err != nil {
+		writeError(w, req, ErrorResponse{Error: "parsing request"}, http.StatusBadRequest)
+		return
+	}
+
+	if ir.Id == "" {
+		writeError(w, req, ErrorResponse{Error: "id is required"}, http.StatusBadRequest)
+		return
+	}
+
+	instance, err := s.store.GetInstance(req.Context(), s.cryptoUtil, userInfo.UserID, ir.Id)
+	if err != nil {
+		var notFoundErr *store.InstanceNotFound
+		if errors.As(err, &notFoundErr) {
+			writeError(w, req, ErrorResponse{Error: "instance not found"}, http.StatusNotFound)
+			return
+		}
+		s.log(req.Context()).Errorf("getting instance: %s", err)
+		writeError(w, req, ErrorResponse{Error: "rotating credentials"}, http.StatusInternalServerError)
+		return
+	}
+
+	instance.ConfigVars, err = provisioner.GenerateConfigVars(instance)
+	if err != nil {
+		s.log(req.Context()).Errorf("generating config vars: %s", err)
+		writeError(w, req, ErrorResponse{Error: "rotating credentials"}, http.StatusInternalServerError)
+		return
+	}
+
+	err = s.store.UpdateInstanceConfigVars(req.Context(), s.cryptoUtil, instance.AccountID, instance.Id, instance.ConfigVars)
+	if err != nil {
+		s.log(req.Context()).Errorf("updating config vars: %s", err)
+		writeError(w, req, ErrorResponse{Error: "rotating credentials"}, http.StatusInternalServerError)
+		return
+	}
+
+	if userInfo.Provenance == "heroku" {
+		err = s.pushHerokuConfigVars(req.Context(), instance)
+		if err != nil {
+			s.log(req.Context()).Errorf("pushing config vars to heroku: %s", err)
+			writeError(w, req, ErrorResponse{Error: "credentials rotated but could not be updated on heroku"}, http.StatusBadGateway)
+			return
+		}
+	}
+
+	fmt.Fprint(w, `{"status":"success"}`)
+}
+
+// ensureConfigVars generates and saves config vars for instances created
+// before they were stored.
+func (s WebServer) ensureConfigVars(ctx context.Context, instance account.Instance) (account.Instance, error) {
+	if len(instance.ConfigVars) > 0 {
+		return instance, nil
+	}
+
+	configVars, err := provisioner.GenerateConfigVars(instance)
+	if err != nil {
+		return instance, fmt.Errorf("generating config vars: %w", err)
+	}
+
+	err = s.store.UpdateInstanceConfigVars(ctx, s.cryptoUtil, instance.AccountID, instance.Id, configVars)
+	if err != nil {
+		return instance, fmt.Errorf("saving config vars: %w", err)
+	}
+
+	instance.ConfigVars = configVars
+	return instance, nil
+}
+
+// pushHerokuConfigVars sets the instance's config vars on the Heroku app the
+// add-on is attached to. The account UUID of Heroku instances is the resource
+// UUID of the add-on.
+func (s WebServer) pushHerokuConfigVars(ctx context.Context, instance account.Instance) error {
+	token, err := s.tokenManager.TokenFor(ctx, instance.AccountID)
+	if err != nil {
+		return fmt.Errorf("getting access token: %w", err)
+	}
+
+	configVars := heroku.ConfigVars{}
+	for name, value := range instance.ConfigVars {
+		configVars.Config = append(configVars.Config, heroku.Vars{
+			Name:  name,
+			Value: value,
+		})
+	}
+
+	err = s.herokuClient.UpdateConfigVars(ctx, token, instance.AccountID, configVars)
+	if err != nil {
+		return fmt.Errorf("updating config vars: %w", err)
+	}
+
+	return nil
+}
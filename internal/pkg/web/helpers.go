@@ -2,6 +2,7 @@ package web
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"net/url"
@@ -34,7 +35,23 @@ func getGithubUserEmail(ctx context.Context, token oauth2.Token) (string, error)
 }
 
 func (s WebServer) errorLogAndRedirect(w http.ResponseWriter, req *http.Request, logMessage, reason string) {
-	s.logger.Errorf(logMessage)
+	s.log(req.Context()).Errorf(logMessage)
 	url := fmt.Sprintf("/login?reason=%s", url.QueryEscape(reason))
 	http.Redirect(w, req, url, http.StatusFound)
 }
+
+// writeError writes a JSON error response carrying the request ID, so that a
+// failed request can be found in the logs.
+func writeError(w http.ResponseWriter, req *http.Request, resp ErrorResponse, statusCode int) {
+	resp.RequestID = requestID(req.Context())
+	j, err := json.Marshal(resp)
+	if err != nil {
+		http.Error(w, `{"error":"internal error"}`, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(statusCode)
+	w.Write(j)
+}
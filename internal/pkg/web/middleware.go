@@ -0,0 +1,200 @@
+package web
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/metrics"
+	"github.com/dghubble/sessions"
+	"github.com/google/uuid"
+	gmux "github.com/gorilla/mux"
+	"go.opentelemetry.io/otel/attribute"
+	semconv "go.opentelemetry.io/otel/semconv/v1.21.0"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+)
+
+// requestIDHeader is set by the Heroku router, requests without one are given
+// a new ID.
+const requestIDHeader = "X-Request-ID"
+
+var validRequestID = regexp.MustCompile(`^[a-zA-Z0-9_.:-]{1,128}$`)
+
+// statusRecorder remembers the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+func (r *statusRecorder) Unwrap() http.ResponseWriter {
+	return r.ResponseWriter
+}
+
+// loadedSession is the session decoded by loadSession along with the error
+// decoding it, if any.
+type loadedSession struct {
+	session *sessions.Session[string]
+	err     error
+}
+
+// loadSession decodes the session cookie once and puts it into the request
+// context for the middleware and handlers that follow.
+func (s WebServer) loadSession(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		session, err := s.sessionStore.Get(req, "heroku-addon")
+		ctx := context.WithValue(req.Context(), ContextSessionKey, loadedSession{session: session, err: err})
+		next.ServeHTTP(w, req.WithContext(ctx))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// session returns the session decoded by loadSession, decoding it here for
+// requests that didn't go through it.
+func (s WebServer) session(req *http.Request) (*sessions.Session[string], error) {
+	if loaded, ok := req.Context().Value(ContextSessionKey).(loadedSession); ok {
+		return loaded.session, loaded.err
+	}
+	return s.sessionStore.Get(req, "heroku-addon")
+}
+
+// withMiddleware wraps h in middleware the way gorilla/mux does for matched
+// routes, the first middleware being the outermost.
+func withMiddleware(h http.Handler, middleware []gmux.MiddlewareFunc) http.Handler {
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+	return h
+}
+
+func methodNotAllowed(w http.ResponseWriter, req *http.Request) {
+	w.WriteHeader(http.StatusMethodNotAllowed)
+}
+
+// recordRequestMetrics counts every request and records its duration, tagged
+// by route template rather than path so that IDs don't become tags.
+func (s WebServer) recordRequestMetrics(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+
+		next.ServeHTTP(rec, req)
+
+		tags := metrics.Tags{
+			"route":      routeTemplate(req),
+			"method":     req.Method,
+			"status":     strconv.Itoa(rec.status),
+			"provenance": s.requestProvenance(req),
+		}
+		s.recorder.Count(req.Context(), metrics.NameHTTPRequests, 1, tags)
+		s.recorder.Histogram(req.Context(), metrics.NameHTTPRequestDuration, time.Since(start).Seconds(), tags)
+	}
+	return http.HandlerFunc(fn)
+}
+
+// nameRequestSpan names the span started by otelhttp after the matched route,
+// which isn't known until the router has run.
+func nameRequestSpan(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		template := routeTemplate(req)
+		span := trace.SpanFromContext(req.Context())
+		span.SetName(req.Method + " " + template)
+		span.SetAttributes(semconv.HTTPRoute(template))
+
+		next.ServeHTTP(w, req)
+	}
+	return http.HandlerFunc(fn)
+}
+
+func routeTemplate(req *http.Request) string {
+	route := gmux.CurrentRoute(req)
+	if route == nil {
+		return "unmatched"
+	}
+
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return "unmatched"
+	}
+	return template
+}
+
+// requestLogging propagates the request ID, echoing it in the response, and
+// puts a logger tagged with the request ID, route, provenance and account
+// into the request context.
+func (s WebServer) requestLogging(next http.Handler) http.Handler {
+	fn := func(w http.ResponseWriter, req *http.Request) {
+		requestID := req.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = uuid.NewString()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		logger := s.logger.With(
+			"request_id", requestID,
+			"route", routeTemplate(req),
+			"provenance", s.requestProvenance(req),
+		)
+		span := trace.SpanFromContext(req.Context())
+		span.SetAttributes(attribute.String("request.id", requestID))
+		if span.SpanContext().IsValid() {
+			logger = logger.With("trace_id", span.SpanContext().TraceID().String())
+		}
+		if accountUUID := s.requestAccountUUID(req); accountUUID != "" {
+			logger = logger.With("account_uuid", accountUUID)
+		}
+
+		ctx := context.WithValue(req.Context(), ContextRequestIDKey, requestID)
+		ctx = context.WithValue(ctx, ContextLoggerKey, logger)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	}
+	return http.HandlerFunc(fn)
+}
+
+// requestProvenance returns the provenance of the logged in user, or "none"
+// for requests without a session such as the Heroku partner API.
+func (s WebServer) requestProvenance(req *http.Request) string {
+	session, err := s.session(req)
+	if err != nil {
+		return "none"
+	}
+
+	provenance, ok := session.GetOk("provenance")
+	if !ok {
+		return "none"
+	}
+	return provenance
+}
+
+// requestAccountUUID returns the UUID of the logged in account, if any.
+func (s WebServer) requestAccountUUID(req *http.Request) string {
+	session, err := s.session(req)
+	if err != nil {
+		return ""
+	}
+
+	accountUUID, _ := session.GetOk("user-id")
+	return accountUUID
+}
+
+// log returns the request logger carried by ctx, or the server's logger
+// outside of a request.
+func (s WebServer) log(ctx context.Context) *zap.SugaredLogger {
+	logger, ok := ctx.Value(ContextLoggerKey).(*zap.SugaredLogger)
+	if !ok {
+		return s.logger
+	}
+	return logger
+}
+
+func requestID(ctx context.Context) string {
+	id, _ := ctx.Value(ContextRequestIDKey).(string)
+	return id
+}
@@ -0,0 +1,237 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/metrics"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/provisioner"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store"
+	"github.com/stripe/stripe-go/v75"
+
+	gmux "github.com/gorilla/mux"
+)
+
+// changeInstancePlan moves a GitHub user's instance to another plan. Paid
+// plans are billed through the instance's subscription, with the price
+// difference prorated, and the plan only changes once Stripe confirms the
+// payment with a customer.subscription.updated webhook.
+func (s WebServer) changeInstancePlan(w http.ResponseWriter, req *http.Request) {
+	userInfo, err := s.getUserInfo(req)
+	if err != nil {
+		s.log(req.Context()).Errorf("getting user info: %s", err)
+		writeError(w, req, ErrorResponse{Error: "could not get user"}, http.StatusBadRequest)
+		return
+	}
+
+	if userInfo.Provenance == "heroku" {
+		s.log(req.Context()).Errorf("heroku user cannot change plans")
+		writeError(w, req, ErrorResponse{Error: "heroku user cannot change plans"}, http.StatusBadRequest)
+		return
+	}
+
+	type planRequest struct {
+		Plan string `json:"plan"`
+	}
+	var pr planRequest
+	err = json.NewDecoder(req.Body).Decode(&pr)
+	if err != nil {
+		writeError(w, req, ErrorResponse{Error: "parsing request"}, http.StatusBadRequest)
+		return
+	}
+
+	pricingPlan, err := s.pricing.LookupPricingPlan(pr.Plan)
+	if err != nil {
+		s.log(req.Context()).Errorf("changing plan: %s", err)
+		s.writeUnknownPlan(w, req, err, false)
+		return
+	}
+
+	i, err := s.store.GetInstance(req.Context(), s.cryptoUtil, userInfo.UserID, gmux.Vars(req)["id"])
+	var notFoundErr *store.InstanceNotFound
+	if errors.As(err, &notFoundErr) {
+		writeError(w, req, ErrorResponse{Error: "instance not found"}, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		s.log(req.Context()).Errorf("getting instance: %s", err)
+		writeError(w, req, ErrorResponse{Error: "error getting instance"}, http.StatusInternalServerError)
+		return
+	}
+
+	if i.Status != account.InstanceStatusActive {
+		writeError(w, req, ErrorResponse{Error: "instance is not active"}, http.StatusBadRequest)
+		return
+	}
+
+	if i.Plan == pricingPlan.Name {
+		writeError(w, req, ErrorResponse{Error: "instance is already on this plan"}, http.StatusBadRequest)
+		return
+	}
+
+	// instances without a subscription have nothing to bill for a free plan
+	if i.Subscription == nil && pricingPlan.PriceDollars == 0 {
+		err = s.applyPlanChange(req.Context(), i, pricingPlan.Name)
+		if err != nil {
+			s.log(req.Context()).Errorf("changing plan: %s", err)
+			writeError(w, req, ErrorResponse{Error: "error changing plan"}, http.StatusInternalServerError)
+			return
+		}
+		fmt.Fprintf(w, `{"status":"success","plan":"%s"}`, pricingPlan.Name)
+		return
+	}
+
+	var clientSecret string
+	if i.Subscription == nil || i.Subscription.Status == string(stripe.SubscriptionStatusIncomplete) {
+		clientSecret, err = s.subscribeInstance(req.Context(), i, userInfo.StripeID, pricingPlan)
+	} else {
+		clientSecret, err = s.swapSubscriptionPrice(req.Context(), i, pricingPlan)
+	}
+	if err != nil {
+		s.log(req.Context()).Errorf("changing plan: %s", err)
+		writeError(w, req, ErrorResponse{Error: "error changing plan"}, http.StatusBadRequest)
+		return
+	}
+
+	fmt.Fprintf(w, `{"status":"pending","plan":"%s","clientSecret":"%s"}`, pricingPlan.Name, clientSecret)
+}
+
+// subscribeInstance starts a subscription for an instance that isn't paid for
+// yet. An abandoned subscription from an earlier attempt is replaced, it is
+// unlinked from the instance before it is cancelled so that its
+// customer.subscription.deleted webhook leaves the instance alone.
+func (s WebServer) subscribeInstance(ctx context.Context, i account.Instance, customerID string, plan account.PricingPlan) (string, error) {
+	priceID, err := plan.StripePriceID()
+	if err != nil {
+		return "", err
+	}
+
+	params := &stripe.SubscriptionParams{
+		Customer: stripe.String(customerID),
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				Price: stripe.String(priceID),
+			},
+		},
+		PaymentBehavior: stripe.String("default_incomplete"),
+		PaymentSettings: &stripe.SubscriptionPaymentSettingsParams{
+			SaveDefaultPaymentMethod: stripe.String("on_subscription"),
+		},
+		Metadata: map[string]string{
+			"plan":     plan.Name,
+			"name":     i.Name,
+			"env":      s.env,
+			"instance": i.Id,
+		},
+	}
+	params.AddExpand("latest_invoice.payment_intent")
+	sub, err := s.billingProvider.CreateSubscription(ctx, params)
+	if err != nil {
+		return "", fmt.Errorf("creating subscription: %w", err)
+	}
+
+	err = s.store.UpdateInstanceSubscription(ctx, i.AccountID, i.Id, *subscriptionFromStripe(sub))
+	if err != nil {
+		return "", fmt.Errorf("updating instance subscription: %w", err)
+	}
+
+	if i.Subscription != nil {
+		_, err = s.billingProvider.CancelSubscription(ctx, i.Subscription.ID)
+		if err != nil {
+			s.log(ctx).Errorf("cancelling abandoned subscription %s: %s", i.Subscription.ID, err)
+		}
+	}
+
+	return paymentClientSecret(sub), nil
+}
+
+// swapSubscriptionPrice moves the instance's subscription to the plan's
+// price. The prorated difference is invoiced straight away and the change is
+// left pending by Stripe until that invoice is paid.
+func (s WebServer) swapSubscriptionPrice(ctx context.Context, i account.Instance, plan account.PricingPlan) (string, error) {
+	priceID, err := plan.StripePriceID()
+	if err != nil {
+		return "", err
+	}
+
+	current, err := s.billingProvider.GetSubscription(ctx, i.Subscription.ID)
+	if err != nil {
+		return "", fmt.Errorf("getting subscription: %w", err)
+	}
+
+	if current.Items == nil || len(current.Items.Data) == 0 {
+		return "", fmt.Errorf("subscription %s has no items", current.ID)
+	}
+
+	params := &stripe.SubscriptionParams{
+		Items: []*stripe.SubscriptionItemsParams{
+			{
+				ID:    stripe.String(current.Items.Data[0].ID),
+				Price: stripe.String(priceID),
+			},
+		},
+		ProrationBehavior: stripe.String("always_invoice"),
+		PaymentBehavior:   stripe.String("pending_if_incomplete"),
+	}
+	params.AddExpand("latest_invoice.payment_intent")
+	sub, err := s.billingProvider.UpdateSubscription(ctx, current.ID, params)
+	if err != nil {
+		return "", fmt.Errorf("updating subscription: %w", err)
+	}
+
+	return paymentClientSecret(sub), nil
+}
+
+// syncInstancePlan changes an instance's plan to the one billed by its
+// subscription's price.
+func (s WebServer) syncInstancePlan(ctx context.Context, i account.Instance, priceID string) error {
+	plan, err := s.pricing.LookupPricingPlanByPriceID(priceID)
+	if err != nil {
+		s.log(ctx).Errorf("syncing plan of instance %s: %s", i.Id, err)
+		return nil
+	}
+
+	if plan.Name == i.Plan {
+		return nil
+	}
+
+	return s.applyPlanChange(ctx, i, plan.Name)
+}
+
+func (s WebServer) applyPlanChange(ctx context.Context, i account.Instance, plan string) error {
+	s.recorder.Count(ctx, metrics.NamePlanChange, 1, metrics.Tags{"type": "github"})
+
+	err := s.store.UpdateInstancePlan(ctx, i.AccountID, i.Id, plan)
+	if err != nil {
+		return err
+	}
+
+	s.log(ctx).Infof("changing plan of instance %s from %s to %s", i.Id, i.Plan, plan)
+	i.Plan = plan
+	err = provisioner.ProvisionResource(i)
+	if err != nil {
+		return fmt.Errorf("provisioning resource: %w", err)
+	}
+
+	return nil
+}
+
+// paymentClientSecret returns the client secret the frontend needs to
+// confirm the payment of a subscription's latest invoice, or an empty string
+// when no action is needed.
+func paymentClientSecret(sub *stripe.Subscription) string {
+	if sub.LatestInvoice == nil || sub.LatestInvoice.PaymentIntent == nil {
+		return ""
+	}
+
+	switch sub.LatestInvoice.PaymentIntent.Status {
+	case stripe.PaymentIntentStatusRequiresAction, stripe.PaymentIntentStatusRequiresPaymentMethod, stripe.PaymentIntentStatusRequiresConfirmation:
+		return sub.LatestInvoice.PaymentIntent.ClientSecret
+	}
+
+	return ""
+}
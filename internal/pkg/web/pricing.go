@@ -0,0 +1,80 @@
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+	"github.com/stripe/stripe-go/v75"
+)
+
+// ValidatePricingPlans checks that every configured plan is billed with an
+// active, recurring Stripe price that charges what the plan advertises. Free
+// plans are no exception: they need a $0 recurring price, because moving a
+// subscribed instance to a free plan swaps its subscription onto that price.
+// Plans without a price in this environment are skipped, they can't be
+// subscribed to.
+func (s WebServer) ValidatePricingPlans(ctx context.Context) error {
+	var err error
+	for _, plan := range s.pricing.Plans() {
+		if plan.PriceID == "" {
+			s.log(ctx).Warnf("plan %s has no stripe price in env %s, it can't be subscribed to", plan.Name, s.env)
+			continue
+		}
+
+		p, getErr := s.billingProvider.GetPrice(ctx, plan.PriceID)
+		if getErr != nil {
+			if plan.PriceDollars == 0 {
+				getErr = fmt.Errorf("free plans need a $0 recurring price: %w", getErr)
+			}
+			err = errors.Join(err, fmt.Errorf("getting stripe price %s for plan %s: %w", plan.PriceID, plan.Name, getErr))
+			continue
+		}
+
+		if !p.Active {
+			err = errors.Join(err, fmt.Errorf("stripe price %s for plan %s is not active", p.ID, plan.Name))
+		}
+		if p.Type != stripe.PriceTypeRecurring {
+			err = errors.Join(err, fmt.Errorf("stripe price %s for plan %s is not recurring", p.ID, plan.Name))
+		}
+		if p.UnitAmount != int64(plan.PriceDollars*100) {
+			err = errors.Join(err, fmt.Errorf("stripe price %s for plan %s charges %d cents, expected %d", p.ID, plan.Name, p.UnitAmount, plan.PriceDollars*100))
+		}
+	}
+
+	return err
+}
+
+// writeUnknownPlan responds with a 400 that lists the valid plans when err is
+// an account.UnknownPlan. Heroku responses also carry a failed status.
+func (s WebServer) writeUnknownPlan(w http.ResponseWriter, req *http.Request, err error, herokuRequest bool) {
+	var unknownPlanErr *account.UnknownPlan
+	if !errors.As(err, &unknownPlanErr) {
+		writeError(w, req, ErrorResponse{Error: "invalid plan"}, http.StatusBadRequest)
+		return
+	}
+
+	resp := UnknownPlanResponse{
+		Error:      fmt.Sprintf("unknown plan %s", unknownPlanErr.Plan),
+		Plan:       unknownPlanErr.Plan,
+		ValidPlans: unknownPlanErr.ValidPlans,
+		RequestID:  requestID(req.Context()),
+	}
+	if herokuRequest {
+		resp.Status = "failed"
+	}
+
+	j, err := json.Marshal(resp)
+	if err != nil {
+		s.log(req.Context()).Errorf("marshalling unknown plan response: %s", err)
+		writeError(w, req, ErrorResponse{Error: "invalid plan"}, http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusBadRequest)
+	w.Write(j)
+}
@@ -0,0 +1,191 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/provisioner"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store"
+	"github.com/google/uuid"
+)
+
+const (
+	provisioningPollInterval = 5 * time.Second
+	provisioningMaxAttempts  = 5
+)
+
+var errTokenExchange = errors.New("exchanging oauth grant")
+
+// RunProvisioningWorker completes pending Heroku provisioning jobs created by
+// provisionHerokuHandler when async provisioning is enabled. It blocks until
+// ctx is cancelled.
+func (s WebServer) RunProvisioningWorker(ctx context.Context) {
+	if !s.asyncProvisioning {
+		return
+	}
+
+	ticker := time.NewTicker(provisioningPollInterval)
+	defer ticker.Stop()
+
+	for {
+		s.processProvisioningJobs(ctx)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (s WebServer) processProvisioningJobs(ctx context.Context) {
+	for {
+		job, ok, err := s.store.ClaimProvisioningJob(ctx, s.cryptoUtil)
+		if err != nil {
+			s.logger.Errorf("claiming provisioning job: %s", err)
+			return
+		}
+		if !ok {
+			return
+		}
+
+		s.logger.Infof("running provisioning job for %s, attempt %d", job.ResourceUUID, job.Attempts)
+		err = s.runProvisioningJob(ctx, job)
+		if err != nil {
+			s.logger.Errorf("provisioning job for %s failed: %s", job.ResourceUUID, err)
+			job.LastError = err.Error()
+			job.Status = account.ProvisioningJobStatusPending
+			if job.Attempts >= provisioningMaxAttempts {
+				job.Status = account.ProvisioningJobStatusFailed
+			}
+		} else {
+			s.logger.Infof("provisioning job for %s complete", job.ResourceUUID)
+			job.LastError = ""
+			job.Status = account.ProvisioningJobStatusComplete
+		}
+
+		err = s.store.UpdateProvisioningJob(ctx, job)
+		if err != nil {
+			s.logger.Errorf("updating provisioning job for %s: %s", job.ResourceUUID, err)
+		}
+	}
+}
+
+func (s WebServer) runProvisioningJob(ctx context.Context, job account.ProvisioningJob) error {
+	instance, err := s.completeHerokuProvisioning(ctx, job.ResourceUUID, job.Plan, job.OauthCode)
+	if err != nil {
+		return err
+	}
+
+	err = s.pushHerokuConfigVars(ctx, instance)
+	if err != nil {
+		return err
+	}
+
+	token, err := s.tokenManager.TokenFor(ctx, job.ResourceUUID)
+	if err != nil {
+		return fmt.Errorf("getting access token: %w", err)
+	}
+
+	err = s.herokuClient.MarkProvisioned(ctx, token, job.ResourceUUID)
+	if err != nil {
+		return fmt.Errorf("marking addon as provisioned: %w", err)
+	}
+
+	return nil
+}
+
+// completeHerokuProvisioning creates the account and instance for a Heroku
+// resource and provisions the backing resource. Steps that already completed on a previous attempt are
+// skipped so that it can be retried.
+func (s WebServer) completeHerokuProvisioning(ctx context.Context, resourceUUID, plan, code string) (account.Instance, error) {
+	a, err := s.store.GetAccount(ctx, s.cryptoUtil, resourceUUID)
+	if err != nil {
+		var noAcctErr *store.AccountNotFound
+		if !errors.As(err, &noAcctErr) {
+			return account.Instance{}, fmt.Errorf("getting account: %w", err)
+		}
+	}
+
+	if err != nil || !a.DeprovisionedAt.IsZero() {
+		a, err = s.createHerokuAccount(ctx, resourceUUID, code)
+		if err != nil {
+			return account.Instance{}, err
+		}
+	}
+
+	instances, err := s.store.GetInstances(ctx, s.cryptoUtil, resourceUUID)
+	if err != nil {
+		return account.Instance{}, fmt.Errorf("getting instances: %w", err)
+	}
+
+	var instance account.Instance
+	if len(instances) > 0 {
+		instance, err = s.ensureConfigVars(ctx, instances[0])
+		if err != nil {
+			return account.Instance{}, err
+		}
+	} else {
+		idAndName := uuid.New().String()
+		instance = account.Instance{
+			AccountID: resourceUUID,
+			Id:        idAndName,
+			Plan:      plan,
+			Name:      idAndName,
+		}
+
+		instance.ConfigVars, err = provisioner.GenerateConfigVars(instance)
+		if err != nil {
+			return account.Instance{}, fmt.Errorf("generating config vars: %w", err)
+		}
+
+		err = s.store.CreateOrUpdateInstance(ctx, s.cryptoUtil, instance)
+		if err != nil {
+			return account.Instance{}, fmt.Errorf("saving instance to database: %w", err)
+		}
+	}
+
+	err = provisioner.ProvisionResource(instance)
+	if err != nil {
+		return account.Instance{}, fmt.Errorf("provisioning resource: %w", err)
+	}
+
+	return instance, nil
+}
+
+func (s WebServer) createHerokuAccount(ctx context.Context, resourceUUID, code string) (account.Account, error) {
+	oauthResp, err := s.herokuClient.ExchangeToken(ctx, code)
+	if err != nil {
+		return account.Account{}, fmt.Errorf("%w: %s", errTokenExchange, err)
+	}
+
+	addonInfo, err := s.herokuClient.GetAppAddonInfo(ctx, oauthResp.AccessToken)
+	if err != nil {
+		return account.Account{}, fmt.Errorf("getting app id: %w", err)
+	}
+
+	ownerEmail, err := s.herokuClient.GetOwnerEmail(ctx, oauthResp.AccessToken, addonInfo.App.Id)
+	if err != nil {
+		return account.Account{}, fmt.Errorf("getting owner email: %w", err)
+	}
+
+	acct := account.Account{
+		UUID:           resourceUUID,
+		Email:          ownerEmail,
+		Name:           addonInfo.App.Name,
+		AccountType:    account.AccountTypeHeroku,
+		AccessToken:    oauthResp.AccessToken,
+		RefreshToken:   oauthResp.RefreshToken,
+		StripeCustID:   "", // payment handled by Heroku, not required
+		TokenExpiresAt: time.Now().Add(time.Duration(oauthResp.ExpiresIn) * time.Second),
+	}
+	err = s.store.CreateOrUpdateAccount(ctx, s.cryptoUtil, acct)
+	if err != nil {
+		return account.Account{}, fmt.Errorf("creating account: %w", err)
+	}
+
+	return acct, nil
+}
@@ -0,0 +1,35 @@
+package web
+
+import (
+	"context"
+	"time"
+)
+
+const purgeInterval = time.Hour
+
+// RunAccountPurger periodically deletes deprovisioned Heroku accounts once
+// they are older than the configured retention period. It blocks until ctx
+// is cancelled.
+func (s WebServer) RunAccountPurger(ctx context.Context) {
+	if s.accountRetention <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+
+	for {
+		n, err := s.store.PurgeDeprovisionedAccounts(ctx, time.Now().Add(-s.accountRetention))
+		if err != nil {
+			s.log(ctx).Errorf("purging deprovisioned accounts: %s", err)
+		} else if n > 0 {
+			s.log(ctx).Infof("purged %d deprovisioned accounts", n)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
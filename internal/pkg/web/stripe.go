@@ -3,31 +3,31 @@ package web
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"time"
 
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
-	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/datadog"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/metrics"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/provisioner"
 	"github.com/google/uuid"
 	"github.com/stripe/stripe-go/v75"
-	"github.com/stripe/stripe-go/v75/paymentintent"
-	"github.com/stripe/stripe-go/v75/subscription"
-	"github.com/stripe/stripe-go/v75/webhook"
 )
 
 func (s WebServer) createSubscription(w http.ResponseWriter, req *http.Request) {
 	userInfo, err := s.getUserInfo(req)
 	if err != nil {
-		s.logger.Errorf("getting user info: %s", err)
-		http.Error(w, `{"error":"could not get user"}`, http.StatusBadRequest)
+		s.log(req.Context()).Errorf("getting user info: %s", err)
+		writeError(w, req, ErrorResponse{Error: "could not get user"}, http.StatusBadRequest)
 		return
 	}
 
 	if userInfo.Provenance == "heroku" {
-		s.logger.Errorf("heroku user cannot create payment intent")
-		http.Error(w, `{"error":"heroku user cannot create payment intent"}`, http.StatusBadRequest)
+		s.log(req.Context()).Errorf("heroku user cannot create payment intent")
+		writeError(w, req, ErrorResponse{Error: "heroku user cannot create payment intent"}, http.StatusBadRequest)
 		return
 	}
 
@@ -38,50 +38,83 @@ func (s WebServer) createSubscription(w http.ResponseWriter, req *http.Request)
 	var ir instanceRequest
 	err = json.NewDecoder(req.Body).Decode(&ir)
 	if err != nil {
-		http.Error(w, `{"error":"parsing request"}`, http.StatusBadRequest)
+		writeError(w, req, ErrorResponse{Error: "parsing request"}, http.StatusBadRequest)
 		return
 	}
 
 	if ir.Name == "" || ir.Plan == "" {
-		http.Error(w, `{"error":"name and plan are required"}`, http.StatusBadRequest)
+		writeError(w, req, ErrorResponse{Error: "name and plan are required"}, http.StatusBadRequest)
 		return
 	}
 
-	pricingPlan := account.LookupPricingPlan(ir.Plan)
-	stripe.Key = s.stripeKey
+	pricingPlan, err := s.pricing.LookupPricingPlan(ir.Plan)
+	if err != nil {
+		s.log(req.Context()).Errorf("creating subscription: %s", err)
+		s.writeUnknownPlan(w, req, err, false)
+		return
+	}
+
+	priceID, err := pricingPlan.StripePriceID()
+	if err != nil {
+		s.log(req.Context()).Errorf("creating subscription: %s", err)
+		writeError(w, req, ErrorResponse{Error: "plan is not available"}, http.StatusBadRequest)
+		return
+	}
 
 	subscriptionParams := &stripe.SubscriptionParams{
 		Customer: stripe.String(userInfo.StripeID),
 		Items: []*stripe.SubscriptionItemsParams{
 			{
-				Price: stripe.String(pricingPlan.PriceID),
+				Price: stripe.String(priceID),
 			},
 		},
 		PaymentBehavior: stripe.String("default_incomplete"),
+		PaymentSettings: &stripe.SubscriptionPaymentSettingsParams{
+			SaveDefaultPaymentMethod: stripe.String("on_subscription"),
+		},
+		Metadata: map[string]string{
+			"plan": ir.Plan,
+			"name": ir.Name,
+			"env":  s.env,
+		},
 	}
 	subscriptionParams.AddExpand("latest_invoice.payment_intent")
-	sub, err := subscription.New(subscriptionParams)
+	sub, err := s.billingProvider.CreateSubscription(req.Context(), subscriptionParams)
 	if err != nil {
-		s.logger.Errorf("creating subscription %s", err.Error())
-		http.Error(w, `{"error":"error creating subscription"}`, http.StatusBadRequest)
+		s.log(req.Context()).Errorf("creating subscription %s", err.Error())
+		writeError(w, req, ErrorResponse{Error: "error creating subscription"}, http.StatusBadRequest)
+		return
+	}
+
+	i := account.Instance{
+		AccountID:    userInfo.UserID,
+		Id:           uuid.New().String(),
+		Plan:         ir.Plan,
+		Name:         ir.Name,
+		Status:       account.InstanceStatusPending,
+		Subscription: subscriptionFromStripe(sub),
+	}
+	err = s.store.CreateOrUpdateInstance(req.Context(), s.cryptoUtil, i)
+	if err != nil {
+		s.log(req.Context()).Errorf("creating instance: %s", err)
+		writeError(w, req, ErrorResponse{Error: "error creating instance"}, http.StatusInternalServerError)
 		return
 	}
 
-	// // sub.ID
 	fmt.Fprintf(w, `{"status":"success","clientSecret":"%s"}`, sub.LatestInvoice.PaymentIntent.ClientSecret)
 }
 
 func (s WebServer) newPaymentIntent(w http.ResponseWriter, req *http.Request) {
 	userInfo, err := s.getUserInfo(req)
 	if err != nil {
-		s.logger.Errorf("getting user info: %s", err)
-		http.Error(w, `{"error":"could not get user"}`, http.StatusBadRequest)
+		s.log(req.Context()).Errorf("getting user info: %s", err)
+		writeError(w, req, ErrorResponse{Error: "could not get user"}, http.StatusBadRequest)
 		return
 	}
 
 	if userInfo.Provenance == "heroku" {
-		s.logger.Errorf("heroku user cannot create payment intent")
-		http.Error(w, `{"error":"heroku user cannot create payment intent"}`, http.StatusBadRequest)
+		s.log(req.Context()).Errorf("heroku user cannot create payment intent")
+		writeError(w, req, ErrorResponse{Error: "heroku user cannot create payment intent"}, http.StatusBadRequest)
 		return
 	}
 
@@ -92,23 +125,24 @@ func (s WebServer) newPaymentIntent(w http.ResponseWriter, req *http.Request) {
 	var ir instanceRequest
 	err = json.NewDecoder(req.Body).Decode(&ir)
 	if err != nil {
-		http.Error(w, `{"error":"parsing request"}`, http.StatusBadRequest)
+		writeError(w, req, ErrorResponse{Error: "parsing request"}, http.StatusBadRequest)
 		return
 	}
 
 	if ir.Name == "" || ir.Plan == "" {
-		http.Error(w, `{"error":"name and plan are required"}`, http.StatusBadRequest)
+		writeError(w, req, ErrorResponse{Error: "name and plan are required"}, http.StatusBadRequest)
+		return
+	}
+
+	pricingPlan, err := s.pricing.LookupPricingPlan(ir.Plan)
+	if err != nil {
+		s.log(req.Context()).Errorf("creating payment intent: %s", err)
+		s.writeUnknownPlan(w, req, err, false)
 		return
 	}
 
 	if ir.Plan == string(account.PlanTypeFree) {
-		s.ddClient.Publish(req.Context(), datadog.CustomMetric{
-			MetricName:  datadog.MetricNameProvision,
-			MetricValue: 1,
-			Tags: map[string]string{
-				"type": "github",
-			},
-		})
+		s.recorder.Count(req.Context(), metrics.NameProvision, 1, metrics.Tags{"type": "github"})
 
 		i := account.Instance{
 			AccountID: userInfo.UserID,
@@ -116,18 +150,23 @@ func (s WebServer) newPaymentIntent(w http.ResponseWriter, req *http.Request) {
 			Plan:      string(account.PlanTypeFree),
 			Name:      ir.Name,
 		}
-		err = s.postgresClient.CreateOrUpdateInstance(i)
+		i.ConfigVars, err = provisioner.GenerateConfigVars(i)
+		if err != nil {
+			s.log(req.Context()).Errorf("generating config vars: %s", err)
+			writeError(w, req, ErrorResponse{Error: "error creating instance"}, http.StatusInternalServerError)
+			return
+		}
+		err = s.store.CreateOrUpdateInstance(req.Context(), s.cryptoUtil, i)
 		if err != nil {
-			s.logger.Errorf("creating instance: %s", err)
-			http.Error(w, `{"error":"error creating instance"}`, http.StatusInternalServerError)
+			s.log(req.Context()).Errorf("creating instance: %s", err)
+			writeError(w, req, ErrorResponse{Error: "error creating instance"}, http.StatusInternalServerError)
 			return
 		}
 		fmt.Fprint(w, `{"status":"success","clientSecret":"free"}`)
 		return
 	}
 
-	pricePennies := account.LookupPricingPlan(ir.Plan).PriceDollars * 100
-	stripe.Key = s.stripeKey
+	pricePennies := pricingPlan.PriceDollars * 100
 	params := &stripe.PaymentIntentParams{
 		Amount: stripe.Int64(int64(pricePennies)),
 		AutomaticPaymentMethods: &stripe.PaymentIntentAutomaticPaymentMethodsParams{
@@ -141,10 +180,10 @@ func (s WebServer) newPaymentIntent(w http.ResponseWriter, req *http.Request) {
 			"env":  s.env,
 		},
 	}
-	pi, err := paymentintent.New(params)
+	pi, err := s.billingProvider.CreatePaymentIntent(req.Context(), params)
 	if err != nil {
-		s.logger.Errorf("creating payment intent %s", err.Error())
-		http.Error(w, `{"error":"error creating payment intent"}`, http.StatusBadRequest)
+		s.log(req.Context()).Errorf("creating payment intent %s", err.Error())
+		writeError(w, req, ErrorResponse{Error: "error creating payment intent"}, http.StatusBadRequest)
 		return
 	}
 
@@ -160,7 +199,7 @@ func (s WebServer) handleStripeWebhook(w http.ResponseWriter, req *http.Request)
 	req.Body = http.MaxBytesReader(w, req.Body, MaxBodyBytes)
 	payload, err := io.ReadAll(req.Body)
 	if err != nil {
-		fmt.Fprintf(os.Stderr, "Error reading request body: %v\n", err)
+		s.log(req.Context()).Errorf("reading webhook request body: %s", err)
 		w.WriteHeader(http.StatusServiceUnavailable)
 		return
 	}
@@ -168,64 +207,168 @@ func (s WebServer) handleStripeWebhook(w http.ResponseWriter, req *http.Request)
 	event := stripe.Event{}
 
 	if err := json.Unmarshal(payload, &event); err != nil {
-		fmt.Fprintf(os.Stderr, "⚠️  Webhook error while parsing basic request. %v\n", err.Error())
+		s.log(req.Context()).Errorf("parsing webhook request: %s", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
 	signatureHeader := req.Header.Get("Stripe-Signature")
-	event, err = webhook.ConstructEventWithOptions(payload, signatureHeader, s.stripeWebhookSigningSecret, webhook.ConstructEventOptions{
-		IgnoreAPIVersionMismatch: true, // TODO: fix this
-	})
+	event, err = s.billingProvider.ConstructEvent(payload, signatureHeader)
 	if err != nil {
-		s.logger.Error("webhook signature verification failed: %s", err.Error())
+		s.log(req.Context()).Errorf("webhook signature verification failed: %s", err)
 		w.WriteHeader(http.StatusBadRequest)
 		return
 	}
 
-	s.ddClient.Publish(req.Context(), datadog.CustomMetric{
-		MetricName:  datadog.MetricNameStripeWebhookEvent,
-		MetricValue: 1,
-		Tags: map[string]string{
-			"type": event.Type,
-		},
+	s.recorder.Count(req.Context(), metrics.NameStripeWebhookEvent, 1, metrics.Tags{"type": event.Type})
+
+	record, claimed, err := s.store.ClaimStripeEvent(req.Context(), account.StripeEvent{
+		ID:      event.ID,
+		Type:    event.Type,
+		Payload: payload,
 	})
+	if err != nil {
+		s.log(req.Context()).Errorf("recording stripe event %s: %s", event.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !claimed {
+		if record.Status == account.StripeEventStatusProcessed {
+			s.log(req.Context()).Infof("stripe event %s was already processed, skipping", event.ID)
+			w.WriteHeader(http.StatusOK)
+			return
+		}
+		// Stripe retries until it gets a 2xx, by then the delivery in
+		// progress will have finished
+		s.log(req.Context()).Infof("stripe event %s is being processed by another delivery, skipping", event.ID)
+		w.WriteHeader(http.StatusConflict)
+		return
+	}
+
+	err = s.processRecordedStripeEvent(req.Context(), record, event)
+	if err != nil {
+		s.log(req.Context()).Errorf("handling %s event %s: %s", event.Type, event.ID, err)
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+}
 
+// ReplayStripeEvent processes an event from the ledger again. Events that
+// were already processed, or are being processed, are refused.
+func (s WebServer) ReplayStripeEvent(ctx context.Context, id string) error {
+	record, err := s.store.GetStripeEvent(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	record, claimed, err := s.store.ClaimStripeEvent(ctx, record)
+	if err != nil {
+		return err
+	}
+	if !claimed {
+		return fmt.Errorf("stripe event %s is %s", id, record.Status)
+	}
+
+	var event stripe.Event
+	err = json.Unmarshal(record.Payload, &event)
+	if err != nil {
+		return fmt.Errorf("parsing stored event: %w", err)
+	}
+
+	return s.processRecordedStripeEvent(ctx, record, event)
+}
+
+// processRecordedStripeEvent processes an event and records the outcome in
+// the ledger.
+func (s WebServer) processRecordedStripeEvent(ctx context.Context, record account.StripeEvent, event stripe.Event) error {
+	err := s.processStripeEvent(ctx, event)
+
+	record.Attempts++
+	if err != nil {
+		record.Status = account.StripeEventStatusFailed
+		record.LastError = err.Error()
+	} else {
+		record.Status = account.StripeEventStatusProcessed
+		record.LastError = ""
+		record.ProcessedAt = time.Now()
+	}
+
+	updateErr := s.store.UpdateStripeEvent(ctx, record)
+	if updateErr != nil {
+		return errors.Join(err, fmt.Errorf("recording outcome of stripe event: %w", updateErr))
+	}
+
+	return err
+}
+
+// processStripeEvent hands a verified webhook event to the handler for its
+// type. Event types without a handler are ignored.
+func (s WebServer) processStripeEvent(ctx context.Context, event stripe.Event) error {
 	switch event.Type {
 	case "charge.succeeded":
-		s.logger.Info("charge.succeeded event received")
+		s.log(ctx).Info("charge.succeeded event received")
 		var charge stripe.Charge
 		err := json.Unmarshal(event.Data.Raw, &charge)
 		if err != nil {
-			fmt.Fprintf(os.Stderr, "Error parsing webhook JSON: %v\n", err)
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return fmt.Errorf("parsing charge: %w", err)
+		}
+		return s.handleChargeSucceeded(ctx, charge)
+
+	case "charge.refunded":
+		var charge stripe.Charge
+		err := json.Unmarshal(event.Data.Raw, &charge)
+		if err != nil {
+			return fmt.Errorf("parsing charge: %w", err)
 		}
+		return s.handleChargeRefunded(ctx, charge)
 
-		err = s.handleChargeSucceeded(req.Context(), charge)
+	case "invoice.paid":
+		var invoice stripe.Invoice
+		err := json.Unmarshal(event.Data.Raw, &invoice)
 		if err != nil {
-			s.logger.Errorf("handling charge succeeded: %s", err.Error())
-			w.WriteHeader(http.StatusBadRequest)
-			return
+			return fmt.Errorf("parsing invoice: %w", err)
+		}
+		return s.handleInvoicePaid(ctx, invoice)
+
+	case "invoice.payment_failed":
+		var invoice stripe.Invoice
+		err := json.Unmarshal(event.Data.Raw, &invoice)
+		if err != nil {
+			return fmt.Errorf("parsing invoice: %w", err)
+		}
+		return s.handleInvoicePaymentFailed(ctx, invoice)
+
+	case "customer.subscription.updated":
+		var sub stripe.Subscription
+		err := json.Unmarshal(event.Data.Raw, &sub)
+		if err != nil {
+			return fmt.Errorf("parsing subscription: %w", err)
 		}
+		return s.handleSubscriptionUpdated(ctx, sub)
 
-	default:
-		// fmt.Fprintf(os.Stderr, "Unhandled event type: %s\n", event.Type)
+	case "customer.subscription.deleted":
+		var sub stripe.Subscription
+		err := json.Unmarshal(event.Data.Raw, &sub)
+		if err != nil {
+			return fmt.Errorf("parsing subscription: %w", err)
+		}
+		return s.handleSubscriptionDeleted(ctx, sub)
 	}
 
-	w.WriteHeader(http.StatusOK)
+	return nil
 }
 
 func (s WebServer) handleChargeSucceeded(ctx context.Context, charge stripe.Charge) error {
-	s.ddClient.Publish(ctx, datadog.CustomMetric{
-		MetricName:  datadog.MetricNameProvision,
-		MetricValue: 1,
-		Tags: map[string]string{
-			"type": "github",
-		},
-	})
+	// subscription payments create their instance from invoice.paid
+	if charge.Invoice != nil {
+		return nil
+	}
+
+	s.recorder.Count(ctx, metrics.NameProvision, 1, metrics.Tags{"type": "github"})
 
-	a, err := s.postgresClient.GetAccountFromStripeCustID(s.cryptoUtil, charge.Customer.ID)
+	a, err := s.store.GetAccountFromStripeCustID(ctx, s.cryptoUtil, charge.Customer.ID)
 	if err != nil {
 		return fmt.Errorf("getting account from stripe customer id: %w", err)
 	}
@@ -248,10 +391,15 @@ func (s WebServer) handleChargeSucceeded(ctx context.Context, charge stripe.Char
 		Name:      instanceName,
 	}
 
-	s.logger.Infof("provisioning instance - (stripe customer: %s) (account id: %s) (instance id: %s)", charge.Customer.ID, a.UUID, instanceUUID)
-	err = s.postgresClient.CreateOrUpdateInstance(i)
+	i.ConfigVars, err = provisioner.GenerateConfigVars(i)
+	if err != nil {
+		return fmt.Errorf("generating config vars: %w", err)
+	}
+
+	s.log(ctx).Infof("provisioning instance - (stripe customer: %s) (account id: %s) (instance id: %s)", charge.Customer.ID, a.UUID, instanceUUID)
+	err = s.store.CreateOrUpdateInstance(ctx, s.cryptoUtil, i)
 	if err != nil {
-		s.logger.Errorf("creating instance: %s", err)
+		s.log(ctx).Errorf("creating instance: %s", err)
 		return fmt.Errorf("creating instance: %w", err)
 	}
 
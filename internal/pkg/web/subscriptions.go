@@ -0,0 +1,383 @@
+package web
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/metrics"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/provisioner"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v75"
+)
+
+const suspendInterval = 15 * time.Minute
+
+// cancellationOutcome is what happened to an instance's subscription when the
+// instance was deleted.
+type cancellationOutcome string
+
+const (
+	cancellationNone        cancellationOutcome = "none"
+	cancellationImmediate   cancellationOutcome = "cancelled"
+	cancellationAtPeriodEnd cancellationOutcome = "cancel_at_period_end"
+	cancellationFailed      cancellationOutcome = "failed"
+)
+
+// handleInvoicePaid creates the instance for a new subscription once its
+// first invoice is paid. For existing instances it settles a failed payment
+// and resumes the instance if it was suspended.
+func (s WebServer) handleInvoicePaid(ctx context.Context, inv stripe.Invoice) error {
+	if inv.Subscription == nil {
+		return nil
+	}
+
+	i, found, err := s.getSubscriptionInstance(ctx, inv.Subscription.ID)
+	if err != nil {
+		return err
+	}
+
+	if !found {
+		return s.createSubscriptionInstance(ctx, inv)
+	}
+
+	if i.Status == account.InstanceStatusPending {
+		return s.activateInstance(ctx, i)
+	}
+
+	return s.markInstancePaid(ctx, i)
+}
+
+// handleInvoicePaymentFailed starts the grace period for an instance whose
+// renewal failed. RunInstanceSuspender suspends it once the grace period is
+// over, unless a later payment succeeds.
+func (s WebServer) handleInvoicePaymentFailed(ctx context.Context, inv stripe.Invoice) error {
+	if inv.Subscription == nil {
+		return nil
+	}
+
+	i, found, err := s.getSubscriptionInstance(ctx, inv.Subscription.ID)
+	if err != nil || !found {
+		return err
+	}
+
+	return s.markPaymentFailed(ctx, i)
+}
+
+// handleSubscriptionUpdated keeps an instance in step with the status of its
+// subscription.
+func (s WebServer) handleSubscriptionUpdated(ctx context.Context, sub stripe.Subscription) error {
+	i, found, err := s.getSubscriptionInstance(ctx, sub.ID)
+	if err != nil || !found {
+		return err
+	}
+
+	billing := subscriptionFromStripe(&sub)
+	err = s.store.UpdateInstanceSubscription(ctx, i.AccountID, i.Id, *billing)
+	if err != nil {
+		return fmt.Errorf("updating instance subscription: %w", err)
+	}
+
+	switch sub.Status {
+	case stripe.SubscriptionStatusActive, stripe.SubscriptionStatusTrialing:
+		err = s.syncInstancePlan(ctx, i, billing.PriceID)
+		if err != nil {
+			return fmt.Errorf("changing plan: %w", err)
+		}
+		return s.markInstancePaid(ctx, i)
+	case stripe.SubscriptionStatusPastDue:
+		return s.markPaymentFailed(ctx, i)
+	case stripe.SubscriptionStatusUnpaid, stripe.SubscriptionStatusPaused:
+		return s.suspendInstance(ctx, i)
+	case stripe.SubscriptionStatusIncompleteExpired:
+		if i.Status == account.InstanceStatusPending {
+			return s.deprovisionInstance(ctx, i)
+		}
+		// an abandoned upgrade, the instance keeps its current plan
+		return s.store.UpdateInstanceSubscription(ctx, i.AccountID, i.Id, account.Subscription{})
+	}
+
+	return nil
+}
+
+// handleSubscriptionDeleted deprovisions the instance of a cancelled
+// subscription.
+func (s WebServer) handleSubscriptionDeleted(ctx context.Context, sub stripe.Subscription) error {
+	i, found, err := s.getSubscriptionInstance(ctx, sub.ID)
+	if err != nil || !found {
+		return err
+	}
+
+	return s.deprovisionInstance(ctx, i)
+}
+
+func (s WebServer) deprovisionInstance(ctx context.Context, i account.Instance) error {
+	s.recorder.Count(ctx, metrics.NameDeprovision, 1, metrics.Tags{"type": "github"})
+
+	err := provisioner.DeprovisionResource(i)
+	if err != nil {
+		return fmt.Errorf("deprovisioning resource: %w", err)
+	}
+
+	s.log(ctx).Infof("deprovisioning instance - (stripe subscription: %s) (account id: %s) (instance id: %s)", i.Subscription.ID, i.AccountID, i.Id)
+	err = s.store.DeleteInstance(ctx, i.AccountID, i.Id)
+	if err != nil {
+		return fmt.Errorf("deleting instance: %w", err)
+	}
+
+	return nil
+}
+
+// handleChargeRefunded suspends the instance paid for by a fully refunded
+// subscription charge. Partial refunds leave the instance running.
+func (s WebServer) handleChargeRefunded(ctx context.Context, charge stripe.Charge) error {
+	if !charge.Refunded {
+		return nil
+	}
+
+	if charge.Invoice == nil {
+		s.log(ctx).Infof("refunded charge %s is not for a subscription, nothing to suspend", charge.ID)
+		return nil
+	}
+
+	inv, err := s.billingProvider.GetInvoice(ctx, charge.Invoice.ID)
+	if err != nil {
+		return fmt.Errorf("getting invoice: %w", err)
+	}
+
+	if inv.Subscription == nil {
+		return nil
+	}
+
+	i, found, err := s.getSubscriptionInstance(ctx, inv.Subscription.ID)
+	if err != nil || !found {
+		return err
+	}
+
+	return s.suspendInstance(ctx, i)
+}
+
+// cancelInstanceSubscription stops billing for an instance that is being
+// deleted. Depending on configuration the subscription is cancelled straight
+// away or at the end of the paid period, in which case the instance keeps
+// running until then.
+func (s WebServer) cancelInstanceSubscription(ctx context.Context, i account.Instance) (cancellationOutcome, error) {
+	if i.Subscription == nil {
+		return cancellationNone, nil
+	}
+
+	switch stripe.SubscriptionStatus(i.Subscription.Status) {
+	case stripe.SubscriptionStatusCanceled, stripe.SubscriptionStatusIncompleteExpired:
+		return cancellationNone, nil
+	}
+
+	if i.Subscription.CancelAtPeriodEnd {
+		return cancellationAtPeriodEnd, nil
+	}
+
+	// nothing has been paid for an incomplete subscription so there is no
+	// period to keep running for
+	if s.cancelAtPeriodEnd && i.Subscription.Status != string(stripe.SubscriptionStatusIncomplete) {
+		sub, err := s.billingProvider.UpdateSubscription(ctx, i.Subscription.ID, &stripe.SubscriptionParams{
+			CancelAtPeriodEnd: stripe.Bool(true),
+		})
+		if err != nil {
+			return "", fmt.Errorf("scheduling cancellation: %w", err)
+		}
+
+		err = s.store.UpdateInstanceSubscription(ctx, i.AccountID, i.Id, *subscriptionFromStripe(sub))
+		if err != nil {
+			return "", fmt.Errorf("updating instance subscription: %w", err)
+		}
+
+		return cancellationAtPeriodEnd, nil
+	}
+
+	_, err := s.billingProvider.CancelSubscription(ctx, i.Subscription.ID)
+	if err != nil {
+		return "", fmt.Errorf("cancelling subscription: %w", err)
+	}
+
+	return cancellationImmediate, nil
+}
+
+// RunInstanceSuspender periodically suspends instances whose payment failed
+// longer ago than the payment grace period. It blocks until ctx is cancelled.
+func (s WebServer) RunInstanceSuspender(ctx context.Context) {
+	ticker := time.NewTicker(suspendInterval)
+	defer ticker.Stop()
+
+	for {
+		instances, err := s.store.GetInstancesWithFailedPayments(ctx, s.cryptoUtil, time.Now().Add(-s.paymentGracePeriod))
+		if err != nil {
+			s.log(ctx).Errorf("getting instances with failed payments: %s", err)
+		}
+
+		for _, i := range instances {
+			err := s.suspendInstance(ctx, i)
+			if err != nil {
+				s.log(ctx).Errorf("suspending instance %s: %s", i.Id, err)
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// activateInstance provisions a pending instance once the first invoice of
+// its subscription is paid.
+func (s WebServer) activateInstance(ctx context.Context, i account.Instance) error {
+	s.recorder.Count(ctx, metrics.NameProvision, 1, metrics.Tags{"type": "github"})
+
+	err := provisioner.ProvisionResource(i)
+	if err != nil {
+		return fmt.Errorf("provisioning resource: %w", err)
+	}
+
+	i, err = s.ensureConfigVars(ctx, i)
+	if err != nil {
+		return err
+	}
+
+	s.log(ctx).Infof("activating instance - (stripe subscription: %s) (account id: %s) (instance id: %s)", i.Subscription.ID, i.AccountID, i.Id)
+	return s.store.UpdateInstanceStatus(ctx, i.AccountID, i.Id, account.InstanceStatusActive)
+}
+
+// createSubscriptionInstance creates the instance for a subscription that
+// was paid for without a pending instance being recorded.
+func (s WebServer) createSubscriptionInstance(ctx context.Context, inv stripe.Invoice) error {
+	if inv.SubscriptionDetails == nil || inv.Customer == nil {
+		return fmt.Errorf("invoice %s has no subscription details", inv.ID)
+	}
+
+	instanceName, ok := inv.SubscriptionDetails.Metadata["name"]
+	if !ok {
+		return fmt.Errorf("name key in subscription metadata not found")
+	}
+
+	instancePlan, ok := inv.SubscriptionDetails.Metadata["plan"]
+	if !ok {
+		return fmt.Errorf("plan key in subscription metadata not found")
+	}
+
+	a, err := s.store.GetAccountFromStripeCustID(ctx, s.cryptoUtil, inv.Customer.ID)
+	if err != nil {
+		return fmt.Errorf("getting account from stripe customer id: %w", err)
+	}
+
+	s.recorder.Count(ctx, metrics.NameProvision, 1, metrics.Tags{"type": "github"})
+
+	i := account.Instance{
+		AccountID: a.UUID,
+		Id:        uuid.New().String(),
+		Plan:      instancePlan,
+		Name:      instanceName,
+		Subscription: &account.Subscription{
+			ID:     inv.Subscription.ID,
+			Status: string(stripe.SubscriptionStatusActive),
+		},
+	}
+
+	i.ConfigVars, err = provisioner.GenerateConfigVars(i)
+	if err != nil {
+		return fmt.Errorf("generating config vars: %w", err)
+	}
+
+	s.log(ctx).Infof("provisioning instance - (stripe subscription: %s) (account id: %s) (instance id: %s)", inv.Subscription.ID, a.UUID, i.Id)
+	err = s.store.CreateOrUpdateInstance(ctx, s.cryptoUtil, i)
+	if err != nil {
+		return fmt.Errorf("creating instance: %w", err)
+	}
+
+	return nil
+}
+
+// getSubscriptionInstance looks up the instance for a subscription. The bool
+// is false when no instance is linked to it, which is the case for
+// subscriptions whose first payment never succeeded.
+func (s WebServer) getSubscriptionInstance(ctx context.Context, subscriptionID string) (account.Instance, bool, error) {
+	i, err := s.store.GetInstanceFromStripeSubscriptionID(ctx, s.cryptoUtil, subscriptionID)
+	var notFoundErr *store.InstanceNotFound
+	if errors.As(err, &notFoundErr) {
+		return i, false, nil
+	}
+	if err != nil {
+		return i, false, fmt.Errorf("getting instance from subscription: %w", err)
+	}
+
+	return i, true, nil
+}
+
+// subscriptionFromStripe returns the billing state of a Stripe subscription
+// to store on its instance.
+func subscriptionFromStripe(sub *stripe.Subscription) *account.Subscription {
+	subscription := &account.Subscription{
+		ID:                sub.ID,
+		Status:            string(sub.Status),
+		CancelAtPeriodEnd: sub.CancelAtPeriodEnd,
+	}
+
+	if sub.Items != nil && len(sub.Items.Data) > 0 && sub.Items.Data[0].Price != nil {
+		subscription.PriceID = sub.Items.Data[0].Price.ID
+	}
+
+	if sub.CurrentPeriodEnd > 0 {
+		subscription.CurrentPeriodEnd = time.Unix(sub.CurrentPeriodEnd, 0)
+	}
+
+	return subscription
+}
+
+func (s WebServer) markInstancePaid(ctx context.Context, i account.Instance) error {
+	if !i.PaymentFailedAt.IsZero() {
+		err := s.store.UpdateInstancePaymentFailedAt(ctx, i.AccountID, i.Id, time.Time{})
+		if err != nil {
+			return err
+		}
+	}
+
+	if i.Status != account.InstanceStatusSuspended {
+		return nil
+	}
+
+	err := provisioner.ResumeResource(i)
+	if err != nil {
+		return fmt.Errorf("resuming resource: %w", err)
+	}
+
+	s.log(ctx).Infof("resuming instance %s", i.Id)
+	return s.store.UpdateInstanceStatus(ctx, i.AccountID, i.Id, account.InstanceStatusActive)
+}
+
+func (s WebServer) markPaymentFailed(ctx context.Context, i account.Instance) error {
+	// the grace period runs from the first failure
+	if !i.PaymentFailedAt.IsZero() {
+		return nil
+	}
+
+	s.log(ctx).Infof("payment failed for instance %s, suspending in %s unless paid", i.Id, s.paymentGracePeriod)
+	return s.store.UpdateInstancePaymentFailedAt(ctx, i.AccountID, i.Id, time.Now())
+}
+
+func (s WebServer) suspendInstance(ctx context.Context, i account.Instance) error {
+	if i.Status == account.InstanceStatusSuspended {
+		return nil
+	}
+
+	s.recorder.Count(ctx, metrics.NameSuspend, 1, metrics.Tags{"type": "github"})
+
+	err := provisioner.SuspendResource(i)
+	if err != nil {
+		return fmt.Errorf("suspending resource: %w", err)
+	}
+
+	s.log(ctx).Infof("suspending instance %s", i.Id)
+	return s.store.UpdateInstanceStatus(ctx, i.AccountID, i.Id, account.InstanceStatusSuspended)
+}
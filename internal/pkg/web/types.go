@@ -1,5 +1,7 @@
 package web
 
+import "time"
+
 type GithubAuth struct {
 	SessionSecret string
 }
@@ -11,3 +13,47 @@ type UserInfo struct {
 	Provenance string `json:"provenance"`
 	StripeID   string `json:"stripeID"`
 }
+
+type HerokuResourceResponse struct {
+	ID      string            `json:"id,omitempty"`
+	Message string            `json:"message"`
+	Config  map[string]string `json:"config,omitempty"`
+}
+
+type UnknownPlanResponse struct {
+	Error      string   `json:"error"`
+	Status     string   `json:"status,omitempty"`
+	Plan       string   `json:"plan"`
+	ValidPlans []string `json:"validPlans"`
+	RequestID  string   `json:"requestId,omitempty"`
+}
+
+type ErrorResponse struct {
+	Error     string `json:"error"`
+	Status    string `json:"status,omitempty"`
+	RequestID string `json:"requestId,omitempty"`
+}
+
+type Invoice struct {
+	ID          string    `json:"id"`
+	Number      string    `json:"number"`
+	Status      string    `json:"status"`
+	AmountDue   int64     `json:"amountDue"`
+	AmountPaid  int64     `json:"amountPaid"`
+	Currency    string    `json:"currency"`
+	Created     time.Time `json:"created"`
+	PeriodStart time.Time `json:"periodStart"`
+	PeriodEnd   time.Time `json:"periodEnd"`
+	HostedURL   string    `json:"hostedURL"`
+	PDF         string    `json:"pdf"`
+}
+
+type BillingPortalResponse struct {
+	Status string `json:"status"`
+	URL    string `json:"url"`
+}
+
+type InvoicesResponse struct {
+	Invoices []Invoice `json:"invoices"`
+	HasMore  bool      `json:"hasMore"`
+}
@@ -2,24 +2,27 @@ package web
 
 import (
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 
-	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/datadog"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/metrics"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store"
 )
 
 func (s WebServer) getUser(w http.ResponseWriter, req *http.Request) {
 	userInfo, err := s.getUserInfo(req)
 	if err != nil {
-		s.logger.Errorf("getting user info: %s", err)
-		http.Error(w, "could not get user", http.StatusBadRequest)
+		s.log(req.Context()).Errorf("getting user info: %s", err)
+		writeError(w, req, ErrorResponse{Error: "could not get user"}, http.StatusBadRequest)
 		return
 	}
 
 	uJson, err := json.Marshal(userInfo)
 	if err != nil {
-		s.logger.Errorf("marshalling user info to json: %s", err)
-		http.Error(w, "could not get user", http.StatusInternalServerError)
+		s.log(req.Context()).Errorf("marshalling user info to json: %s", err)
+		writeError(w, req, ErrorResponse{Error: "could not get user"}, http.StatusInternalServerError)
 		return
 	}
 
@@ -30,22 +33,22 @@ func (s WebServer) getInstances(w http.ResponseWriter, req *http.Request) {
 
 	userInfo, err := s.getUserInfo(req)
 	if err != nil {
-		s.logger.Errorf("getting user info: %s", err)
-		http.Error(w, "could not get user", http.StatusBadRequest)
+		s.log(req.Context()).Errorf("getting user info: %s", err)
+		writeError(w, req, ErrorResponse{Error: "could not get user"}, http.StatusBadRequest)
 		return
 	}
 
-	instances, err := s.postgresClient.GetInstances(userInfo.UserID)
+	instances, err := s.store.GetInstances(req.Context(), s.cryptoUtil, userInfo.UserID)
 	if err != nil {
-		s.logger.Errorf("getting instances from postgres: %s", err)
-		http.Error(w, "could not get instances", http.StatusInternalServerError)
+		s.log(req.Context()).Errorf("getting instances from postgres: %s", err)
+		writeError(w, req, ErrorResponse{Error: "could not get instances"}, http.StatusInternalServerError)
 		return
 	}
 
 	iJson, err := json.Marshal(instances)
 	if err != nil {
-		s.logger.Errorf("marshalling instances to json: %s", err)
-		http.Error(w, "could not get instances", http.StatusInternalServerError)
+		s.log(req.Context()).Errorf("marshalling instances to json: %s", err)
+		writeError(w, req, ErrorResponse{Error: "could not get instances"}, http.StatusInternalServerError)
 		return
 	}
 
@@ -53,53 +56,98 @@ func (s WebServer) getInstances(w http.ResponseWriter, req *http.Request) {
 }
 
 func (s WebServer) deleteInstance(w http.ResponseWriter, req *http.Request) {
-	s.ddClient.Publish(req.Context(), datadog.CustomMetric{
-		MetricName:  datadog.MetricNameDeleteInstance,
-		MetricValue: 1,
-		Tags: map[string]string{
-			"type": "github",
-		},
-	})
-
 	userInfo, err := s.getUserInfo(req)
 	if err != nil {
-		s.logger.Errorf("getting user info: %s", err)
-		http.Error(w, "could not get user", http.StatusBadRequest)
+		s.log(req.Context()).Errorf("getting user info: %s", err)
+		writeError(w, req, ErrorResponse{Error: "could not get user"}, http.StatusBadRequest)
 		return
 	}
 
 	if userInfo.Provenance == "heroku" {
-		s.logger.Errorf("heroku user cannot delete instances")
-		http.Error(w, `{"error":"heroku user cannot delete instances"}`, http.StatusBadRequest)
+		s.log(req.Context()).Errorf("heroku user cannot delete instances")
+		writeError(w, req, ErrorResponse{Error: "heroku user cannot delete instances"}, http.StatusBadRequest)
 		return
 	}
 
 	type instanceRequest struct {
 		Id string `json:"id"`
+		// Force deletes the instance even when its subscription could not be
+		// cancelled.
+		Force bool `json:"force"`
 	}
 	var ir instanceRequest
 	err = json.NewDecoder(req.Body).Decode(&ir)
 	if err != nil {
-		http.Error(w, `{"error":"parsing request"}`, http.StatusBadRequest)
+		writeError(w, req, ErrorResponse{Error: "parsing request"}, http.StatusBadRequest)
 		return
 	}
 
 	if ir.Id == "" {
-		http.Error(w, `{"error":"id is required"}`, http.StatusBadRequest)
+		writeError(w, req, ErrorResponse{Error: "id is required"}, http.StatusBadRequest)
 		return
 	}
 
-	err = s.postgresClient.DeleteInstance(userInfo.UserID, ir.Id)
+	i, err := s.store.GetInstance(req.Context(), s.cryptoUtil, userInfo.UserID, ir.Id)
+	var notFoundErr *store.InstanceNotFound
+	if errors.As(err, &notFoundErr) {
+		writeError(w, req, ErrorResponse{Error: "instance not found"}, http.StatusNotFound)
+		return
+	}
 	if err != nil {
-		s.logger.Errorf("deleting instance: %s", err)
-		http.Error(w, `{"error":"deleting instance"}`, http.StatusBadRequest)
+		s.log(req.Context()).Errorf("getting instance: %s", err)
+		writeError(w, req, ErrorResponse{Error: "deleting instance"}, http.StatusInternalServerError)
 		return
 	}
-	fmt.Fprint(w, `{"status":"success"}`)
+
+	deletion := account.InstanceDeletion{
+		AccountID:  i.AccountID,
+		InstanceID: i.Id,
+	}
+	if i.Subscription != nil {
+		deletion.SubscriptionID = i.Subscription.ID
+	}
+
+	outcome, err := s.cancelInstanceSubscription(req.Context(), i)
+	if err != nil {
+		if !ir.Force {
+			s.log(req.Context()).Errorf("cancelling subscription of instance %s: %s", i.Id, err)
+			writeError(w, req, ErrorResponse{Error: "cancelling subscription failed, retry or delete with force"}, http.StatusBadGateway)
+			return
+		}
+		s.log(req.Context()).Errorf("cancelling subscription of instance %s, deleting it anyway: %s", i.Id, err)
+		outcome = cancellationFailed
+		deletion.Error = err.Error()
+	}
+
+	s.recorder.Count(req.Context(), metrics.NameDeleteInstance, 1, metrics.Tags{"type": "github", "subscription": string(outcome)})
+	s.log(req.Context()).Infof("deleting instance %s, subscription cancellation: %s", i.Id, outcome)
+
+	// recorded before the instance is gone so that a subscription that may
+	// still be charging can be traced back to it
+	deletion.Outcome = string(outcome)
+	err = s.store.RecordInstanceDeletion(req.Context(), deletion)
+	if err != nil {
+		s.log(req.Context()).Errorf("recording deletion of instance %s: %s", i.Id, err)
+		writeError(w, req, ErrorResponse{Error: "deleting instance"}, http.StatusInternalServerError)
+		return
+	}
+
+	// the instance is deprovisioned by the customer.subscription.deleted
+	// webhook at the end of the period
+	if outcome != cancellationAtPeriodEnd {
+		err = s.store.DeleteInstance(req.Context(), userInfo.UserID, ir.Id)
+		if err != nil {
+			s.log(req.Context()).Errorf("deleting instance: %s", err)
+			writeError(w, req, ErrorResponse{Error: "deleting instance"}, http.StatusBadRequest)
+			return
+		}
+	}
+
+	fmt.Fprintf(w, `{"status":"success","subscription":"%s"}`, outcome)
 }
 
 func (s WebServer) getUserInfo(req *http.Request) (UserInfo, error) {
-	session, err := s.sessionStore.Get(req, "heroku-addon")
+	session, err := s.session(req)
 	if err != nil {
 		return UserInfo{}, fmt.Errorf("could not get session: %w", err)
 	}
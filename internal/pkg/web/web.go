@@ -8,22 +8,26 @@ import (
 	"net/http"
 	"os"
 	"strings"
+	"time"
 
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/billing"
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/config"
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/crypto"
-	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/datadog"
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/heroku"
-	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/postgres"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/metrics"
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/provisioner"
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/spa"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/tokenmanager"
 	"github.com/dghubble/gologin"
 	"github.com/dghubble/gologin/github"
 	oauth2Login "github.com/dghubble/gologin/oauth2"
 	"github.com/dghubble/sessions"
 	"github.com/google/uuid"
 	"github.com/stripe/stripe-go/v75"
-	"github.com/stripe/stripe-go/v75/customer"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel/propagation"
 	"golang.org/x/oauth2"
 	githubOAuth2 "golang.org/x/oauth2/github"
 
@@ -35,42 +39,63 @@ import (
 const (
 	post   = "post"
 	get    = "get"
+	put    = "put"
 	delete = "delete"
 )
 
 type ContextKey string
 
-const ContextProvenanceKey ContextKey = "provenance"
+const (
+	ContextProvenanceKey ContextKey = "provenance"
+	ContextRequestIDKey  ContextKey = "request-id"
+	ContextLoggerKey     ContextKey = "logger"
+	ContextSessionKey    ContextKey = "session"
+)
 
 type WebServer struct {
-	HttpServer                 *http.Server
-	cryptoUtil                 crypto.Util
-	postgresClient             postgres.Client
-	herokuClient               heroku.HerokuClient
-	ddClient                   datadog.Client
-	sessionStore               sessions.Store[string]
-	logger                     *zap.SugaredLogger
-	stripeKey                  string
-	stripeWebhookSigningSecret string
-	env                        string
+	HttpServer         *http.Server
+	cryptoUtil         crypto.Util
+	store              store.Store
+	herokuClient       heroku.HerokuClient
+	tokenManager       tokenmanager.Manager
+	recorder           metrics.Recorder
+	billingProvider    billing.Provider
+	sessionStore       sessions.Store[string]
+	logger             *zap.SugaredLogger
+	env                string
+	accountRetention   time.Duration
+	asyncProvisioning  bool
+	paymentGracePeriod time.Duration
+	cancelAtPeriodEnd  bool
+	pricing            account.PricingCatalog
+	portalReturnURL    string
 }
 
 func NewWebServer(logger *zap.SugaredLogger,
 	cfg config.Server,
 	cryptoUtil crypto.Util,
-	postgresClient postgres.Client,
+	dataStore store.Store,
 	herokuClient heroku.HerokuClient,
-	ddClient datadog.Client,
+	tokenManager tokenmanager.Manager,
+	recorder metrics.Recorder,
+	billingProvider billing.Provider,
+	pricing account.PricingCatalog,
 	env string) (WebServer, error) {
 	w := WebServer{
-		cryptoUtil:                 cryptoUtil,
-		postgresClient:             postgresClient,
-		herokuClient:               herokuClient,
-		ddClient:                   ddClient,
-		logger:                     logger,
-		stripeKey:                  cfg.Stripe.Key,
-		stripeWebhookSigningSecret: cfg.Stripe.WebhookSigningSecret,
-		env:                        env,
+		cryptoUtil:         cryptoUtil,
+		store:              dataStore,
+		herokuClient:       herokuClient,
+		tokenManager:       tokenManager,
+		recorder:           recorder,
+		logger:             logger,
+		billingProvider:    billingProvider,
+		env:                env,
+		accountRetention:   cfg.Heroku.AccountRetention,
+		asyncProvisioning:  cfg.Heroku.AsyncProvisioning,
+		paymentGracePeriod: cfg.Stripe.PaymentGracePeriod,
+		cancelAtPeriodEnd:  cfg.Stripe.CancelAtPeriodEnd,
+		pricing:            pricing,
+		portalReturnURL:    cfg.Stripe.PortalReturnURL,
 	}
 
 	oauth2Config := &oauth2.Config{
@@ -90,6 +115,7 @@ func NewWebServer(logger *zap.SugaredLogger,
 
 	// heroku
 	router.Handle("/heroku/resources", w.requireHerokuAuth(http.HandlerFunc(w.provisionHerokuHandler))).Methods(post)
+	router.Handle("/heroku/resources/{resource_uuid}", w.requireHerokuAuth(http.HandlerFunc(w.planChangeHerokuHandler))).Methods(put)
 	router.Handle("/heroku/resources/{resource_uuid}", w.requireHerokuAuth(http.HandlerFunc(w.deprovisionHerokuHandler))).Methods(delete)
 
 	store := sessions.NewCookieStore[string](
@@ -109,11 +135,22 @@ func NewWebServer(logger *zap.SugaredLogger,
 	router.Handle("/api/user", w.requireLogin(http.HandlerFunc(w.getUser))).Methods(get)
 	router.Handle("/api/pricing", http.HandlerFunc(w.getPricing)).Methods(get)
 	router.Handle("/api/instances", w.requireLogin(http.HandlerFunc(w.getInstances))).Methods(get)
+	router.Handle("/api/instances/{id}/plan", w.requireLogin(http.HandlerFunc(w.changeInstancePlan))).Methods(put)
 	router.Handle("/api/delete-instance", w.requireLogin(http.HandlerFunc(w.deleteInstance))).Methods(post)
+	router.Handle("/api/rotate-credentials", w.requireLogin(http.HandlerFunc(w.rotateCredentials))).Methods(post)
 	router.Handle("/api/create-payment-intent", w.requireLogin(http.HandlerFunc(w.newPaymentIntent))).Methods(post)
 	router.Handle("/api/create-subscription", w.requireLogin(http.HandlerFunc(w.createSubscription))).Methods(post)
+	router.Handle("/api/billing/portal", w.requireLogin(http.HandlerFunc(w.createBillingPortalSession))).Methods(post)
+	router.Handle("/api/billing/invoices", w.requireLogin(http.HandlerFunc(w.getInvoices))).Methods(get)
 	router.Handle("/stripe-webhooks", http.HandlerFunc(w.handleStripeWebhook)).Methods(post)
 
+	middleware := []gmux.MiddlewareFunc{w.loadSession, w.recordRequestMetrics, nameRequestSpan, w.requestLogging}
+	router.Use(middleware...)
+	// router middleware only runs for matched routes, the router's own 404
+	// and 405 responses are wrapped so that they are counted and logged too
+	router.NotFoundHandler = withMiddleware(http.NotFoundHandler(), middleware)
+	router.MethodNotAllowedHandler = withMiddleware(http.HandlerFunc(methodNotAllowed), middleware)
+
 	spa := spa.SpaHandler{
 		StaticPath: "frontend/build",
 		IndexPath:  "index.html",
@@ -122,10 +159,16 @@ func NewWebServer(logger *zap.SugaredLogger,
 	router.PathPrefix("/").Handler(w.requireLogin(spa))
 
 	addr := fmt.Sprintf("0.0.0.0:%s", cfg.Port)
-	logger.Infof("starting web server on address %s", addr)
 	server := &http.Server{
-		Handler: router,
-		Addr:    addr,
+		// incoming trace context is ignored, every request starts a new trace
+		// so that clients can't choose which requests are sampled
+		Handler: otelhttp.NewHandler(router, "http.request",
+			otelhttp.WithPropagators(propagation.NewCompositeTextMapPropagator()),
+			otelhttp.WithFilter(func(req *http.Request) bool {
+				return req.URL.Path != "/health"
+			}),
+		),
+		Addr: addr,
 	}
 
 	w.HttpServer = server
@@ -133,25 +176,19 @@ func NewWebServer(logger *zap.SugaredLogger,
 }
 
 func (s WebServer) herokuSSOHandler(w http.ResponseWriter, req *http.Request) {
-	s.ddClient.Publish(req.Context(), datadog.CustomMetric{
-		MetricName:  datadog.MetricNameLogin,
-		MetricValue: 1,
-		Tags: map[string]string{
-			"login_source": string(datadog.MetricTagHeroku),
-		},
-	})
+	s.recorder.Count(req.Context(), metrics.NameLogin, 1, metrics.Tags{"login_source": metrics.TagHeroku})
 
 	ssoUser, err := s.herokuClient.ValidateSSO(req)
 	if err != nil {
-		s.logger.Errorf("validating heroku sso: %s", err)
+		s.log(req.Context()).Errorf("validating heroku sso: %s", err)
 		w.WriteHeader(http.StatusForbidden)
 		w.Write([]byte(`<!DOCTYPE html><html><h1>forbidden</h1></html>`))
 		return
 	}
 
-	a, err := s.postgresClient.GetAccountFromEmail(s.cryptoUtil, ssoUser.Email, string(account.AccountTypeHeroku))
+	a, err := s.store.GetAccountFromEmail(req.Context(), s.cryptoUtil, ssoUser.Email, string(account.AccountTypeHeroku))
 	if err != nil {
-		s.logger.Errorf("getting heroku account from email: %s", err)
+		s.log(req.Context()).Errorf("getting heroku account from email: %s", err)
 		http.Redirect(w, req, "/login", http.StatusFound)
 		return
 	}
@@ -221,13 +258,7 @@ func (s WebServer) tmpHandler(w http.ResponseWriter, req *http.Request) {
 
 func (s WebServer) loginGithub(w http.ResponseWriter, req *http.Request) {
 	ctx := req.Context()
-	s.ddClient.Publish(req.Context(), datadog.CustomMetric{
-		MetricName:  datadog.MetricNameLogin,
-		MetricValue: 1,
-		Tags: map[string]string{
-			"login_source": string(datadog.MetricTagGithub),
-		},
-	})
+	s.recorder.Count(req.Context(), metrics.NameLogin, 1, metrics.Tags{"login_source": metrics.TagGithub})
 
 	user, err := github.UserFromContext(ctx)
 	if err != nil {
@@ -261,11 +292,10 @@ func (s WebServer) loginGithub(w http.ResponseWriter, req *http.Request) {
 		userName = "Github User"
 	}
 
-	a, err := s.postgresClient.GetAccountFromEmail(s.cryptoUtil, email, string(account.AccountTypeGithub))
+	a, err := s.store.GetAccountFromEmail(req.Context(), s.cryptoUtil, email, string(account.AccountTypeGithub))
 	if err != nil {
-		var noAcctErr *postgres.AccountNotFound
+		var noAcctErr *store.AccountNotFound
 		if errors.As(err, &noAcctErr) {
-			stripe.Key = s.stripeKey
 			params := &stripe.CustomerParams{
 				Name:  stripe.String(userName),
 				Email: stripe.String(email),
@@ -273,9 +303,9 @@ func (s WebServer) loginGithub(w http.ResponseWriter, req *http.Request) {
 					"env": s.env,
 				},
 			}
-			cust, err := customer.New(params)
+			cust, err := s.billingProvider.CreateCustomer(req.Context(), params)
 			if err != nil {
-				s.logger.Errorf("creating new stripe customer: %s", err)
+				s.log(req.Context()).Errorf("creating new stripe customer: %s", err)
 				http.Redirect(w, req, "/login", http.StatusFound)
 				return
 			}
@@ -291,14 +321,14 @@ func (s WebServer) loginGithub(w http.ResponseWriter, req *http.Request) {
 				StripeCustID: cust.ID,
 			}
 
-			err = s.postgresClient.CreateOrUpdateAccount(s.cryptoUtil, a)
+			err = s.store.CreateOrUpdateAccount(req.Context(), s.cryptoUtil, a)
 			if err != nil {
-				s.logger.Errorf("creating new account: %s", err)
+				s.log(req.Context()).Errorf("creating new account: %s", err)
 				http.Redirect(w, req, "/login", http.StatusFound)
 				return
 			}
 		} else {
-			s.logger.Errorf("getting account from email: %s", err)
+			s.log(req.Context()).Errorf("getting account from email: %s", err)
 			http.Redirect(w, req, "/login", http.StatusFound)
 			return
 		}
@@ -311,7 +341,7 @@ func (s WebServer) loginGithub(w http.ResponseWriter, req *http.Request) {
 	session.Set("stripe-id", a.StripeCustID)
 	session.Set("provenance", "github")
 	if err := session.Save(w); err != nil {
-		s.logger.Errorf("saving session: %s", err)
+		s.log(req.Context()).Errorf("saving session: %s", err)
 		http.Redirect(w, req, "/login", http.StatusFound)
 		return
 	}
@@ -329,7 +359,7 @@ func (s WebServer) logout() http.Handler {
 
 func (s WebServer) requireLogin(next http.Handler) http.Handler {
 	fn := func(w http.ResponseWriter, r *http.Request) {
-		session, err := s.sessionStore.Get(r, "heroku-addon")
+		session, err := s.session(r)
 
 		if err != nil {
 			// s.logger.Errorf("could not get session: %s", err)
@@ -339,7 +369,7 @@ func (s WebServer) requireLogin(next http.Handler) http.Handler {
 
 		provenance, ok := session.GetOk("provenance")
 		if !ok {
-			s.logger.Errorf("could not get provenance from context")
+			s.log(r.Context()).Errorf("could not get provenance from context")
 			http.Redirect(w, r, "/login", http.StatusFound)
 			return
 		}
@@ -350,7 +380,7 @@ func (s WebServer) requireLogin(next http.Handler) http.Handler {
 
 		_, present := session.GetOk("user-email")
 		if !present {
-			s.logger.Errorf("could not get user-email: %s", err)
+			s.log(r.Context()).Errorf("could not get user-email")
 			http.Redirect(w, req, "/login", http.StatusFound)
 			return
 		}
@@ -362,115 +392,205 @@ func (s WebServer) requireLogin(next http.Handler) http.Handler {
 }
 
 func (s WebServer) provisionHerokuHandler(w http.ResponseWriter, req *http.Request) {
-	s.logger.Infof("got request for new provisioning")
-	s.ddClient.Publish(req.Context(), datadog.CustomMetric{
-		MetricName:  datadog.MetricNameProvision,
-		MetricValue: 1,
-		Tags: map[string]string{
-			"type": "heroku",
-		},
-	})
+	s.log(req.Context()).Infof("got request for new provisioning")
+	s.recorder.Count(req.Context(), metrics.NameProvision, 1, metrics.Tags{"type": "heroku"})
 
 	var payload heroku.PlanProvisionPayload
 	err := json.NewDecoder(req.Body).Decode(&payload)
 	if err != nil {
-		s.logger.Errorf("Error parsing payload: %s", err)
-		http.Error(w, `{"error":"Error parsing request","status":"failed"}`, http.StatusBadRequest)
+		s.log(req.Context()).Errorf("Error parsing payload: %s", err)
+		writeError(w, req, ErrorResponse{Error: "Error parsing request", Status: "failed"}, http.StatusBadRequest)
 		return
 	}
 
-	s.logger.Infof("starting provision process for %s", payload.UUID)
-
-	oauthResp, err := s.herokuClient.ExchangeToken(payload.OauthGrant.Code)
+	pricingPlan, err := s.pricing.LookupHerokuPlan(payload.Plan)
 	if err != nil {
-		s.logger.Errorf("error exchanging token: %s", err)
-		emptyOauthResp := heroku.OauthResponse{}
-		if oauthResp != emptyOauthResp {
-			s.logger.Errorf("token response: %s", oauthResp)
-		}
-		http.Error(w, `{"error":"error exchanging token","status":"failed"}`, http.StatusBadRequest)
+		s.log(req.Context()).Errorf("provisioning %s: %s", payload.UUID, err)
+		s.writeUnknownPlan(w, req, err, true)
 		return
 	}
 
-	addonInfo, err := s.herokuClient.GetAppAddonInfo(oauthResp.AccessToken)
-	if err != nil {
-		s.logger.Errorf("error getting app id: %s", err)
-		http.Error(w, `{"error":"error provisioning","status":"failed"}`, http.StatusInternalServerError)
+	s.log(req.Context()).Infof("starting provision process for %s", payload.UUID)
+
+	if s.asyncProvisioning {
+		job := account.ProvisioningJob{
+			ResourceUUID: payload.UUID,
+			Plan:         pricingPlan.Name,
+			Region:       payload.Region,
+			OauthCode:    payload.OauthGrant.Code,
+			Status:       account.ProvisioningJobStatusPending,
+		}
+		err = s.store.CreateProvisioningJob(req.Context(), s.cryptoUtil, job)
+		if err != nil {
+			s.log(req.Context()).Errorf("error creating provisioning job: %s", err)
+			writeError(w, req, ErrorResponse{Error: "error provisioning", Status: "failed"}, http.StatusInternalServerError)
+			return
+		}
+
+		s.writeHerokuResponse(w, req, http.StatusAccepted, HerokuResourceResponse{
+			ID:      payload.UUID,
+			Message: "provisioning",
+		})
 		return
 	}
 
-	ownerEmail, err := heroku.GetOwnerEmail(oauthResp.AccessToken, addonInfo.App.Id)
+	instance, err := s.completeHerokuProvisioning(req.Context(), payload.UUID, pricingPlan.Name, payload.OauthGrant.Code)
 	if err != nil {
-		s.logger.Errorf("error getting owner email: %s", err)
-		http.Error(w, `{"error":"error provisioning","status":"failed"}`, http.StatusInternalServerError)
+		s.log(req.Context()).Errorf("error provisioning %s: %s", payload.UUID, err)
+		if errors.Is(err, errTokenExchange) {
+			writeError(w, req, ErrorResponse{Error: "error exchanging token", Status: "failed"}, http.StatusBadRequest)
+			return
+		}
+		writeError(w, req, ErrorResponse{Error: "error provisioning", Status: "failed"}, http.StatusInternalServerError)
 		return
 	}
 
-	acct := account.Account{
-		UUID:         payload.UUID,
-		Email:        ownerEmail,
-		Name:         addonInfo.App.Name,
-		AccountType:  account.AccountTypeHeroku,
-		AccessToken:  oauthResp.AccessToken,
-		RefreshToken: oauthResp.RefreshToken,
-		StripeCustID: "", // payment handled by Heroku, not required
-	}
-	err = s.postgresClient.CreateOrUpdateAccount(s.cryptoUtil, acct)
+	s.writeHerokuResponse(w, req, http.StatusOK, HerokuResourceResponse{
+		ID:      payload.UUID,
+		Message: "Your add-on is provisioned!",
+		Config:  instance.ConfigVars,
+	})
+}
+
+func (s WebServer) planChangeHerokuHandler(w http.ResponseWriter, req *http.Request) {
+	s.log(req.Context()).Infof("got request to change addon plan")
+	s.recorder.Count(req.Context(), metrics.NamePlanChange, 1, metrics.Tags{"type": "heroku"})
+
+	resourceUUID := gmux.Vars(req)["resource_uuid"]
+
+	var payload heroku.PlanChangePayload
+	err := json.NewDecoder(req.Body).Decode(&payload)
 	if err != nil {
-		s.logger.Errorf("error creating account: %s", err)
-		http.Error(w, `{"error":"error provisioning","status":"failed"}`, http.StatusInternalServerError)
+		s.log(req.Context()).Errorf("Error parsing payload: %s", err)
+		writeError(w, req, ErrorResponse{Error: "Error parsing request", Status: "failed"}, http.StatusBadRequest)
 		return
 	}
 
-	idAndName := uuid.New().String()
-	a := account.Instance{
-		AccountID: payload.UUID,
-		Id:        idAndName,
-		Plan:      payload.Plan,
-		Name:      idAndName,
+	pricingPlan, err := s.pricing.LookupHerokuPlan(payload.Plan)
+	if err != nil {
+		s.log(req.Context()).Errorf("changing plan for %s: %s", resourceUUID, err)
+		s.writeUnknownPlan(w, req, err, true)
+		return
 	}
 
-	err = s.postgresClient.CreateOrUpdateInstance(a)
+	instances, err := s.store.GetInstances(req.Context(), s.cryptoUtil, resourceUUID)
 	if err != nil {
-		s.logger.Errorf("error creating instance: %s", err)
-		http.Error(w, `{"error":"saving instance to database","status":"failed"}`, http.StatusInternalServerError)
+		s.log(req.Context()).Errorf("error getting instances: %s", err)
+		writeError(w, req, ErrorResponse{Error: "error changing plan", Status: "failed"}, http.StatusInternalServerError)
 		return
 	}
 
-	err = provisioner.ProvisionResource()
-	if err != nil {
-		s.logger.Errorf("error provisioning resource: %s", err)
-		http.Error(w, `{"error":"error provisioning","status":"failed"}`, http.StatusInternalServerError)
+	if len(instances) == 0 {
+		s.log(req.Context()).Errorf("no instances found for resource %s", resourceUUID)
+		writeError(w, req, ErrorResponse{Error: "resource not found", Status: "failed"}, http.StatusNotFound)
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
-	// w.WriteHeader(http.StatusBadRequest)
-	w.Write([]byte(fmt.Sprintf(`{"id":"%s","message":"Your add-on is provisioned!","config": { "TESTING": "hello" }
-	}`, payload.UUID)))
+	s.log(req.Context()).Infof("changing plan for %s to %s", resourceUUID, pricingPlan.Name)
+
+	var config map[string]string
+	for _, i := range instances {
+		err = s.store.UpdateInstancePlan(req.Context(), i.AccountID, i.Id, pricingPlan.Name)
+		if err != nil {
+			s.log(req.Context()).Errorf("error updating instance plan: %s", err)
+			writeError(w, req, ErrorResponse{Error: "error changing plan", Status: "failed"}, http.StatusInternalServerError)
+			return
+		}
+
+		i.Plan = pricingPlan.Name
+		err = provisioner.ProvisionResource(i)
+		if err != nil {
+			s.log(req.Context()).Errorf("error provisioning resource: %s", err)
+			writeError(w, req, ErrorResponse{Error: "error changing plan", Status: "failed"}, http.StatusInternalServerError)
+			return
+		}
+
+		i, err = s.ensureConfigVars(req.Context(), i)
+		if err != nil {
+			s.log(req.Context()).Errorf("error getting config vars: %s", err)
+			writeError(w, req, ErrorResponse{Error: "error changing plan", Status: "failed"}, http.StatusInternalServerError)
+			return
+		}
+
+		// the response also sets config vars, pushing them keeps the app
+		// up to date if Heroku has already given up on this request
+		err = s.pushHerokuConfigVars(req.Context(), i)
+		if err != nil {
+			s.log(req.Context()).Errorf("error pushing config vars: %s", err)
+		}
+		config = i.ConfigVars
+	}
+
+	s.writeHerokuResponse(w, req, http.StatusOK, HerokuResourceResponse{
+		Message: fmt.Sprintf("Your add-on plan has been changed to %s.", pricingPlan.Name),
+		Config:  config,
+	})
 }
 
 func (s WebServer) deprovisionHerokuHandler(w http.ResponseWriter, req *http.Request) {
-	s.logger.Infof("got request to delete addon")
-	s.ddClient.Publish(req.Context(), datadog.CustomMetric{
-		MetricName:  datadog.MetricNameDeprovision,
-		MetricValue: 1,
-		Tags: map[string]string{
-			"type": "heroku",
-		},
-	})
+	s.log(req.Context()).Infof("got request to delete addon")
+	s.recorder.Count(req.Context(), metrics.NameDeprovision, 1, metrics.Tags{"type": "heroku"})
 
-	vars := gmux.Vars(req)
+	resourceUUID := gmux.Vars(req)["resource_uuid"]
+	s.log(req.Context()).Infow("deleting heroku addon instance", "resource_uuid", resourceUUID)
 
-	s.logger.Infof("deleting heroku addon instance", "resource_uuid", vars["resource_uuid"])
+	a, err := s.store.GetAccount(req.Context(), s.cryptoUtil, resourceUUID)
+	if err != nil {
+		var noAcctErr *store.AccountNotFound
+		if errors.As(err, &noAcctErr) {
+			s.log(req.Context()).Errorf("account not found for resource %s", resourceUUID)
+			writeError(w, req, ErrorResponse{Error: "resource not found", Status: "failed"}, http.StatusGone)
+			return
+		}
+		s.log(req.Context()).Errorf("error getting account: %s", err)
+		writeError(w, req, ErrorResponse{Error: "error deprovisioning", Status: "failed"}, http.StatusInternalServerError)
+		return
+	}
 
-	// delete instance
-	// keep account in case return customer?
+	if !a.DeprovisionedAt.IsZero() {
+		s.log(req.Context()).Infof("resource %s was already deprovisioned at %s", resourceUUID, a.DeprovisionedAt)
+		writeError(w, req, ErrorResponse{Error: "resource already deprovisioned", Status: "failed"}, http.StatusGone)
+		return
+	}
 
-	w.WriteHeader(http.StatusNoContent)
-	// TODO: add correct id
-	w.Write([]byte(`{"id":"hello","message":"Your add-on has been deleted."}`))
+	instances, err := s.store.GetInstances(req.Context(), s.cryptoUtil, a.UUID)
+	if err != nil {
+		s.log(req.Context()).Errorf("error getting instances: %s", err)
+		writeError(w, req, ErrorResponse{Error: "error deprovisioning", Status: "failed"}, http.StatusInternalServerError)
+		return
+	}
 
+	for _, i := range instances {
+		err = provisioner.DeprovisionResource(i)
+		if err != nil {
+			s.log(req.Context()).Errorf("error deprovisioning resource %s: %s", i.Id, err)
+			writeError(w, req, ErrorResponse{Error: "error deprovisioning", Status: "failed"}, http.StatusInternalServerError)
+			return
+		}
+	}
+
+	err = s.store.DeleteInstances(req.Context(), a.UUID)
+	if err != nil {
+		s.log(req.Context()).Errorf("error deleting instances: %s", err)
+		writeError(w, req, ErrorResponse{Error: "error deprovisioning", Status: "failed"}, http.StatusInternalServerError)
+		return
+	}
+
+	if s.accountRetention > 0 {
+		err = s.store.DeprovisionAccount(req.Context(), s.cryptoUtil, a.UUID)
+	} else {
+		err = s.store.DeleteAccout(req.Context(), a.UUID)
+	}
+	if err != nil {
+		s.log(req.Context()).Errorf("error removing account: %s", err)
+		writeError(w, req, ErrorResponse{Error: "error deprovisioning", Status: "failed"}, http.StatusInternalServerError)
+		return
+	}
+
+	s.writeHerokuResponse(w, req, http.StatusOK, HerokuResourceResponse{
+		ID:      a.UUID,
+		Message: "Your add-on has been deleted.",
+	})
 }
 
 func (s *WebServer) requireHerokuAuth(next http.Handler) http.Handler {
@@ -484,15 +604,28 @@ func (s *WebServer) requireHerokuAuth(next http.Handler) http.Handler {
 	return http.HandlerFunc(fn)
 }
 
+func (s WebServer) writeHerokuResponse(w http.ResponseWriter, req *http.Request, statusCode int, resp HerokuResourceResponse) {
+	j, err := json.Marshal(resp)
+	if err != nil {
+		s.log(req.Context()).Errorf("marshalling heroku response: %s", err)
+		writeError(w, req, ErrorResponse{Error: "internal error", Status: "failed"}, http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(statusCode)
+	w.Write(j)
+}
+
 func healthHandler(w http.ResponseWriter, req *http.Request) {
 	fmt.Fprintf(w, `ok`)
 }
 
 func (s WebServer) getPricing(w http.ResponseWriter, req *http.Request) {
-	plans, err := json.Marshal(account.PricingPlans)
+	plans, err := json.Marshal(s.pricing.Plans())
 	if err != nil {
-		s.logger.Errorf("marshalling pricing plans to json: %s", err)
-		http.Error(w, "could not get pricing", http.StatusInternalServerError)
+		s.log(req.Context()).Errorf("marshalling pricing plans to json: %s", err)
+		writeError(w, req, ErrorResponse{Error: "could not get pricing"}, http.StatusInternalServerError)
 		return
 	}
 	fmt.Fprint(w, string(plans))
@@ -0,0 +1,15 @@
+package web_test
+
+import (
+	"testing"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store/memory"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/web/webtest"
+)
+
+func TestHerokuAddon(t *testing.T) {
+	webtest.Run(t, func(t *testing.T) store.Store {
+		return memory.NewStore()
+	})
+}
@@ -0,0 +1,1142 @@
+// Package webtest is an integration suite that drives the Heroku add-on and
+// GitHub billing flows through the web server's router, with the Heroku APIs
+// served by heroku/fake and billing by billing/fake. Every store.Store implementation
+// the server runs against should have a test that calls Run.
+package webtest
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/billing/fake"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/config"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/crypto"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/heroku"
+	herokufake "github.com/andrewmarklloyd/heroku-addon/internal/pkg/heroku/fake"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/metrics"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/provisioner"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/store"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/tokenmanager"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/web"
+	"github.com/dghubble/sessions"
+	"github.com/google/uuid"
+	"github.com/stripe/stripe-go/v75"
+	"go.uber.org/zap/zaptest"
+)
+
+const (
+	testEncryptionKey = "0123456789abcdef0123456789abcdef"
+	addonUsername     = "alloyd-test"
+	addonPassword     = "addon-password"
+	clientSecret      = "client-secret"
+	ssoSalt           = "sso-salt"
+)
+
+var ctx = context.Background()
+
+// Run runs the suite. newStore is called once per subtest and must return a
+// store with no data in it.
+func Run(t *testing.T, newStore func(t *testing.T) store.Store) {
+	tests := []struct {
+		name string
+		opts options
+		fn   func(t *testing.T, h *harness)
+	}{
+		{"ProvisionSSODeprovision", options{}, testProvisionSSODeprovision},
+		{"ProvisionUnknownPlan", options{}, testProvisionUnknownPlan},
+		{"ProvisionTokenExchangeFails", options{}, testProvisionTokenExchangeFails},
+		{"ProvisionHerokuAPIFails", options{}, testProvisionHerokuAPIFails},
+		{"ProvisionRetry", options{}, testProvisionRetry},
+		{"AsyncProvisionSSODeprovision", options{async: true}, testAsyncProvisionSSODeprovision},
+		{"AsyncProvisionRetry", options{async: true}, testAsyncProvisionRetry},
+		{"SSOInvalidToken", options{}, testSSOInvalidToken},
+		{"PlanChangePushesConfigVars", options{}, testPlanChangePushesConfigVars},
+		{"DeprovisionUnknownResource", options{}, testDeprovisionUnknownResource},
+		{"SubscribeThroughWebhooks", options{}, testSubscribeThroughWebhooks},
+		{"WebhookDeliveredTwice", options{}, testWebhookDeliveredTwice},
+		{"WebhookConcurrentDelivery", options{}, testWebhookConcurrentDelivery},
+		{"WebhookReplayFailedEvent", options{}, testWebhookReplayFailedEvent},
+		{"ChangePlanSwapsPrice", options{}, testChangePlanSwapsPrice},
+		{"DeleteInstanceCancelsSubscription", options{}, testDeleteInstanceCancelsSubscription},
+		{"DeleteInstanceCancellationFails", options{}, testDeleteInstanceCancellationFails},
+		{"DeleteInstanceAtPeriodEnd", options{cancelAtPeriodEnd: true}, testDeleteInstanceAtPeriodEnd},
+	}
+
+	for _, tc := range tests {
+		tc := tc
+		t.Run(tc.name, func(t *testing.T) {
+			tc.fn(t, newHarness(t, newStore(t), tc.opts))
+		})
+	}
+}
+
+// options configures the web server a test runs against.
+type options struct {
+	// async enables async provisioning, the test runs the worker itself.
+	async bool
+	// cancelAtPeriodEnd keeps deleted instances running until the end of
+	// their paid period.
+	cancelAtPeriodEnd bool
+}
+
+// harness is a web server wired to fakes, and the fakes and store behind it.
+type harness struct {
+	server  web.WebServer
+	handler http.Handler
+	// url is where the handler is served, for webhooks sent by the billing
+	// fake.
+	url          string
+	heroku       *herokufake.Server
+	billing      *fake.Provider
+	store        store.Store
+	crypto       crypto.Util
+	sessionStore sessions.Store[string]
+}
+
+func newHarness(t *testing.T, dataStore store.Store, opts options) *harness {
+	t.Helper()
+
+	logger := zaptest.NewLogger(t).Sugar()
+
+	cryptoUtil, err := crypto.NewUtil(testEncryptionKey)
+	if err != nil {
+		t.Fatalf("creating crypto util: %s", err)
+	}
+
+	herokuServer := herokufake.NewServer(clientSecret, ssoSalt)
+	t.Cleanup(herokuServer.Close)
+
+	herokuClient := heroku.NewHerokuClient(heroku.ClientConfig{
+		ClientSecret:  clientSecret,
+		AddonUsername: addonUsername,
+		AddonPassword: addonPassword,
+		SSOSalt:       ssoSalt,
+		APIURL:        herokuServer.URL(),
+		IdentityURL:   herokuServer.URL(),
+		Timeout:       5 * time.Second,
+	})
+
+	pricing, err := account.NewPricingCatalog([]account.PricingPlan{
+		{Name: "free", DisplayName: "Free", PriceID: "price_free", HerokuPlan: "free"},
+		{Name: "production", DisplayName: "Production", PriceID: "price_production", PriceDollars: 50, HerokuPlan: "production"},
+	})
+	if err != nil {
+		t.Fatalf("creating pricing catalog: %s", err)
+	}
+
+	billingProvider := fake.NewProvider("whsec_test")
+	billingProvider.AddPrice("price_free", 0)
+	billingProvider.AddPrice("price_production", 5000)
+
+	cfg := config.Server{
+		SessionSecret: config.SessionSecret{
+			HashKey:       "0123456789abcdef0123456789abcdef",
+			EncryptionKey: "abcdef0123456789abcdef0123456789",
+		},
+		Heroku: config.Heroku{
+			AddonUsername:     addonUsername,
+			AddonPassword:     addonPassword,
+			ClientSecret:      clientSecret,
+			SSOSalt:           ssoSalt,
+			AccountRetention:  24 * time.Hour,
+			AsyncProvisioning: opts.async,
+		},
+		Stripe: config.Stripe{
+			CancelAtPeriodEnd: opts.cancelAtPeriodEnd,
+		},
+	}
+
+	tokenManager := tokenmanager.NewManager(logger, cryptoUtil, dataStore, herokuClient)
+	server, err := web.NewWebServer(logger, cfg, cryptoUtil, dataStore, herokuClient, tokenManager, metrics.Noop{}, billingProvider, pricing, "test")
+	if err != nil {
+		t.Fatalf("creating web server: %s", err)
+	}
+
+	httpServer := httptest.NewServer(server.HttpServer.Handler)
+	t.Cleanup(httpServer.Close)
+
+	return &harness{
+		server:  server,
+		handler: server.HttpServer.Handler,
+		url:     httpServer.URL,
+		heroku:  herokuServer,
+		billing: billingProvider,
+		store:   dataStore,
+		crypto:  cryptoUtil,
+		sessionStore: sessions.NewCookieStore[string](
+			sessions.DefaultCookieConfig,
+			[]byte(cfg.SessionSecret.HashKey),
+			[]byte(cfg.SessionSecret.EncryptionKey),
+		),
+	}
+}
+
+// do sends req through the router and returns the recorded response.
+func (h *harness) do(req *http.Request) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	h.handler.ServeHTTP(rec, req)
+	return rec
+}
+
+// runProvisioningWorker runs the async provisioning worker until the test
+// ends.
+func (h *harness) runProvisioningWorker(t *testing.T) {
+	t.Helper()
+
+	workerCtx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.server.RunProvisioningWorker(workerCtx)
+	}()
+	t.Cleanup(func() {
+		cancel()
+		<-done
+	})
+}
+
+// waitFor polls cond until it returns true, failing the test if it doesn't
+// within a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// herokuRequest makes a request the way Heroku calls the add-on partner API.
+func (h *harness) herokuRequest(t *testing.T, method, path string, payload any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		t.Fatalf("marshalling payload: %s", err)
+	}
+
+	req := httptest.NewRequest(method, path, strings.NewReader(string(body)))
+	req.Header.Set("Content-Type", "application/json")
+	req.SetBasicAuth(addonUsername, addonPassword)
+	return h.do(req)
+}
+
+func (h *harness) provision(t *testing.T, resourceUUID, plan, code string) *httptest.ResponseRecorder {
+	t.Helper()
+
+	return h.herokuRequest(t, http.MethodPost, "/heroku/resources", heroku.PlanProvisionPayload{
+		Plan:   plan,
+		Region: "amazon-web-services::us-east-1",
+		UUID:   resourceUUID,
+		OauthGrant: heroku.OauthGrant{
+			Code:      code,
+			ExpiresAt: time.Now().Add(5 * time.Minute).Format(time.RFC3339),
+			Type:      "authorization_code",
+		},
+	})
+}
+
+func (h *harness) sso(form url.Values) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodPost, "/heroku/sso/login", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	return h.do(req)
+}
+
+// githubLogin creates a GitHub account with a Stripe customer and returns it
+// with the session cookies the GitHub login would have set.
+func (h *harness) githubLogin(t *testing.T) (account.Account, []*http.Cookie) {
+	t.Helper()
+
+	id := uuid.New().String()
+	email := "user-" + id[:8] + "@example.com"
+	cust, err := h.billing.CreateCustomer(ctx, &stripe.CustomerParams{
+		Name:  stripe.String("Github User"),
+		Email: stripe.String(email),
+	})
+	if err != nil {
+		t.Fatalf("creating stripe customer: %s", err)
+	}
+
+	a := account.Account{
+		UUID:         id,
+		Email:        email,
+		Name:         "Github User",
+		AccountType:  account.AccountTypeGithub,
+		StripeCustID: cust.ID,
+	}
+	err = h.store.CreateOrUpdateAccount(ctx, h.crypto, a)
+	if err != nil {
+		t.Fatalf("creating account: %s", err)
+	}
+
+	session := h.sessionStore.New("heroku-addon")
+	session.Set("user-email", a.Email)
+	session.Set("user-id", a.UUID)
+	session.Set("user-name", a.Name)
+	session.Set("stripe-id", a.StripeCustID)
+	session.Set("provenance", "github")
+	rec := httptest.NewRecorder()
+	err = session.Save(rec)
+	if err != nil {
+		t.Fatalf("saving session: %s", err)
+	}
+
+	return a, rec.Result().Cookies()
+}
+
+// userRequest makes a request to the user API with the session cookies of a
+// logged in user.
+func (h *harness) userRequest(t *testing.T, cookies []*http.Cookie, method, path string, payload any) *httptest.ResponseRecorder {
+	t.Helper()
+
+	var body string
+	if payload != nil {
+		b, err := json.Marshal(payload)
+		if err != nil {
+			t.Fatalf("marshalling payload: %s", err)
+		}
+		body = string(b)
+	}
+
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	return h.do(req)
+}
+
+// newEvent wraps object in a webhook event from the billing fake.
+func (h *harness) newEvent(t *testing.T, eventType string, object any) stripe.Event {
+	t.Helper()
+
+	event, err := h.billing.Event(eventType, object)
+	if err != nil {
+		t.Fatalf("creating %s event: %s", eventType, err)
+	}
+	return event
+}
+
+// sendWebhook delivers event to the webhook endpoint through the billing fake
+// and returns the response status.
+func (h *harness) sendWebhook(t *testing.T, event stripe.Event) int {
+	t.Helper()
+
+	t.Setenv("PROCESS_WEBHOOKS", "true")
+	resp, err := h.billing.SendWebhook(ctx, h.url+"/stripe-webhooks", event)
+	if err != nil {
+		t.Fatalf("sending %s webhook: %s", event.Type, err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func (h *harness) getInstance(t *testing.T, accountID, id string) account.Instance {
+	t.Helper()
+
+	i, err := h.store.GetInstance(ctx, h.crypto, accountID, id)
+	if err != nil {
+		t.Fatalf("getting instance %s: %s", id, err)
+	}
+	return i
+}
+
+func newApp() herokufake.App {
+	id := uuid.New().String()
+	return herokufake.App{
+		ID:         id,
+		Name:       "app-" + id[:8],
+		OwnerEmail: "owner-" + id[:8] + "@example.com",
+	}
+}
+
+func decode(t *testing.T, rec *httptest.ResponseRecorder, v any) {
+	t.Helper()
+
+	err := json.Unmarshal(rec.Body.Bytes(), v)
+	if err != nil {
+		t.Fatalf("decoding response %q: %s", rec.Body.String(), err)
+	}
+}
+
+func expectStatus(t *testing.T, rec *httptest.ResponseRecorder, status int) {
+	t.Helper()
+
+	if rec.Code != status {
+		t.Fatalf("got status %d, want %d, body: %s", rec.Code, status, rec.Body.String())
+	}
+}
+
+func testProvisionSSODeprovision(t *testing.T, h *harness) {
+	resourceUUID := uuid.New().String()
+	app := newApp()
+	code := h.heroku.AddAddon(resourceUUID, app)
+
+	rec := h.provision(t, resourceUUID, "free", code)
+	expectStatus(t, rec, http.StatusOK)
+
+	var provisioned web.HerokuResourceResponse
+	decode(t, rec, &provisioned)
+	if provisioned.ID != resourceUUID {
+		t.Errorf("got resource id %s, want %s", provisioned.ID, resourceUUID)
+	}
+	if provisioned.Config[provisioner.ConfigVarURL] == "" || provisioned.Config[provisioner.ConfigVarAPIKey] == "" {
+		t.Errorf("got config vars %v, want %s and %s", provisioned.Config, provisioner.ConfigVarURL, provisioner.ConfigVarAPIKey)
+	}
+
+	a, err := h.store.GetAccount(ctx, h.crypto, resourceUUID)
+	if err != nil {
+		t.Fatalf("getting provisioned account: %s", err)
+	}
+	if a.Email != app.OwnerEmail || a.Name != app.Name || a.AccountType != account.AccountTypeHeroku {
+		t.Errorf("got account %+v, want email %s and name %s", a, app.OwnerEmail, app.Name)
+	}
+	if a.AccessToken == "" || a.RefreshToken == "" {
+		t.Errorf("account has no oauth tokens")
+	}
+
+	instances, err := h.store.GetInstances(ctx, h.crypto, resourceUUID)
+	if err != nil {
+		t.Fatalf("getting instances: %s", err)
+	}
+	if len(instances) != 1 || instances[0].Plan != "free" {
+		t.Fatalf("got instances %+v, want one free instance", instances)
+	}
+
+	rec = h.sso(h.heroku.SSOForm(resourceUUID))
+	expectStatus(t, rec, http.StatusFound)
+	cookies := rec.Result().Cookies()
+	if len(cookies) == 0 {
+		t.Fatalf("sso login did not set a session cookie")
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/api/user", nil)
+	for _, c := range cookies {
+		req.AddCookie(c)
+	}
+	rec = h.do(req)
+	expectStatus(t, rec, http.StatusOK)
+
+	var user web.UserInfo
+	decode(t, rec, &user)
+	if user.UserID != resourceUUID || user.Email != app.OwnerEmail || user.Provenance != "heroku" {
+		t.Errorf("got user %+v, want %s logged in through heroku", user, app.OwnerEmail)
+	}
+
+	rec = h.herokuRequest(t, http.MethodDelete, "/heroku/resources/"+resourceUUID, nil)
+	expectStatus(t, rec, http.StatusOK)
+
+	instances, err = h.store.GetInstances(ctx, h.crypto, resourceUUID)
+	if err != nil {
+		t.Fatalf("getting instances: %s", err)
+	}
+	if len(instances) != 0 {
+		t.Errorf("got %d instances after deprovisioning, want 0", len(instances))
+	}
+
+	a, err = h.store.GetAccount(ctx, h.crypto, resourceUUID)
+	if err != nil {
+		t.Fatalf("getting deprovisioned account: %s", err)
+	}
+	if a.DeprovisionedAt.IsZero() {
+		t.Errorf("account was not marked as deprovisioned")
+	}
+
+	rec = h.herokuRequest(t, http.MethodDelete, "/heroku/resources/"+resourceUUID, nil)
+	expectStatus(t, rec, http.StatusGone)
+}
+
+func testProvisionUnknownPlan(t *testing.T, h *harness) {
+	resourceUUID := uuid.New().String()
+	code := h.heroku.AddAddon(resourceUUID, newApp())
+
+	rec := h.provision(t, resourceUUID, "enterprise", code)
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	var resp web.UnknownPlanResponse
+	decode(t, rec, &resp)
+	if resp.Plan != "enterprise" || len(resp.ValidPlans) != 2 {
+		t.Errorf("got %+v, want enterprise rejected with the 2 valid plans", resp)
+	}
+
+	if len(h.heroku.Requests()) != 0 {
+		t.Errorf("heroku was called for an unknown plan: %+v", h.heroku.Requests())
+	}
+}
+
+func testProvisionTokenExchangeFails(t *testing.T, h *harness) {
+	resourceUUID := uuid.New().String()
+	h.heroku.AddAddon(resourceUUID, newApp())
+
+	rec := h.provision(t, resourceUUID, "free", "not-a-grant")
+	expectStatus(t, rec, http.StatusBadRequest)
+
+	var resp web.ErrorResponse
+	decode(t, rec, &resp)
+	if resp.Error != "error exchanging token" || resp.Status != "failed" || resp.RequestID == "" {
+		t.Errorf("got %+v, want a failed token exchange with a request id", resp)
+	}
+
+	_, err := h.store.GetAccount(ctx, h.crypto, resourceUUID)
+	var notFoundErr *store.AccountNotFound
+	if !errors.As(err, &notFoundErr) {
+		t.Errorf("got %v getting the account, want it not to be created", err)
+	}
+}
+
+func testProvisionHerokuAPIFails(t *testing.T, h *harness) {
+	resourceUUID := uuid.New().String()
+	code := h.heroku.AddAddon(resourceUUID, newApp())
+	h.heroku.SetFailure(herokufake.EndpointCollaborators, &herokufake.Failure{
+		StatusCode: http.StatusServiceUnavailable,
+		ID:         "unavailable",
+		Message:    "API is temporarily unavailable.",
+	})
+
+	rec := h.provision(t, resourceUUID, "free", code)
+	expectStatus(t, rec, http.StatusInternalServerError)
+
+	if len(h.heroku.RequestsTo(herokufake.EndpointCollaborators)) != 1 {
+		t.Errorf("got %d collaborator requests, want 1", len(h.heroku.RequestsTo(herokufake.EndpointCollaborators)))
+	}
+
+	_, err := h.store.GetAccount(ctx, h.crypto, resourceUUID)
+	var notFoundErr *store.AccountNotFound
+	if !errors.As(err, &notFoundErr) {
+		t.Errorf("got %v getting the account, want it not to be created", err)
+	}
+}
+
+// testProvisionRetry checks that Heroku retrying a provisioning request that
+// already succeeded returns the same instance instead of creating another.
+func testProvisionRetry(t *testing.T, h *harness) {
+	resourceUUID := uuid.New().String()
+	code := h.heroku.AddAddon(resourceUUID, newApp())
+
+	rec := h.provision(t, resourceUUID, "free", code)
+	expectStatus(t, rec, http.StatusOK)
+	var first web.HerokuResourceResponse
+	decode(t, rec, &first)
+
+	rec = h.provision(t, resourceUUID, "free", code)
+	expectStatus(t, rec, http.StatusOK)
+	var second web.HerokuResourceResponse
+	decode(t, rec, &second)
+
+	if first.Config[provisioner.ConfigVarURL] != second.Config[provisioner.ConfigVarURL] {
+		t.Errorf("retry provisioned %s, want %s", second.Config[provisioner.ConfigVarURL], first.Config[provisioner.ConfigVarURL])
+	}
+
+	instances, err := h.store.GetInstances(ctx, h.crypto, resourceUUID)
+	if err != nil {
+		t.Fatalf("getting instances: %s", err)
+	}
+	if len(instances) != 1 {
+		t.Errorf("got %d instances after a retry, want 1", len(instances))
+	}
+
+	if n := len(h.heroku.RequestsTo(herokufake.EndpointToken)); n != 1 {
+		t.Errorf("got %d token exchanges, want the grant to be exchanged once", n)
+	}
+}
+
+// testAsyncProvisionSSODeprovision checks that with async provisioning the
+// request is accepted straight away and the worker exchanges the grant,
+// pushes the config vars and marks the addon as provisioned.
+func testAsyncProvisionSSODeprovision(t *testing.T, h *harness) {
+	resourceUUID := uuid.New().String()
+	app := newApp()
+	code := h.heroku.AddAddon(resourceUUID, app)
+
+	rec := h.provision(t, resourceUUID, "free", code)
+	expectStatus(t, rec, http.StatusAccepted)
+
+	var accepted web.HerokuResourceResponse
+	decode(t, rec, &accepted)
+	if accepted.ID != resourceUUID || len(accepted.Config) != 0 {
+		t.Errorf("got %+v, want %s accepted without config vars", accepted, resourceUUID)
+	}
+	if len(h.heroku.Requests()) != 0 {
+		t.Errorf("heroku was called before the worker ran: %+v", h.heroku.Requests())
+	}
+
+	h.runProvisioningWorker(t)
+	waitFor(t, "the addon to be marked as provisioned", func() bool {
+		return h.heroku.Provisioned(resourceUUID)
+	})
+
+	instances, err := h.store.GetInstances(ctx, h.crypto, resourceUUID)
+	if err != nil {
+		t.Fatalf("getting instances: %s", err)
+	}
+	if len(instances) != 1 || instances[0].Plan != "free" {
+		t.Fatalf("got instances %+v, want one free instance", instances)
+	}
+
+	pushed := h.heroku.ConfigVars(resourceUUID)
+	if pushed[provisioner.ConfigVarURL] == "" || pushed[provisioner.ConfigVarURL] != instances[0].ConfigVars[provisioner.ConfigVarURL] {
+		t.Errorf("got config vars %v pushed to heroku, want %v", pushed, instances[0].ConfigVars)
+	}
+
+	rec = h.sso(h.heroku.SSOForm(resourceUUID))
+	expectStatus(t, rec, http.StatusFound)
+
+	rec = h.herokuRequest(t, http.MethodDelete, "/heroku/resources/"+resourceUUID, nil)
+	expectStatus(t, rec, http.StatusOK)
+
+	a, err := h.store.GetAccount(ctx, h.crypto, resourceUUID)
+	if err != nil {
+		t.Fatalf("getting deprovisioned account: %s", err)
+	}
+	if a.Email != app.OwnerEmail || a.DeprovisionedAt.IsZero() {
+		t.Errorf("got account %+v, want %s deprovisioned", a, app.OwnerEmail)
+	}
+}
+
+// testAsyncProvisionRetry checks that Heroku retrying a provisioning request
+// whose job is already queued is accepted again and provisioned once.
+func testAsyncProvisionRetry(t *testing.T, h *harness) {
+	resourceUUID := uuid.New().String()
+	code := h.heroku.AddAddon(resourceUUID, newApp())
+
+	rec := h.provision(t, resourceUUID, "free", code)
+	expectStatus(t, rec, http.StatusAccepted)
+
+	rec = h.provision(t, resourceUUID, "free", code)
+	expectStatus(t, rec, http.StatusAccepted)
+
+	h.runProvisioningWorker(t)
+	waitFor(t, "the addon to be marked as provisioned", func() bool {
+		return h.heroku.Provisioned(resourceUUID)
+	})
+
+	instances, err := h.store.GetInstances(ctx, h.crypto, resourceUUID)
+	if err != nil {
+		t.Fatalf("getting instances: %s", err)
+	}
+	if len(instances) != 1 {
+		t.Errorf("got %d instances after a retry, want 1", len(instances))
+	}
+
+	if n := len(h.heroku.RequestsTo(herokufake.EndpointToken)); n != 1 {
+		t.Errorf("got %d token exchanges, want the grant to be exchanged once", n)
+	}
+}
+
+func testSSOInvalidToken(t *testing.T, h *harness) {
+	resourceUUID := uuid.New().String()
+	code := h.heroku.AddAddon(resourceUUID, newApp())
+
+	rec := h.provision(t, resourceUUID, "free", code)
+	expectStatus(t, rec, http.StatusOK)
+
+	form := h.heroku.SSOForm(resourceUUID)
+	form.Set("resource_token", "0000000000000000000000000000000000000000")
+	rec = h.sso(form)
+	expectStatus(t, rec, http.StatusForbidden)
+
+	if len(rec.Result().Cookies()) != 0 {
+		t.Errorf("a session cookie was set for an invalid sso token")
+	}
+}
+
+func testPlanChangePushesConfigVars(t *testing.T, h *harness) {
+	resourceUUID := uuid.New().String()
+	code := h.heroku.AddAddon(resourceUUID, newApp())
+
+	rec := h.provision(t, resourceUUID, "free", code)
+	expectStatus(t, rec, http.StatusOK)
+
+	rec = h.herokuRequest(t, http.MethodPut, "/heroku/resources/"+resourceUUID, heroku.PlanChangePayload{
+		Plan:     "production",
+		HerokuID: resourceUUID,
+		UUID:     resourceUUID,
+	})
+	expectStatus(t, rec, http.StatusOK)
+
+	var resp web.HerokuResourceResponse
+	decode(t, rec, &resp)
+
+	instances, err := h.store.GetInstances(ctx, h.crypto, resourceUUID)
+	if err != nil {
+		t.Fatalf("getting instances: %s", err)
+	}
+	if len(instances) != 1 || instances[0].Plan != "production" {
+		t.Fatalf("got instances %+v, want one production instance", instances)
+	}
+
+	pushed := h.heroku.ConfigVars(resourceUUID)
+	if pushed[provisioner.ConfigVarURL] != resp.Config[provisioner.ConfigVarURL] {
+		t.Errorf("got config vars %v pushed to heroku, want %v", pushed, resp.Config)
+	}
+}
+
+func testDeprovisionUnknownResource(t *testing.T, h *harness) {
+	rec := h.herokuRequest(t, http.MethodDelete, "/heroku/resources/"+uuid.New().String(), nil)
+	expectStatus(t, rec, http.StatusGone)
+}
+
+// testSubscribeThroughWebhooks subscribes a GitHub user to a paid plan, pays
+// the first invoice through the billing fake and checks that the signed
+// invoice.paid webhook activates the instance and is recorded in the ledger.
+func testSubscribeThroughWebhooks(t *testing.T, h *harness) {
+	a, cookies := h.githubLogin(t)
+
+	rec := h.userRequest(t, cookies, http.MethodPost, "/api/create-subscription", map[string]string{
+		"name": "db",
+		"plan": "production",
+	})
+	expectStatus(t, rec, http.StatusOK)
+
+	var created struct {
+		ClientSecret string `json:"clientSecret"`
+	}
+	decode(t, rec, &created)
+	if created.ClientSecret == "" {
+		t.Errorf("got no client secret to confirm the payment with")
+	}
+
+	calls := h.billing.CallsTo("CreateSubscription")
+	if len(calls) != 1 {
+		t.Fatalf("got %d CreateSubscription calls, want 1", len(calls))
+	}
+	params := calls[0].Params.(*stripe.SubscriptionParams)
+	if *params.Customer != a.StripeCustID || *params.Items[0].Price != "price_production" {
+		t.Errorf("subscribed customer %s to %s, want %s to price_production", *params.Customer, *params.Items[0].Price, a.StripeCustID)
+	}
+
+	instances, err := h.store.GetInstances(ctx, h.crypto, a.UUID)
+	if err != nil {
+		t.Fatalf("getting instances: %s", err)
+	}
+	if len(instances) != 1 || instances[0].Status != account.InstanceStatusPending || instances[0].Subscription == nil {
+		t.Fatalf("got instances %+v, want one pending instance with a subscription", instances)
+	}
+	i := instances[0]
+
+	inv, err := h.billing.PaySubscription(i.Subscription.ID)
+	if err != nil {
+		t.Fatalf("paying subscription: %s", err)
+	}
+
+	event := h.newEvent(t, "invoice.paid", inv)
+	if status := h.sendWebhook(t, event); status != http.StatusOK {
+		t.Fatalf("got status %d for invoice.paid, want 200", status)
+	}
+
+	i = h.getInstance(t, a.UUID, i.Id)
+	if i.Status != account.InstanceStatusActive || i.ConfigVars[provisioner.ConfigVarURL] == "" {
+		t.Errorf("got instance %+v, want it active with config vars", i)
+	}
+
+	record, err := h.store.GetStripeEvent(ctx, event.ID)
+	if err != nil {
+		t.Fatalf("getting stripe event: %s", err)
+	}
+	if record.Status != account.StripeEventStatusProcessed || record.Attempts != 1 || record.Type != "invoice.paid" {
+		t.Errorf("got ledger entry %+v, want invoice.paid processed once", record)
+	}
+
+	rec = h.userRequest(t, cookies, http.MethodGet, "/api/billing/invoices", nil)
+	expectStatus(t, rec, http.StatusOK)
+
+	var invoices web.InvoicesResponse
+	decode(t, rec, &invoices)
+	if len(invoices.Invoices) != 1 || invoices.Invoices[0].ID != inv.ID || invoices.Invoices[0].AmountPaid != 5000 {
+		t.Errorf("got invoices %+v, want %s paid for 5000 cents", invoices.Invoices, inv.ID)
+	}
+}
+
+// activeSubscription subscribes a GitHub user to the production plan and
+// pays for it, and returns the instance once the webhooks Stripe sends for
+// the payment have activated it.
+func (h *harness) activeSubscription(t *testing.T, a account.Account, cookies []*http.Cookie) account.Instance {
+	t.Helper()
+
+	rec := h.userRequest(t, cookies, http.MethodPost, "/api/create-subscription", map[string]string{
+		"name": "db",
+		"plan": "production",
+	})
+	expectStatus(t, rec, http.StatusOK)
+
+	instances, err := h.store.GetInstances(ctx, h.crypto, a.UUID)
+	if err != nil {
+		t.Fatalf("getting instances: %s", err)
+	}
+	if len(instances) != 1 || instances[0].Subscription == nil {
+		t.Fatalf("got instances %+v, want one with a subscription", instances)
+	}
+	i := instances[0]
+
+	inv, err := h.billing.PaySubscription(i.Subscription.ID)
+	if err != nil {
+		t.Fatalf("paying subscription: %s", err)
+	}
+	if status := h.sendWebhook(t, h.newEvent(t, "invoice.paid", inv)); status != http.StatusOK {
+		t.Fatalf("got status %d for invoice.paid, want 200", status)
+	}
+	h.sendSubscriptionUpdated(t, i.Subscription.ID)
+
+	i = h.getInstance(t, a.UUID, i.Id)
+	if i.Status != account.InstanceStatusActive || i.Subscription.Status != string(stripe.SubscriptionStatusActive) {
+		t.Fatalf("got instance %+v, want it active with an active subscription", i)
+	}
+	return i
+}
+
+// sendSubscriptionUpdated sends the customer.subscription.updated webhook
+// for the subscription as the billing fake has it now.
+func (h *harness) sendSubscriptionUpdated(t *testing.T, id string) {
+	t.Helper()
+
+	sub, err := h.billing.GetSubscription(ctx, id)
+	if err != nil {
+		t.Fatalf("getting subscription: %s", err)
+	}
+	if status := h.sendWebhook(t, h.newEvent(t, "customer.subscription.updated", sub)); status != http.StatusOK {
+		t.Fatalf("got status %d for customer.subscription.updated, want 200", status)
+	}
+}
+
+// deleteInstance deletes an instance through the user API and returns the
+// response status and the subscription cancellation outcome.
+func (h *harness) deleteInstance(t *testing.T, cookies []*http.Cookie, id string, force bool) (int, string) {
+	t.Helper()
+
+	rec := h.userRequest(t, cookies, http.MethodPost, "/api/delete-instance", map[string]any{
+		"id":    id,
+		"force": force,
+	})
+	if rec.Code != http.StatusOK {
+		return rec.Code, ""
+	}
+
+	var resp struct {
+		Subscription string `json:"subscription"`
+	}
+	decode(t, rec, &resp)
+	return rec.Code, resp.Subscription
+}
+
+func (h *harness) instanceDeletions(t *testing.T, outcome string) []account.InstanceDeletion {
+	t.Helper()
+
+	deletions, err := h.store.GetInstanceDeletions(ctx, outcome)
+	if err != nil {
+		t.Fatalf("getting %s instance deletions: %s", outcome, err)
+	}
+	return deletions
+}
+
+// chargeSucceeded is a one-off payment for a new instance, its webhook
+// creates an instance every time it is processed.
+func chargeSucceeded(customerID string) *stripe.Charge {
+	return &stripe.Charge{
+		ID:       "ch_" + uuid.New().String(),
+		Customer: &stripe.Customer{ID: customerID},
+		Metadata: map[string]string{
+			"name": "db",
+			"plan": "production",
+		},
+	}
+}
+
+func (h *harness) countInstances(t *testing.T, accountID string) int {
+	t.Helper()
+
+	instances, err := h.store.GetInstances(ctx, h.crypto, accountID)
+	if err != nil {
+		t.Fatalf("getting instances: %s", err)
+	}
+	return len(instances)
+}
+
+// testWebhookDeliveredTwice checks that Stripe retrying a delivery that was
+// already processed is acknowledged without processing the event again.
+func testWebhookDeliveredTwice(t *testing.T, h *harness) {
+	a, _ := h.githubLogin(t)
+	event := h.newEvent(t, "charge.succeeded", chargeSucceeded(a.StripeCustID))
+
+	if status := h.sendWebhook(t, event); status != http.StatusOK {
+		t.Fatalf("got status %d for the first delivery, want 200", status)
+	}
+	if status := h.sendWebhook(t, event); status != http.StatusOK {
+		t.Fatalf("got status %d for the retried delivery, want 200", status)
+	}
+
+	if n := h.countInstances(t, a.UUID); n != 1 {
+		t.Errorf("got %d instances, want the event to be processed once", n)
+	}
+
+	record, err := h.store.GetStripeEvent(ctx, event.ID)
+	if err != nil {
+		t.Fatalf("getting stripe event: %s", err)
+	}
+	if record.Status != account.StripeEventStatusProcessed || record.Attempts != 1 {
+		t.Errorf("got ledger entry %+v, want it processed in 1 attempt", record)
+	}
+}
+
+// testWebhookConcurrentDelivery checks that a delivery of an event another
+// delivery is still processing gets a 409, so that Stripe retries it later,
+// and leaves the event to the other delivery.
+func testWebhookConcurrentDelivery(t *testing.T, h *harness) {
+	a, _ := h.githubLogin(t)
+	event := h.newEvent(t, "charge.succeeded", chargeSucceeded(a.StripeCustID))
+
+	payload, _, err := h.billing.SignedPayload(event)
+	if err != nil {
+		t.Fatalf("signing event: %s", err)
+	}
+	_, claimed, err := h.store.ClaimStripeEvent(ctx, account.StripeEvent{
+		ID:      event.ID,
+		Type:    event.Type,
+		Payload: payload,
+	})
+	if err != nil || !claimed {
+		t.Fatalf("claiming event for the first delivery: claimed %t, %v", claimed, err)
+	}
+
+	if status := h.sendWebhook(t, event); status != http.StatusConflict {
+		t.Fatalf("got status %d for a concurrent delivery, want 409", status)
+	}
+
+	if n := h.countInstances(t, a.UUID); n != 0 {
+		t.Errorf("got %d instances, want the concurrent delivery not to process the event", n)
+	}
+
+	record, err := h.store.GetStripeEvent(ctx, event.ID)
+	if err != nil {
+		t.Fatalf("getting stripe event: %s", err)
+	}
+	if record.Status != account.StripeEventStatusProcessing {
+		t.Errorf("got ledger entry %+v, want it still processing", record)
+	}
+}
+
+// testWebhookReplayFailedEvent checks that an event whose processing failed
+// is recorded as failed and can be replayed from the ledger, once.
+func testWebhookReplayFailedEvent(t *testing.T, h *harness) {
+	// the customer's account doesn't exist yet, so processing fails
+	cust, err := h.billing.CreateCustomer(ctx, &stripe.CustomerParams{})
+	if err != nil {
+		t.Fatalf("creating stripe customer: %s", err)
+	}
+	event := h.newEvent(t, "charge.succeeded", chargeSucceeded(cust.ID))
+
+	if status := h.sendWebhook(t, event); status != http.StatusInternalServerError {
+		t.Fatalf("got status %d for an event that can't be processed, want 500", status)
+	}
+
+	record, err := h.store.GetStripeEvent(ctx, event.ID)
+	if err != nil {
+		t.Fatalf("getting stripe event: %s", err)
+	}
+	if record.Status != account.StripeEventStatusFailed || record.Attempts != 1 || record.LastError == "" {
+		t.Fatalf("got ledger entry %+v, want it failed after 1 attempt with the error", record)
+	}
+
+	a := account.Account{
+		UUID:         uuid.New().String(),
+		Email:        "late@example.com",
+		Name:         "Github User",
+		AccountType:  account.AccountTypeGithub,
+		StripeCustID: cust.ID,
+	}
+	err = h.store.CreateOrUpdateAccount(ctx, h.crypto, a)
+	if err != nil {
+		t.Fatalf("creating account: %s", err)
+	}
+
+	err = h.server.ReplayStripeEvent(ctx, event.ID)
+	if err != nil {
+		t.Fatalf("replaying event: %s", err)
+	}
+
+	if n := h.countInstances(t, a.UUID); n != 1 {
+		t.Errorf("got %d instances after the replay, want 1", n)
+	}
+
+	record, err = h.store.GetStripeEvent(ctx, event.ID)
+	if err != nil {
+		t.Fatalf("getting stripe event: %s", err)
+	}
+	if record.Status != account.StripeEventStatusProcessed || record.Attempts != 2 || record.LastError != "" {
+		t.Errorf("got ledger entry %+v, want it processed on the second attempt", record)
+	}
+
+	err = h.server.ReplayStripeEvent(ctx, event.ID)
+	if err == nil {
+		t.Errorf("replaying a processed event succeeded, want it refused")
+	}
+	if n := h.countInstances(t, a.UUID); n != 1 {
+		t.Errorf("got %d instances after replaying a processed event, want 1", n)
+	}
+}
+
+// testChangePlanSwapsPrice checks that changing the plan of a subscribed
+// instance swaps the price of its subscription with the difference
+// invoiced straight away, and that the plan only changes once Stripe
+// confirms the update.
+func testChangePlanSwapsPrice(t *testing.T, h *harness) {
+	a, cookies := h.githubLogin(t)
+	i := h.activeSubscription(t, a, cookies)
+
+	rec := h.userRequest(t, cookies, http.MethodPut, "/api/instances/"+i.Id+"/plan", map[string]string{
+		"plan": "free",
+	})
+	expectStatus(t, rec, http.StatusOK)
+
+	var resp struct {
+		Status string `json:"status"`
+		Plan   string `json:"plan"`
+	}
+	decode(t, rec, &resp)
+	if resp.Status != "pending" || resp.Plan != "free" {
+		t.Errorf("got %+v, want a pending change to free", resp)
+	}
+
+	if n := len(h.billing.CallsTo("CreateSubscription")); n != 1 {
+		t.Errorf("got %d CreateSubscription calls, want the existing subscription to be updated", n)
+	}
+	calls := h.billing.CallsTo("UpdateSubscription")
+	if len(calls) != 1 {
+		t.Fatalf("got %d UpdateSubscription calls, want 1", len(calls))
+	}
+	params := calls[0].Params.(*stripe.SubscriptionParams)
+	if *params.ProrationBehavior != "always_invoice" {
+		t.Errorf("got proration behavior %s, want always_invoice", *params.ProrationBehavior)
+	}
+	if len(params.Items) != 1 || *params.Items[0].Price != "price_free" || params.Items[0].ID == nil {
+		t.Errorf("got items %+v, want the existing item swapped to price_free", params.Items)
+	}
+
+	if got := h.getInstance(t, a.UUID, i.Id); got.Plan != "production" {
+		t.Errorf("got plan %s before stripe confirmed the change, want production", got.Plan)
+	}
+
+	h.sendSubscriptionUpdated(t, i.Subscription.ID)
+
+	got := h.getInstance(t, a.UUID, i.Id)
+	if got.Plan != "free" || got.Subscription.PriceID != "price_free" {
+		t.Errorf("got plan %s billed with %s, want free billed with price_free", got.Plan, got.Subscription.PriceID)
+	}
+}
+
+func testDeleteInstanceCancelsSubscription(t *testing.T, h *harness) {
+	a, cookies := h.githubLogin(t)
+	i := h.activeSubscription(t, a, cookies)
+
+	status, outcome := h.deleteInstance(t, cookies, i.Id, false)
+	if status != http.StatusOK || outcome != "cancelled" {
+		t.Fatalf("got status %d and outcome %q, want 200 and cancelled", status, outcome)
+	}
+
+	calls := h.billing.CallsTo("CancelSubscription")
+	if len(calls) != 1 || calls[0].Params != i.Subscription.ID {
+		t.Errorf("got CancelSubscription calls %+v, want %s cancelled once", calls, i.Subscription.ID)
+	}
+
+	if n := h.countInstances(t, a.UUID); n != 0 {
+		t.Errorf("got %d instances after deleting, want 0", n)
+	}
+
+	deletions := h.instanceDeletions(t, "cancelled")
+	if len(deletions) != 1 || deletions[0].InstanceID != i.Id || deletions[0].SubscriptionID != i.Subscription.ID {
+		t.Errorf("got deletions %+v, want %s recorded with %s", deletions, i.Id, i.Subscription.ID)
+	}
+}
+
+// testDeleteInstanceCancellationFails checks that an instance whose
+// subscription can't be cancelled is kept, unless the delete is forced, in
+// which case the failure is recorded for the subscription to be cancelled by
+// hand.
+func testDeleteInstanceCancellationFails(t *testing.T, h *harness) {
+	a, cookies := h.githubLogin(t)
+	i := h.activeSubscription(t, a, cookies)
+	h.billing.SetError("CancelSubscription", errors.New("stripe is down"))
+
+	status, _ := h.deleteInstance(t, cookies, i.Id, false)
+	if status != http.StatusBadGateway {
+		t.Fatalf("got status %d, want 502", status)
+	}
+	if n := h.countInstances(t, a.UUID); n != 1 {
+		t.Errorf("got %d instances after a failed delete, want the instance kept", n)
+	}
+	if deletions := h.instanceDeletions(t, "failed"); len(deletions) != 0 {
+		t.Errorf("got deletions %+v for an instance that was kept, want none", deletions)
+	}
+
+	status, outcome := h.deleteInstance(t, cookies, i.Id, true)
+	if status != http.StatusOK || outcome != "failed" {
+		t.Fatalf("got status %d and outcome %q for a forced delete, want 200 and failed", status, outcome)
+	}
+	if n := h.countInstances(t, a.UUID); n != 0 {
+		t.Errorf("got %d instances after a forced delete, want 0", n)
+	}
+
+	if n := len(h.billing.CallsTo("CancelSubscription")); n != 2 {
+		t.Errorf("got %d CancelSubscription calls, want 2", n)
+	}
+
+	deletions := h.instanceDeletions(t, "failed")
+	if len(deletions) != 1 || deletions[0].SubscriptionID != i.Subscription.ID || !strings.Contains(deletions[0].Error, "stripe is down") {
+		t.Errorf("got deletions %+v, want %s recorded with the stripe error", deletions, i.Subscription.ID)
+	}
+}
+
+// testDeleteInstanceAtPeriodEnd checks that with cancellation at the end of
+// the period the instance keeps running until Stripe ends the subscription,
+// and that deleting it again in the meantime changes nothing.
+func testDeleteInstanceAtPeriodEnd(t *testing.T, h *harness) {
+	a, cookies := h.githubLogin(t)
+	i := h.activeSubscription(t, a, cookies)
+
+	for attempt := 1; attempt <= 2; attempt++ {
+		status, outcome := h.deleteInstance(t, cookies, i.Id, false)
+		if status != http.StatusOK || outcome != "cancel_at_period_end" {
+			t.Fatalf("delete %d: got status %d and outcome %q, want 200 and cancel_at_period_end", attempt, status, outcome)
+		}
+	}
+
+	calls := h.billing.CallsTo("UpdateSubscription")
+	if len(calls) != 1 || !*calls[0].Params.(*stripe.SubscriptionParams).CancelAtPeriodEnd {
+		t.Errorf("got UpdateSubscription calls %+v, want cancel_at_period_end set once", calls)
+	}
+	if n := len(h.billing.CallsTo("CancelSubscription")); n != 0 {
+		t.Errorf("got %d CancelSubscription calls, want the subscription to run to the end of the period", n)
+	}
+
+	got := h.getInstance(t, a.UUID, i.Id)
+	if got.Status != account.InstanceStatusActive || !got.Subscription.CancelAtPeriodEnd {
+		t.Errorf("got instance %+v, want it active until the end of the period", got)
+	}
+
+	deletions := h.instanceDeletions(t, "cancel_at_period_end")
+	if len(deletions) != 1 || deletions[0].InstanceID != i.Id {
+		t.Errorf("got deletions %+v, want %s recorded once", deletions, i.Id)
+	}
+
+	sub, err := h.billing.CancelSubscription(ctx, i.Subscription.ID)
+	if err != nil {
+		t.Fatalf("ending subscription: %s", err)
+	}
+	if status := h.sendWebhook(t, h.newEvent(t, "customer.subscription.deleted", sub)); status != http.StatusOK {
+		t.Fatalf("got status %d for customer.subscription.deleted, want 200", status)
+	}
+
+	if n := h.countInstances(t, a.UUID); n != 0 {
+		t.Errorf("got %d instances after the subscription ended, want 0", n)
+	}
+}
@@ -1,19 +1,33 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/account"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/billing"
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/config"
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/crypto"
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/datadog"
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/heroku"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/metrics"
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/postgres"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/tokenmanager"
+	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/tracing"
 	"github.com/andrewmarklloyd/heroku-addon/internal/pkg/web"
 	"go.uber.org/zap"
 )
 
 var logger *zap.SugaredLogger
 
+const shutdownTimeout = 30 * time.Second
+
 func main() {
 	l, _ := zap.NewProduction()
 	logger = l.Sugar().Named("heroku-addon")
@@ -24,32 +38,150 @@ func main() {
 		logger.Fatalln("error building config: %s", err.Error())
 	}
 
-	cryptoUtil, err := crypto.NewUtil(cfg.DBEncryptionKey)
+	cryptoUtil, err := crypto.NewKeyring(cfg.DBEncryption.Keys, cfg.DBEncryption.ActiveKeyID)
 	if err != nil {
 		logger.Fatalln(fmt.Errorf("error creating crypto client: %s", err))
 	}
+	if !cfg.DBEncryption.AllowUnbound {
+		cryptoUtil.DisallowUnbound()
+	}
 
 	postgresClient, err := postgres.NewPostgresClient(cfg.PostgresURL)
 	if err != nil {
 		logger.Fatalln(fmt.Errorf("error creating postgres client: %s", err))
 	}
 
-	herokuClient := heroku.NewHerokuClient(cfg.Heroku.ClientSecret, cfg.Heroku.AddonUsername, cfg.Heroku.AddonPassword, cfg.Heroku.SSOSalt)
-
-	ddClient := datadog.NewDatadogClient(cfg.Datadog.APIKey, cfg.TestMode)
-
 	env := "prod"
 	if cfg.TestMode {
 		env = "test"
 	}
 
-	webServer, err := web.NewWebServer(logger, cfg, cryptoUtil, postgresClient, herokuClient, ddClient, env)
+	// commands only need the database, the web server is built on demand
+	// for the ones that process events
+	if len(os.Args) > 1 {
+		buildWebServer := func() (web.WebServer, error) {
+			webServer, _, err := newWebServer(cfg, cryptoUtil, &postgresClient, metrics.Noop{}, env)
+			return webServer, err
+		}
+		err = runCommand(postgresClient, cryptoUtil, buildWebServer, os.Args[1:])
+		if err != nil {
+			logger.Fatalf("running %s command: %s", os.Args[1], err)
+		}
+		return
+	}
+
+	recorder := newMetricsRecorder(cfg, env)
+
+	shutdownTracing, err := tracing.Setup(context.Background(), cfg.Tracing, env)
 	if err != nil {
-		logger.Fatalf("creating web server: %w", err)
+		logger.Fatalf("setting up tracing: %s", err)
 	}
+	defer func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := shutdownTracing(ctx)
+		if err != nil {
+			logger.Errorf("flushing traces: %s", err)
+		}
+	}()
 
-	err = webServer.HttpServer.ListenAndServe()
+	webServer, tokenManager, err := newWebServer(cfg, cryptoUtil, &postgresClient, recorder, env)
+	if err != nil {
+		logger.Fatalf("creating web server: %s", err)
+	}
+
+	err = webServer.ValidatePricingPlans(context.Background())
+	if err != nil {
+		logger.Fatalf("validating pricing plans: %s", err)
+	}
+
+	applied, err := postgresClient.MigrateUp(context.Background())
 	if err != nil {
+		logger.Fatalln(fmt.Errorf("error migrating database: %s", err))
+	}
+	logger.Infof("applied %d database migrations", applied)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	metricsDone := make(chan struct{})
+	go func() {
+		recorder.Run(ctx)
+		close(metricsDone)
+	}()
+
+	go tokenManager.Run(ctx)
+	go webServer.RunAccountPurger(ctx)
+	go webServer.RunProvisioningWorker(ctx)
+	go webServer.RunInstanceSuspender(ctx)
+
+	go func() {
+		<-ctx.Done()
+		logger.Infof("shutting down web server")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		err := webServer.HttpServer.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Errorf("shutting down web server: %s", err)
+		}
+	}()
+
+	logger.Infof("starting web server on address %s", webServer.HttpServer.Addr)
+	err = webServer.HttpServer.ListenAndServe()
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		logger.Fatalf("starting web server: %w", err)
 	}
+
+	// wait for buffered metrics to be flushed
+	<-metricsDone
+}
+
+// newWebServer builds the web server, and the token manager that keeps the
+// Heroku tokens it uses fresh.
+func newWebServer(cfg config.Server, cryptoUtil crypto.Util, postgresClient *postgres.Client, recorder metrics.Recorder, env string) (web.WebServer, tokenmanager.Manager, error) {
+	herokuClient := heroku.NewHerokuClient(heroku.ClientConfig{
+		ClientSecret:  cfg.Heroku.ClientSecret,
+		AddonUsername: cfg.Heroku.AddonUsername,
+		AddonPassword: cfg.Heroku.AddonPassword,
+		SSOSalt:       cfg.Heroku.SSOSalt,
+		APIURL:        cfg.Heroku.APIURL,
+		IdentityURL:   cfg.Heroku.IdentityURL,
+		Timeout:       cfg.Heroku.RequestTimeout,
+	})
+
+	tokenManager := tokenmanager.NewManager(logger, cryptoUtil, postgresClient, herokuClient)
+
+	pricing, err := account.LoadPricingCatalog(cfg.PricingPlansFile, env)
+	if err != nil {
+		return web.WebServer{}, tokenmanager.Manager{}, fmt.Errorf("loading pricing plans: %w", err)
+	}
+
+	billingProvider := billing.NewStripeProvider(cfg.Stripe.Key, cfg.Stripe.WebhookSigningSecret)
+
+	webServer, err := web.NewWebServer(logger, cfg, cryptoUtil, postgresClient, herokuClient, tokenManager, recorder, billingProvider, pricing, env)
+	if err != nil {
+		return web.WebServer{}, tokenmanager.Manager{}, err
+	}
+
+	return webServer, tokenManager, nil
+}
+
+// newMetricsRecorder returns the recorder for the configured metrics backend.
+func newMetricsRecorder(cfg config.Server, env string) metrics.Recorder {
+	switch cfg.Metrics.Backend {
+	case config.MetricsBackendDatadog:
+		ddClient := datadog.NewDatadogClient(cfg.Datadog.APIKey, cfg.TestMode)
+		aggregator := datadog.NewAggregator(logger, ddClient, datadog.AggregatorConfig{
+			FlushInterval: cfg.Datadog.FlushInterval,
+			FlushSize:     cfg.Datadog.FlushSize,
+			BufferSize:    cfg.Datadog.BufferSize,
+			MaxRetries:    cfg.Datadog.MaxRetries,
+			RetryBackoff:  time.Second,
+		})
+		return metrics.NewDatadogRecorder(aggregator)
+	case config.MetricsBackendPrometheus:
+		return metrics.NewPrometheusRecorder(logger, env, cfg.Metrics.PrometheusAddr)
+	default:
+		return metrics.Noop{}
+	}
 }